@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/carl-mastrangelo/gammux/internal"
+)
+
+// Muxes every pair of images in dir named with the thumbnail and full suffixes, such as
+// name.thumb.png and name.full.png, into name.muxed.png.  Pairs are muxed workers at a time, and
+// within the MemoryBudget of opts if it is set.  A pair failing doesn't stop the others.  Prints
+// what happened to each pair, and a summary.
+func GammaMuxBatch(dir, thumbSuffix, fullSuffix string, workers int,
+	opts internal.Options) *internal.ErrChain {
+	if thumbSuffix == "" || fullSuffix == "" || thumbSuffix == fullSuffix {
+		return internal.ChainErr(nil, "Batch thumbnail and full suffixes must differ")
+	}
+	if workers < 1 {
+		return internal.ChainErr(nil, "-batch-workers must be at least 1")
+	}
+	thumbs, err := filepath.Glob(filepath.Join(dir, "*"+thumbSuffix))
+	if err != nil {
+		return internal.ChainErr(err, "Unable to list batch directory")
+	}
+	sort.Strings(thumbs)
+	// Each pair has its own layout, so there is no single one to report.
+	opts.Layout = nil
+
+	var sched *internal.MemoryScheduler
+	if opts.MemoryBudget > 0 {
+		sched = internal.NewMemoryScheduler(opts.MemoryBudget)
+	}
+	results := make([]string, len(thumbs))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i] = muxBatchPair(thumbs[i], strings.TrimSuffix(thumbs[i], thumbSuffix),
+					fullSuffix, sched, opts)
+			}
+		}()
+	}
+	for i := range thumbs {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	counts := make(map[string]int)
+	for i, thumb := range thumbs {
+		fmt.Printf("%s: %s\n", thumb, results[i])
+		counts[strings.SplitN(results[i], ":", 2)[0]]++
+	}
+	fmt.Printf("%d muxed, %d missing full, %d failed\n",
+		counts["muxed"], counts["missing full"], counts["failed"])
+	if counts["failed"] > 0 {
+		return internal.ChainErr(nil, fmt.Sprintf("%d pairs failed", counts["failed"]))
+	}
+	return nil
+}
+
+// Muxes the thumb of a batch pair with the Full image named name plus fullSuffix, waiting for its
+// share of sched if it isn't nil, and says what happened.
+func muxBatchPair(thumb, name, fullSuffix string, sched *internal.MemoryScheduler,
+	opts internal.Options) string {
+	full := name + fullSuffix
+	if _, err := os.Stat(full); err != nil {
+		return "missing full: " + full
+	}
+	if sched != nil {
+		cost := internal.EstimateMuxMemory(imageFileSize(thumb), imageFileSize(full), opts)
+		if sched.Acquire(cost) {
+			log.Printf("%s waited for %d bytes of the memory budget", thumb, cost)
+		}
+		defer sched.Release(cost)
+	}
+	dest := name + ".muxed.png"
+	if ec := GammaMuxFiles(thumb, full, dest, opts); ec != nil {
+		// Don't leave a half written image behind to be mistaken for a muxed one.
+		os.Remove(dest)
+		return "failed: " + strings.Replace(ec.Error(), "\n", " ", -1)
+	}
+	return "muxed"
+}
+
+// Returns the size of the image at path from its header, or nothing if it can't be read, leaving
+// the error for muxing to report.
+func imageFileSize(path string) image.Point {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Point{}
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return image.Point{}
+	}
+	return image.Pt(config.Width, config.Height)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/carl-mastrangelo/gammux/internal"
+)
+
+func writeTestPNG(t *testing.T, path string, w, h int, c color.Color) {
+	t.Helper()
+	im := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			im.Set(x, y, c)
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, im); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// With a budget too small for even one pair, pairs still run, one at a time.
+func TestGammaMuxBatchMemoryBudget(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"a", "b", "c"}
+	for _, name := range names {
+		writeTestPNG(t, filepath.Join(dir, name+".thumb.png"), 8, 8, color.Gray{0x80})
+		writeTestPNG(t, filepath.Join(dir, name+".full.png"), 4, 4, color.White)
+	}
+	opts := internal.Options{MemoryBudget: 1}
+	if ec := GammaMuxBatch(dir, ".thumb.png", ".full.png", len(names), opts); ec != nil {
+		t.Fatal(ec)
+	}
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name+".muxed.png")); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestImageFileSize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "im.png")
+	writeTestPNG(t, path, 5, 3, color.White)
+	if got, want := imageFileSize(path), image.Pt(5, 3); got != want {
+		t.Errorf("imageFileSize() = %v, want %v", got, want)
+	}
+	if got := imageFileSize(filepath.Join(dir, "missing.png")); got != (image.Point{}) {
+		t.Errorf("imageFileSize() of a missing file = %v", got)
+	}
+}
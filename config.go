@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/carl-mastrangelo/gammux/internal"
+)
+
+// The config file used when -config isn't set, if it exists.
+const defaultConfigFile = "gammux.json"
+
+// Sets each flag named in the JSON object at path to its value, unless it was already set on the
+// command line.  A missing default config file is not an error.
+func loadConfig(path string) *internal.ErrChain {
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); os.IsNotExist(err) {
+			return nil
+		}
+		path = defaultConfigFile
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return internal.ChainErr(err, "Unable to read config file")
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return internal.ChainErr(err, "Unable to parse config file "+path)
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var unknown []string
+	for name := range config {
+		if flag.Lookup(name) == nil || name == "config" {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return internal.ChainErr(nil, fmt.Sprintf(
+			"Unknown options in config file %s: %s", path, strings.Join(unknown, ", ")))
+	}
+
+	for name, v := range config {
+		if set[name] {
+			continue
+		}
+		var value string
+		switch v := v.(type) {
+		case string:
+			value = v
+		case float64:
+			// Not 'g', which writes 1e6 as 1e+06, and integer flags can't parse that.
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			value = strconv.FormatBool(v)
+		default:
+			return internal.ChainErr(nil, fmt.Sprintf(
+				"Option %s in config file %s must be a string, number, or bool", name, path))
+		}
+		if err := flag.Set(name, value); err != nil {
+			return internal.ChainErr(err, fmt.Sprintf(
+				"Unable to set option %s from config file %s", name, path))
+		}
+	}
+	return nil
+}
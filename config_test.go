@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Large integral numbers must reach integer flags without an exponent.
+func TestLoadConfigNumbers(t *testing.T) {
+	oldOptimize, oldScale := *printoptimize, *thumbscale
+	defer func() {
+		*printoptimize, *thumbscale = oldOptimize, oldScale
+	}()
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"print-optimize": 1e6, "thumb-scale": 0.0000125}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ec := loadConfig(path); ec != nil {
+		t.Fatal(ec)
+	}
+	if *printoptimize != 1000000 {
+		t.Errorf("print-optimize = %d, want 1000000", *printoptimize)
+	}
+	if *thumbscale != 0.0000125 {
+		t.Errorf("thumb-scale = %v, want 0.0000125", *thumbscale)
+	}
+}
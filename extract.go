@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/carl-mastrangelo/gammux/internal"
+)
+
+// Recovers the Full image hidden in a muxed PNG.
+func runExtract(args []string) {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	in := fs.String("in", "", "The file path of the muxed PNG image")
+	out := fs.String("out", "", "The dest file path of the recovered Full image")
+	scaling := fs.Int("full-scaling", 2, "The -full-scaling the image was muxed with")
+	corner := fs.String("lattice-corner", "", "The -lattice-corner the image was muxed with."+
+		"  If unset, it is detected.")
+	fs.Parse(args)
+
+	opts := internal.Options{FullScaling: *scaling, LatticeCorner: *corner}
+	if ec := ExtractFile(*in, *out, opts); ec != nil {
+		log.Println(ec)
+		os.Exit(1)
+	}
+}
+
+func ExtractFile(in, out string, opts internal.Options) *internal.ErrChain {
+	inf, err := os.Open(in)
+	if err != nil {
+		return internal.ChainErr(err, "Unable to open muxed file")
+	}
+	defer inf.Close()
+
+	outf, err := os.Create(out)
+	if err != nil {
+		return internal.ChainErr(err, "Unable create dest file")
+	}
+	defer outf.Close()
+
+	return internal.ExtractFull(inf, outf, opts)
+}
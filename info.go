@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/carl-mastrangelo/gammux/internal"
+)
+
+// Prints the dimensions and gamma of a PNG, reading from stdin if the path is "-".
+func runInfo(args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gammux info <file.png | ->")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if ec := InfoFile(fs.Arg(0)); ec != nil {
+		log.Println(ec)
+		os.Exit(1)
+	}
+}
+
+func InfoFile(path string) *internal.ErrChain {
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return internal.ChainErr(err, "Unable to open input file")
+		}
+		defer f.Close()
+		in = f
+	}
+
+	info, ec := internal.ReadPNGInfo(in)
+	if ec != nil {
+		return ec
+	}
+	fmt.Printf("Dimensions: %dx%d\n", info.Width, info.Height)
+	fmt.Printf("Bit depth:  %d\n", info.BitDepth)
+	fmt.Printf("Color type: %d\n", info.ColorType)
+	fmt.Printf("Interlaced: %t\n", info.Interlaced)
+	if info.HasGamma {
+		if info.GamaValue == internal.GamaChunkValue(internal.DefaultTargetGamma) {
+			fmt.Printf("Gamma:      %.4g (gAMA %d, the muxing default)\n",
+				info.Gamma, info.GamaValue)
+		} else {
+			fmt.Printf("Gamma:      %.4g (gAMA %d)\n", info.Gamma, info.GamaValue)
+		}
+	} else {
+		fmt.Printf("Gamma:      none\n")
+	}
+	fmt.Printf("Chunks:     %s\n", strings.Join(info.Chunks, " "))
+	if info.Truncated {
+		fmt.Printf("Truncated:  stream ended before the image data\n")
+	}
+	return nil
+}
+
+// Checks that a PNG is still muxed, such as before uploading it.  Exits with 1 if it isn't.
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gammux verify <file.png>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Println(internal.ChainErr(err, "Unable to open input file"))
+		os.Exit(1)
+	}
+	defer f.Close()
+	muxed, ec := internal.IsMuxed(f)
+	if ec != nil {
+		log.Println(ec)
+		os.Exit(1)
+	}
+	if !muxed {
+		fmt.Println("Not muxed: the PNG doesn't declare a high enough gamma")
+		os.Exit(1)
+	}
+	fmt.Println("Muxed")
+}
@@ -0,0 +1,497 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/png"
+	"io"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// APNG frame disposal and blending, as stored in fcTL chunks.
+const (
+	apngDisposeNone       = 0
+	apngDisposeBackground = 1
+	apngDisposePrevious   = 2
+
+	apngBlendSource = 0
+)
+
+// An APNG frame control chunk.
+type apngFrameControl struct {
+	width, height      uint32
+	x, y               uint32
+	delayNum, delayDen uint16
+	dispose, blend     uint8
+}
+
+func parseFrameControl(data []byte) (*apngFrameControl, *ErrChain) {
+	if len(data) != 26 {
+		return nil, ChainErr(nil, fmt.Sprintf("Bad APNG fcTL chunk length %d", len(data)))
+	}
+	return &apngFrameControl{
+		width:    binary.BigEndian.Uint32(data[4:8]),
+		height:   binary.BigEndian.Uint32(data[8:12]),
+		x:        binary.BigEndian.Uint32(data[12:16]),
+		y:        binary.BigEndian.Uint32(data[16:20]),
+		delayNum: binary.BigEndian.Uint16(data[20:22]),
+		delayDen: binary.BigEndian.Uint16(data[22:24]),
+		dispose:  data[24],
+		blend:    data[25],
+	}, nil
+}
+
+// Calls header with the frame count and play count (0 means forever) of an animated GIF or APNG,
+// and then frame with each frame as it is shown, one at a time.  APNG frames are decoded one at a
+// time, so long animations don't need much memory, but image/gif can only decode a GIF whole, so
+// every frame of a GIF is held at once.  Still images are a single frame.  The MaxPixels of opts
+// limits the size of the whole animation, and MaxDecodeTime each decode, which is every frame of
+// a GIF, but a single APNG frame.
+func decodeAnimation(data []byte, opts Options, header func(frames, plays int) *ErrChain,
+	frame func(im image.Image, delayNum, delayDen uint16) *ErrChain) *ErrChain {
+	if err := checkDataPixels(data, opts.MaxPixels); err != nil {
+		return ChainErr(err, "Unable to decode image")
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return decodeGIFAnimation(data, opts.MaxDecodeTime, header, frame)
+	case bytes.HasPrefix(data, pngSignature):
+		return decodeAPNGAnimation(data, opts.MaxDecodeTime, header, frame)
+	}
+	var im image.Image
+	err := decodeWithin(opts.MaxDecodeTime, func() (err error) {
+		im, _, err = image.Decode(bytes.NewReader(data))
+		return err
+	})
+	if err != nil {
+		return ChainErr(err, "Unable to decode image")
+	}
+	if ec := header(1, 0); ec != nil {
+		return ec
+	}
+	return frame(im, 0, 1)
+}
+
+func decodeGIFAnimation(data []byte, timeout time.Duration,
+	header func(frames, plays int) *ErrChain,
+	frame func(im image.Image, delayNum, delayDen uint16) *ErrChain) *ErrChain {
+	var g *gif.GIF
+	err := decodeWithin(timeout, func() (err error) {
+		g, err = gif.DecodeAll(bytes.NewReader(data))
+		return err
+	})
+	if err != nil {
+		return ChainErr(err, "Unable to decode GIF")
+	}
+	// GIFs count the extra times to loop, with 0 meaning forever and -1 meaning no looping.
+	plays := 0
+	switch {
+	case g.LoopCount < 0:
+		plays = 1
+	case g.LoopCount > 0:
+		plays = g.LoopCount + 1
+	}
+	if ec := header(len(g.Image), plays); ec != nil {
+		return ec
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, pal := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneNRGBA(canvas)
+		}
+		draw.Draw(canvas, pal.Bounds(), pal, pal.Bounds().Min, draw.Over)
+		if ec := frame(cloneNRGBA(canvas), uint16(g.Delay[i]), 100); ec != nil {
+			return ChainErr(ec, fmt.Sprintf("Unable to process frame %d", i))
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, pal.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return nil
+}
+
+// Decodes frame index of an animated GIF, as it is shown after the frames before it, within the
+// MaxPixels and MaxDecodeTime of opts.
+func decodeGIFFrame(data []byte, index int, opts Options) (image.Image, *ErrChain) {
+	if err := checkDataPixels(data, opts.MaxPixels); err != nil {
+		return nil, ChainErr(err, "Unable to decode GIF")
+	}
+	var im image.Image
+	var i int
+	header := func(frames, plays int) *ErrChain {
+		if index < 0 || index >= frames {
+			if ec := opts.warn(fmt.Sprintf(
+				"GIF has %d frames, no frame %d, using the first", frames, index)); ec != nil {
+				return ec
+			}
+			index = 0
+		}
+		return nil
+	}
+	frame := func(canvas image.Image, delayNum, delayDen uint16) *ErrChain {
+		if i == index {
+			im = canvas
+		}
+		i++
+		return nil
+	}
+	if ec := decodeGIFAnimation(data, opts.MaxDecodeTime, header, frame); ec != nil {
+		return nil, ec
+	}
+	return im, nil
+}
+
+func decodeAPNGAnimation(data []byte, timeout time.Duration,
+	header func(frames, plays int) *ErrChain,
+	frame func(im image.Image, delayNum, delayDen uint16) *ErrChain) *ErrChain {
+	var (
+		ihdr     []byte
+		shared   [][2]string
+		animated bool
+		canvas   *image.NRGBA
+		control  *apngFrameControl
+		frameDat bytes.Buffer
+		frames   int
+	)
+	// Decodes the pending frame on its own, and draws it onto the canvas.
+	finish := func() *ErrChain {
+		if control == nil {
+			return nil
+		}
+		fc := control
+		control = nil
+		if canvas == nil {
+			return ChainErr(nil, "APNG frame before the PNG IHDR chunk")
+		}
+		region := image.Rect(int(fc.x), int(fc.y), int(fc.x+fc.width), int(fc.y+fc.height))
+		if !region.In(canvas.Bounds()) {
+			return ChainErr(nil, fmt.Sprintf("APNG frame %d is outside the image", frames))
+		}
+		var single bytes.Buffer
+		single.Write(pngSignature)
+		frameIhdr := append([]byte(nil), ihdr...)
+		binary.BigEndian.PutUint32(frameIhdr[0:4], fc.width)
+		binary.BigEndian.PutUint32(frameIhdr[4:8], fc.height)
+		if err := writePngChunk(&single, "IHDR", frameIhdr); err != nil {
+			return ChainErr(err, "Unable to rebuild APNG frame")
+		}
+		for _, chunk := range shared {
+			if err := writePngChunk(&single, chunk[0], []byte(chunk[1])); err != nil {
+				return ChainErr(err, "Unable to rebuild APNG frame")
+			}
+		}
+		if err := writePngChunk(&single, "IDAT", frameDat.Bytes()); err != nil {
+			return ChainErr(err, "Unable to rebuild APNG frame")
+		}
+		if err := writePngChunk(&single, "IEND", nil); err != nil {
+			return ChainErr(err, "Unable to rebuild APNG frame")
+		}
+		frameDat.Reset()
+		var im image.Image
+		err := decodeWithin(timeout, func() (err error) {
+			im, err = png.Decode(&single)
+			return err
+		})
+		if err != nil {
+			return ChainErr(err, fmt.Sprintf("Unable to decode APNG frame %d", frames))
+		}
+
+		var previous *image.NRGBA
+		if fc.dispose == apngDisposePrevious {
+			previous = cloneNRGBA(canvas)
+		}
+		op := draw.Over
+		if fc.blend == apngBlendSource {
+			op = draw.Src
+		}
+		draw.Draw(canvas, region, im, im.Bounds().Min, op)
+		delayDen := fc.delayDen
+		if delayDen == 0 {
+			delayDen = 100
+		}
+		if ec := frame(cloneNRGBA(canvas), fc.delayNum, delayDen); ec != nil {
+			return ChainErr(ec, fmt.Sprintf("Unable to process frame %d", frames))
+		}
+		frames++
+		switch fc.dispose {
+		case apngDisposeBackground:
+			draw.Draw(canvas, region, image.Transparent, image.Point{}, draw.Src)
+		case apngDisposePrevious:
+			canvas = previous
+		}
+		return nil
+	}
+
+	cr := NewPNGChunkReader(bytes.NewReader(data))
+	for {
+		chunkType, chunkData, err := cr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return ChainErr(err, "Unable to read PNG")
+		}
+		switch chunkType {
+		case "IHDR":
+			if len(chunkData) != 13 {
+				return ChainErr(nil, "Bad PNG IHDR chunk")
+			}
+			ihdr = chunkData
+			canvas = image.NewNRGBA(image.Rect(0, 0,
+				int(binary.BigEndian.Uint32(chunkData[0:4])),
+				int(binary.BigEndian.Uint32(chunkData[4:8]))))
+		case "PLTE", "tRNS":
+			shared = append(shared, [2]string{chunkType, string(chunkData)})
+		case "acTL":
+			if len(chunkData) != 8 {
+				return ChainErr(nil, "Bad APNG acTL chunk")
+			}
+			animated = true
+			ec := header(int(binary.BigEndian.Uint32(chunkData[0:4])),
+				int(binary.BigEndian.Uint32(chunkData[4:8])))
+			if ec != nil {
+				return ec
+			}
+		case "fcTL":
+			if ec := finish(); ec != nil {
+				return ec
+			}
+			var ec *ErrChain
+			if control, ec = parseFrameControl(chunkData); ec != nil {
+				return ec
+			}
+		case "IDAT":
+			// Without a fcTL first, the default image isn't part of the animation.
+			if control != nil {
+				frameDat.Write(chunkData)
+			}
+		case "fdAT":
+			if len(chunkData) < 4 {
+				return ChainErr(nil, "Bad APNG fdAT chunk")
+			}
+			frameDat.Write(chunkData[4:])
+		case "IEND":
+			if ec := finish(); ec != nil {
+				return ec
+			}
+		}
+	}
+	if animated {
+		return nil
+	}
+
+	var im image.Image
+	err := decodeWithin(timeout, func() (err error) {
+		im, err = png.Decode(bytes.NewReader(data))
+		return err
+	})
+	if err != nil {
+		return ChainErr(err, "Unable to decode PNG")
+	}
+	if ec := header(1, 0); ec != nil {
+		return ec
+	}
+	return frame(im, 0, 1)
+}
+
+func cloneNRGBA(im *image.NRGBA) *image.NRGBA {
+	dst := image.NewNRGBA(im.Bounds())
+	copy(dst.Pix, im.Pix)
+	return dst
+}
+
+// Reports whether data is a GIF or APNG with more than one frame.
+func isAnimated(data []byte) bool {
+	if bytes.HasPrefix(data, []byte("GIF8")) {
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		return err == nil && len(g.Image) > 1
+	}
+	if !bytes.HasPrefix(data, pngSignature) {
+		return false
+	}
+	cr := NewPNGChunkReader(bytes.NewReader(data))
+	for {
+		chunkType, chunkData, err := cr.Next()
+		if err != nil || chunkType == "IDAT" {
+			return false
+		}
+		if chunkType == "acTL" {
+			return len(chunkData) == 8 && binary.BigEndian.Uint32(chunkData[0:4]) > 1
+		}
+	}
+}
+
+// Writes muxed frames as an APNG, each as soon as it is ready.  If plain is set, the frames are
+// ordinary images instead, and no gamma is declared.
+type apngWriter struct {
+	dest   io.Writer
+	opts   Options
+	plain  bool
+	frames int
+	plays  int
+	ihdr   []byte
+	seq    uint32
+	count  int
+}
+
+func (aw *apngWriter) writeFrame(muxed *image.NRGBA, delayNum, delayDen uint16) *ErrChain {
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: aw.opts.CompressionLevel}
+	if err := encoder.Encode(&buf, muxed); err != nil {
+		return ChainErr(err, "Unable to encode frame")
+	}
+	var ihdr []byte
+	var idat bytes.Buffer
+	cr := NewPNGChunkReader(&buf)
+	for {
+		chunkType, data, err := cr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return ChainErr(err, "Unable to read encoded frame")
+		}
+		switch chunkType {
+		case "IHDR":
+			ihdr = data
+		case "IDAT":
+			idat.Write(data)
+		}
+	}
+
+	if aw.ihdr == nil {
+		aw.ihdr = ihdr
+		if _, err := aw.dest.Write(pngSignature); err != nil {
+			return ChainErr(err, "Unable to write PNG signature")
+		}
+		if err := writePngChunk(aw.dest, "IHDR", ihdr); err != nil {
+			return ChainErr(err, "Unable to write PNG IHDR chunk")
+		}
+		if !aw.plain {
+			if ec := writeGamaPngChunk(aw.dest, aw.opts.targetGamma()); ec != nil {
+				return ec
+			}
+		}
+		if aw.opts.EmbedICC && !aw.plain {
+			if ec := writeIccpPngChunk(aw.dest, aw.opts.targetGamma(), false); ec != nil {
+				return ec
+			}
+		}
+		if ec := writeTextPngChunks(aw.dest, aw.opts.Text); ec != nil {
+			return ec
+		}
+		actl := make([]byte, 8)
+		binary.BigEndian.PutUint32(actl[0:4], uint32(aw.frames))
+		binary.BigEndian.PutUint32(actl[4:8], uint32(aw.plays))
+		if err := writePngChunk(aw.dest, "acTL", actl); err != nil {
+			return ChainErr(err, "Unable to write APNG acTL chunk")
+		}
+	} else if !bytes.Equal(ihdr, aw.ihdr) {
+		return ChainErr(nil, "Frames encoded differently, so they can't share an APNG")
+	}
+
+	fctl := make([]byte, 26)
+	binary.BigEndian.PutUint32(fctl[0:4], aw.seq)
+	binary.BigEndian.PutUint32(fctl[4:8], uint32(muxed.Bounds().Dx()))
+	binary.BigEndian.PutUint32(fctl[8:12], uint32(muxed.Bounds().Dy()))
+	binary.BigEndian.PutUint16(fctl[20:22], delayNum)
+	binary.BigEndian.PutUint16(fctl[22:24], delayDen)
+	fctl[24], fctl[25] = apngDisposeNone, apngBlendSource
+	aw.seq++
+	if err := writePngChunk(aw.dest, "fcTL", fctl); err != nil {
+		return ChainErr(err, "Unable to write APNG fcTL chunk")
+	}
+	if aw.count == 0 {
+		// The first frame doubles as the still image for viewers without APNG support.
+		if err := writePngChunk(aw.dest, "IDAT", idat.Bytes()); err != nil {
+			return ChainErr(err, "Unable to write PNG IDAT chunk")
+		}
+	} else {
+		fdat := make([]byte, 4+idat.Len())
+		binary.BigEndian.PutUint32(fdat[0:4], aw.seq)
+		copy(fdat[4:], idat.Bytes())
+		aw.seq++
+		if err := writePngChunk(aw.dest, "fdAT", fdat); err != nil {
+			return ChainErr(err, "Unable to write APNG fdAT chunk")
+		}
+	}
+	aw.count++
+	return nil
+}
+
+func (aw *apngWriter) close() *ErrChain {
+	if aw.count != aw.frames {
+		return ChainErr(nil, fmt.Sprintf("Expected %d frames, got %d", aw.frames, aw.count))
+	}
+	if err := writePngChunk(aw.dest, "IEND", nil); err != nil {
+		return ChainErr(err, "Unable to write PNG IEND chunk")
+	}
+	return nil
+}
+
+// Muxes each frame of an animated Thumbnail with the same still Full image, and writes the result
+// as an APNG.  Viewers that ignore gamma play the Thumbnail's animation, and those that honor it
+// show the still Full image.  The Full image may not be animated too.
+func gammuxAnimatedData(thumbnail, full io.Reader, dest io.Writer, opts Options) *ErrChain {
+	if opts.Format != "" && opts.Format != "png" {
+		return ChainErr(nil, "Animated Thumbnails can only be written as PNG")
+	}
+	if opts.BitDepth == 16 {
+		return ChainErr(nil, "Animated Thumbnails can only be written with 8 bits")
+	}
+	start := time.Now()
+	fdata, err := io.ReadAll(full)
+	if err != nil {
+		return ChainErr(err, "Unable to read full")
+	}
+	// Checked before isAnimated, which decodes a GIF whole.
+	if err := checkDataPixels(fdata, opts.MaxPixels); err != nil {
+		return decodeErr(err, "full")
+	}
+	if isAnimated(fdata) {
+		return ChainErr(nil, "Only the Thumbnail may be animated, not the Full image")
+	}
+	if opts.SourceGamma == 0 {
+		opts.SourceGamma = declaredGamma(fdata)
+	}
+	fim, err := decodeImage(bytes.NewReader(fdata), opts)
+	if err != nil {
+		return decodeErr(err, "full")
+	}
+	tdata, err := io.ReadAll(thumbnail)
+	if err != nil {
+		return ChainErr(err, "Unable to read thumbnail")
+	}
+	opts.Timings.record("decode", start)
+
+	aw := &apngWriter{dest: dest, opts: opts}
+	header := func(frames, plays int) *ErrChain {
+		aw.frames, aw.plays = frames, plays
+		return nil
+	}
+	frame := func(tim image.Image, delayNum, delayDen uint16) *ErrChain {
+		dim, ec := GammaMuxImagesOpts(tim, fim, opts)
+		if ec != nil {
+			return ec
+		}
+		start := time.Now()
+		defer opts.Timings.record("encode", start)
+		return aw.writeFrame(dim.(*image.NRGBA), delayNum, delayDen)
+	}
+	if ec := decodeAnimation(tdata, opts, header, frame); ec != nil {
+		return ChainErr(ec, "Unable to mux animated thumbnail")
+	}
+	return aw.close()
+}
@@ -0,0 +1,268 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Returns a GIF of frames solid frames of 8x8 pixels, each with its own color and delay.
+func testGIF(t *testing.T, frames, loopCount int) []byte {
+	t.Helper()
+	pal := color.Palette{color.Black, color.White, color.NRGBA{0xFF, 0, 0, 0xFF}}
+	g := &gif.GIF{LoopCount: loopCount}
+	for i := 0; i < frames; i++ {
+		im := image.NewPaletted(image.Rect(0, 0, 8, 8), pal)
+		for j := range im.Pix {
+			im.Pix[j] = uint8(i % len(pal))
+		}
+		g.Image = append(g.Image, im)
+		g.Delay = append(g.Delay, 10*(i+1))
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeGIFLoopCount(t *testing.T) {
+	tests := []struct {
+		loopCount, plays int
+	}{
+		{0, 0},
+		{-1, 1},
+		{1, 2},
+		{5, 6},
+	}
+	for _, tt := range tests {
+		plays := -1
+		header := func(frames, p int) *ErrChain {
+			plays = p
+			return nil
+		}
+		frame := func(image.Image, uint16, uint16) *ErrChain {
+			return nil
+		}
+		if ec := decodeAnimation(testGIF(t, 2, tt.loopCount), Options{}, header, frame); ec != nil {
+			t.Fatal(ec)
+		}
+		if plays != tt.plays {
+			t.Errorf("LoopCount %d: %d plays, want %d", tt.loopCount, plays, tt.plays)
+		}
+	}
+}
+
+// Returns an APNG of frames solid 8x8 frames, each shown for i+1 tenths of a second.
+func testAPNG(t *testing.T, frames, plays int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	aw := &apngWriter{dest: &buf, plain: true, frames: frames, plays: plays}
+	for i := 0; i < frames; i++ {
+		c := uint8(i * 0xFF / frames)
+		im := uniformNRGBA(color.NRGBA{c, c, c, 0xFF})
+		if ec := aw.writeFrame(im, uint16(i+1), 10); ec != nil {
+			t.Fatal(ec)
+		}
+	}
+	if ec := aw.close(); ec != nil {
+		t.Fatal(ec)
+	}
+	return buf.Bytes()
+}
+
+func testPNGData(t *testing.T, im image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, im); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type pngChunk struct {
+	chunkType string
+	data      []byte
+}
+
+func readChunks(t *testing.T, data []byte) []pngChunk {
+	t.Helper()
+	var chunks []pngChunk
+	cr := NewPNGChunkReader(bytes.NewReader(data))
+	for {
+		chunkType, chunkData, err := cr.Next()
+		if err == io.EOF {
+			return chunks
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, pngChunk{chunkType, chunkData})
+	}
+}
+
+func TestGammuxAnimated(t *testing.T) {
+	type wantFrame struct {
+		delayNum, delayDen uint16
+	}
+	tests := []struct {
+		name      string
+		thumbnail []byte
+		plays     uint32
+		frames    []wantFrame
+	}{
+		{"gif", testGIF(t, 3, 2), 3, []wantFrame{{10, 100}, {20, 100}, {30, 100}}},
+		{"apng", testAPNG(t, 3, 2), 2, []wantFrame{{1, 10}, {2, 10}, {3, 10}}},
+	}
+	full := testPNGData(t, uniformNRGBA(color.NRGBA{0xFF, 0xFF, 0xFF, 0xFF}))
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		ec := gammuxAnimatedData(
+			bytes.NewReader(tt.thumbnail), bytes.NewReader(full), &buf, Options{})
+		if ec != nil {
+			t.Fatalf("%s: %v", tt.name, ec)
+		}
+		// Viewers without APNG support see the first frame.
+		if _, err := png.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		var types []string
+		var seqs []uint32
+		var frames []wantFrame
+		for _, c := range readChunks(t, buf.Bytes()) {
+			types = append(types, c.chunkType)
+			switch c.chunkType {
+			case "acTL":
+				if n, plays := binary.BigEndian.Uint32(c.data[0:4]),
+					binary.BigEndian.Uint32(c.data[4:8]); n != 3 || plays != tt.plays {
+					t.Errorf("%s: acTL of %d frames and %d plays, want 3 and %d",
+						tt.name, n, plays, tt.plays)
+				}
+			case "fcTL":
+				fc, ec := parseFrameControl(c.data)
+				if ec != nil {
+					t.Fatal(ec)
+				}
+				if fc.width != 8 || fc.height != 8 || fc.x != 0 || fc.y != 0 {
+					t.Errorf("%s: frame %d is %dx%d at %d,%d, want the whole 8x8 image",
+						tt.name, len(frames), fc.width, fc.height, fc.x, fc.y)
+				}
+				if fc.dispose != apngDisposeNone || fc.blend != apngBlendSource {
+					t.Errorf("%s: frame %d disposes with %d and blends with %d",
+						tt.name, len(frames), fc.dispose, fc.blend)
+				}
+				seqs = append(seqs, binary.BigEndian.Uint32(c.data[0:4]))
+				frames = append(frames, wantFrame{fc.delayNum, fc.delayDen})
+			case "fdAT":
+				seqs = append(seqs, binary.BigEndian.Uint32(c.data[0:4]))
+			}
+		}
+		wantTypes := []string{
+			"IHDR", "gAMA", "acTL", "fcTL", "IDAT", "fcTL", "fdAT", "fcTL", "fdAT", "IEND"}
+		if !slices.Equal(types, wantTypes) {
+			t.Errorf("%s: chunks %v, want %v", tt.name, types, wantTypes)
+		}
+		for i, seq := range seqs {
+			if seq != uint32(i) {
+				t.Errorf("%s: sequence numbers %v, want counting up from 0", tt.name, seqs)
+				break
+			}
+		}
+		if len(frames) != len(tt.frames) {
+			t.Fatalf("%s: %d frames, want %d", tt.name, len(frames), len(tt.frames))
+		}
+		for i, got := range frames {
+			if want := tt.frames[i]; got != want {
+				t.Errorf("%s: frame %d delay %d/%d, want %d/%d", tt.name, i,
+					got.delayNum, got.delayDen, want.delayNum, want.delayDen)
+			}
+		}
+	}
+}
+
+func TestGammuxAnimatedFull(t *testing.T) {
+	thumbnail := testGIF(t, 2, 0)
+	for _, full := range [][]byte{testGIF(t, 2, 0), testAPNG(t, 2, 0)} {
+		ec := gammuxAnimatedData(
+			bytes.NewReader(thumbnail), bytes.NewReader(full), io.Discard, Options{})
+		if ec == nil {
+			t.Error("muxed an animated Full image")
+		}
+	}
+}
+
+func TestGammuxAnimatedMaxPixels(t *testing.T) {
+	full := testPNGData(t, uniformNRGBA(color.NRGBA{0xFF, 0xFF, 0xFF, 0xFF}))
+	for _, thumbnail := range [][]byte{testGIF(t, 2, 0), testAPNG(t, 2, 0)} {
+		for _, tt := range []struct {
+			maxPixels int
+			ok        bool
+		}{{64, true}, {63, false}} {
+			ec := gammuxAnimatedData(bytes.NewReader(thumbnail), bytes.NewReader(full), io.Discard,
+				Options{MaxPixels: tt.maxPixels})
+			if (ec == nil) != tt.ok {
+				t.Errorf("max %d: error %v, want error %v", tt.maxPixels, ec, !tt.ok)
+			}
+		}
+	}
+}
+
+func TestDecodeGIFFrame(t *testing.T) {
+	data := testGIF(t, 3, 0)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	tests := []struct {
+		index int
+		want  color.NRGBA
+		warns bool
+	}{
+		{0, color.NRGBA{0, 0, 0, 0xFF}, false},
+		{1, color.NRGBA{0xFF, 0xFF, 0xFF, 0xFF}, false},
+		{2, color.NRGBA{0xFF, 0, 0, 0xFF}, false},
+		// Frames that don't exist fall back to the first.
+		{3, color.NRGBA{0, 0, 0, 0xFF}, true},
+		{-1, color.NRGBA{0, 0, 0, 0xFF}, true},
+	}
+	for _, tt := range tests {
+		logs.Reset()
+		im, ec := decodeGIFFrame(data, tt.index, Options{})
+		if ec != nil {
+			t.Fatalf("frame %d: %v", tt.index, ec)
+		}
+		if got := color.NRGBAModel.Convert(im.At(4, 4)); got != tt.want {
+			t.Errorf("frame %d: color %v, want %v", tt.index, got, tt.want)
+		}
+		if warned := strings.Contains(logs.String(), "using the first"); warned != tt.warns {
+			t.Errorf("frame %d: logged %q, want warning %v", tt.index, logs.String(), tt.warns)
+		}
+		// Strict makes the warning an error.
+		if _, ec := decodeGIFFrame(data, tt.index, Options{Strict: true}); (ec != nil) != tt.warns {
+			t.Errorf("frame %d: strict error %v, want error %v", tt.index, ec, tt.warns)
+		}
+	}
+}
+
+func TestGammuxFullFrameMaxPixels(t *testing.T) {
+	thumbnail := testPNGData(t, uniformNRGBA(color.NRGBA{0x80, 0x80, 0x80, 0xFF}))
+	full := testGIF(t, 3, 0)
+	for _, tt := range []struct {
+		maxPixels int
+		ok        bool
+	}{{64, true}, {63, false}} {
+		opts := Options{FullFrame: 1, MaxPixels: tt.maxPixels}
+		ec := GammaMuxDataOpts(bytes.NewReader(thumbnail), bytes.NewReader(full), io.Discard, opts)
+		if (ec == nil) != tt.ok {
+			t.Errorf("max %d: error %v, want error %v", tt.maxPixels, ec, !tt.ok)
+		}
+	}
+}
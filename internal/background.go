@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Parses a color written as "rrggbb" or "rrggbbaa" in hex, with an optional leading "#", or as
+// "transparent".
+func ParseColor(s string) (color.Color, *ErrChain) {
+	if s == "transparent" {
+		return color.NRGBA{}, nil
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "#"))
+	if err != nil {
+		return nil, ChainErr(err, fmt.Sprintf("Bad color %q", s))
+	}
+	switch len(b) {
+	case 3:
+		return color.NRGBA{R: b[0], G: b[1], B: b[2], A: nrgbaMax}, nil
+	case 4:
+		return color.NRGBA{R: b[0], G: b[1], B: b[2], A: b[3]}, nil
+	}
+	return nil, ChainErr(nil, fmt.Sprintf("Color %q must be rrggbb, rrggbbaa, or transparent", s))
+}
+
+// Paints the pixels of dst outside of full with bg, as a viewer honoring gamma should show it.
+// Viewers ignoring gamma show the brighter encoded color instead, except for black and
+// transparent, which look the same to both.
+func paintBackground(dst draw.Image, full image.Rectangle, bg color.Color, gamma,
+	maxValue float64) {
+	encode := func(v, max float64) float64 {
+		return math.Round(max * math.Pow(v/max, sourceGamma/gamma))
+	}
+	// The color is kept in the precision of dst, so setting it doesn't round the alpha.
+	var px color.Color
+	if maxValue == nrgba64Max {
+		c := color.NRGBA64Model.Convert(bg).(color.NRGBA64)
+		if c.A == 0 {
+			c = color.NRGBA64{}
+		}
+		c.R = uint16(encode(float64(c.R), nrgba64Max))
+		c.G = uint16(encode(float64(c.G), nrgba64Max))
+		c.B = uint16(encode(float64(c.B), nrgba64Max))
+		px = c
+	} else {
+		c := color.NRGBAModel.Convert(bg).(color.NRGBA)
+		if c.A == 0 {
+			c = color.NRGBA{}
+		}
+		c.R = uint8(encode(float64(c.R), nrgbaMax))
+		c.G = uint8(encode(float64(c.G), nrgbaMax))
+		c.B = uint8(encode(float64(c.B), nrgbaMax))
+		px = c
+	}
+	b := dst.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !image.Pt(x, y).In(full) {
+				dst.Set(x, y, px)
+			}
+		}
+	}
+}
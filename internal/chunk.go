@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}
+
+// ErrBadCRC is the cause of the error PNGChunkReader returns for a chunk whose CRC doesn't match.
+var ErrBadCRC = errors.New("bad CRC")
+
+// The PNG spec limits chunk lengths to 2^31-1.
+const maxPngChunkLength = 1<<31 - 1
+
+// PNGChunkReader reads the chunks of a PNG stream, checking the signature and each chunk's CRC.
+type PNGChunkReader struct {
+	r             io.Reader
+	signatureRead bool
+	header        [4 + 4]byte
+}
+
+func NewPNGChunkReader(r io.Reader) *PNGChunkReader {
+	return &PNGChunkReader{r: r}
+}
+
+// Next returns the type and data of the next chunk.  It returns io.EOF once the stream ends
+// cleanly between chunks.  Chunks cut short fail with io.ErrUnexpectedEOF, and chunks whose CRC
+// doesn't match with ErrBadCRC, as seen through errors.Is.
+func (cr *PNGChunkReader) Next() (chunkType string, data []byte, err error) {
+	chunkType, length, err := cr.nextHeader()
+	if err != nil {
+		return "", nil, err
+	}
+	data, err = cr.readData(chunkType, length)
+	if err != nil {
+		return "", nil, err
+	}
+	return chunkType, data, nil
+}
+
+// Reads up to the start of the next chunk's data.  readData must be called before reading the
+// chunk after it.
+func (cr *PNGChunkReader) nextHeader() (chunkType string, length uint32, err error) {
+	if !cr.signatureRead {
+		sig := make([]byte, len(pngSignature))
+		if _, err := io.ReadFull(cr.r, sig); err != nil {
+			return "", 0, ChainErr(err, "Unable to read PNG signature")
+		}
+		if !bytes.Equal(sig, pngSignature) {
+			return "", 0, ChainErr(nil, "Not a PNG")
+		}
+		cr.signatureRead = true
+	}
+
+	if _, err := io.ReadFull(cr.r, cr.header[:]); err == io.EOF {
+		return "", 0, io.EOF
+	} else if err != nil {
+		return "", 0, ChainErr(err, "Truncated PNG chunk header")
+	}
+	length = binary.BigEndian.Uint32(cr.header[0:4])
+	chunkType = string(cr.header[4:8])
+	if length > maxPngChunkLength {
+		return "", 0, ChainErr(nil, fmt.Sprintf("PNG chunk %q too long: %d", chunkType, length))
+	}
+	return chunkType, length, nil
+}
+
+// Reads the data of the chunk whose header was just read, and checks its CRC.
+func (cr *PNGChunkReader) readData(chunkType string, length uint32) ([]byte, error) {
+	// Read through a LimitReader, rather than allocating length up front, in case it's a lie.
+	var body bytes.Buffer
+	if n, err := io.Copy(&body, io.LimitReader(cr.r, int64(length)+4)); err != nil {
+		return nil, ChainErr(err, fmt.Sprintf("Unable to read PNG chunk %q", chunkType))
+	} else if n != int64(length)+4 {
+		return nil, ChainErr(io.ErrUnexpectedEOF, fmt.Sprintf("Truncated PNG chunk %q", chunkType))
+	}
+	data := body.Bytes()[:length]
+
+	crc := crc32.NewIEEE()
+	crc.Write(cr.header[4:8])
+	crc.Write(data)
+	if want := binary.BigEndian.Uint32(body.Bytes()[length:]); crc.Sum32() != want {
+		return nil, ChainErr(ErrBadCRC, fmt.Sprintf("Bad CRC for PNG chunk %q", chunkType))
+	}
+	return data, nil
+}
+
+// PNGChunkWriter writes a PNG stream one chunk at a time, adding the signature and CRCs.
+type PNGChunkWriter struct {
+	w                io.Writer
+	signatureWritten bool
+}
+
+func NewPNGChunkWriter(w io.Writer) *PNGChunkWriter {
+	return &PNGChunkWriter{w: w}
+}
+
+func (cw *PNGChunkWriter) WriteChunk(chunkType string, data []byte) error {
+	if len(chunkType) != 4 {
+		return ChainErr(nil, fmt.Sprintf("Bad PNG chunk type %q", chunkType))
+	}
+	if !cw.signatureWritten {
+		if _, err := cw.w.Write(pngSignature); err != nil {
+			return ChainErr(err, "Unable to write PNG signature")
+		}
+		cw.signatureWritten = true
+	}
+	if err := writePngChunk(cw.w, chunkType, data); err != nil {
+		return ChainErr(err, fmt.Sprintf("Unable to write PNG chunk %q", chunkType))
+	}
+	return nil
+}
+
+// Writes a complete chunk, with its length prefix and CRC suffix.
+func writePngChunk(w io.Writer, chunkType string, data []byte) error {
+	chunkBuf := make([]byte, 4+4+len(data)+4)
+	binary.BigEndian.PutUint32(chunkBuf[0:4], uint32(len(data)))
+	copy(chunkBuf[4:8], chunkType)
+	copy(chunkBuf[8:], data)
+	crc := crc32.NewIEEE()
+	crc.Write(chunkBuf[4 : 8+len(data)])
+	binary.BigEndian.PutUint32(chunkBuf[8+len(data):], crc.Sum32())
+	_, err := w.Write(chunkBuf)
+	return err
+}
+
+// Copies the PNG in src to dest, calling insert to add extra chunks right after the IHDR chunk.
+// Chunks for which drop returns true are left out.  drop may be nil.
+func spliceAfterHeader(dest io.Writer, src io.Reader, drop func(chunkType string) bool,
+	insert func(w io.Writer) *ErrChain) *ErrChain {
+	cr := NewPNGChunkReader(src)
+	cw := NewPNGChunkWriter(dest)
+	sawHeader := false
+	for {
+		chunkType, data, err := cr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return ChainErr(err, "Unable to read PNG")
+		}
+		if !sawHeader && chunkType != "IHDR" {
+			return ChainErr(nil, "PNG missing header")
+		}
+		if drop != nil && drop(chunkType) {
+			continue
+		}
+		if err := cw.WriteChunk(chunkType, data); err != nil {
+			return ChainErr(err, "Unable to write PNG")
+		}
+		if !sawHeader {
+			sawHeader = true
+			if ec := insert(dest); ec != nil {
+				return ec
+			}
+		}
+	}
+	if !sawHeader {
+		return ChainErr(nil, "PNG missing header")
+	}
+	return nil
+}
+
+// Copies the PNG in src to dest, with a gAMA chunk for gamma.  Any existing gAMA, sRGB, or iCCP
+// chunks are removed, since viewers prefer the latter two over gAMA.
+func RepairGamma(src io.Reader, dest io.Writer, gamma float64) *ErrChain {
+	if ec := CheckGamma(gamma); ec != nil {
+		return ec
+	}
+	drop := func(chunkType string) bool {
+		return chunkType == "gAMA" || chunkType == "sRGB" || chunkType == "iCCP"
+	}
+	return spliceAfterHeader(dest, src, drop, func(w io.Writer) *ErrChain {
+		return writeGamaPngChunk(w, gamma)
+	})
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// PNG color types, as stored in the IHDR chunk.
+const (
+	pngColorGrayAlpha = 4
+	pngColorRGBA      = 6
+)
+
+func toNRGBA(im image.Image) *image.NRGBA {
+	if nrgba, ok := im.(*image.NRGBA); ok {
+		return nrgba
+	}
+	dst := image.NewNRGBA(im.Bounds())
+	draw.Draw(dst, dst.Bounds(), im, im.Bounds().Min, draw.Src)
+	return dst
+}
+
+// Converts im to be encoded with colorType, one of "gray", "grayalpha", "rgb", "rgba", or
+// "palette".  Go's encoder never picks some of these for opaque images, so those come with their
+// own encoder, which compresses with level.  Images that can't be represented exactly are an error,
+// except that a palette is skipped if autoPalette is set.
+func forceColorType(
+	im image.Image, colorType string, autoPalette bool, level png.CompressionLevel) (
+	image.Image, func(io.Writer, image.Image) error, *ErrChain) {
+	nrgba := toNRGBA(im)
+	isGray, isOpaque := true, true
+	for y := nrgba.Bounds().Min.Y; y < nrgba.Bounds().Max.Y; y++ {
+		for x := nrgba.Bounds().Min.X; x < nrgba.Bounds().Max.X; x++ {
+			px := nrgba.NRGBAAt(x, y)
+			isGray = isGray && px.R == px.G && px.G == px.B
+			isOpaque = isOpaque && px.A == nrgbaMax
+		}
+	}
+
+	switch colorType {
+	case "gray":
+		if !isGray || !isOpaque {
+			return nil, nil, ChainErr(nil, "Output has color or transparency, so it can't be gray")
+		}
+		return grayImage(nrgba), nil, nil
+	case "grayalpha":
+		if !isGray {
+			return nil, nil, ChainErr(nil, "Output has color, so it can't be grayalpha")
+		}
+		return nrgba, func(w io.Writer, im image.Image) error {
+			return encodeRawPNG(w, im.(*image.NRGBA), pngColorGrayAlpha, level)
+		}, nil
+	case "rgb":
+		if !isOpaque {
+			return nil, nil, ChainErr(nil, "Output has transparency, so it can't be rgb")
+		}
+		return nrgba, nil, nil
+	case "rgba":
+		return nrgba, func(w io.Writer, im image.Image) error {
+			return encodeRawPNG(w, im.(*image.NRGBA), pngColorRGBA, level)
+		}, nil
+	case "palette":
+		if paletted := palettedImage(nrgba); paletted != nil {
+			return paletted, nil, nil
+		}
+		if autoPalette {
+			return nrgba, nil, nil
+		}
+		return nil, nil, ChainErr(nil, "Output has more than 256 colors, so it can't be a palette")
+	}
+	return nil, nil, ChainErr(nil,
+		"Unknown color type "+colorType+", must be gray, grayalpha, rgb, rgba, or palette")
+}
+
+// Encodes im as an 8 bit PNG of either gray with alpha or RGBA, which Go's encoder only writes
+// when it chooses to.  Rows are not filtered.
+func encodeRawPNG(w io.Writer, im *image.NRGBA, colorType byte, level png.CompressionLevel) error {
+	b := im.Bounds()
+	cw := NewPNGChunkWriter(w)
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(b.Dy()))
+	ihdr[8], ihdr[9] = 8, colorType
+	if err := cw.WriteChunk("IHDR", ihdr); err != nil {
+		return err
+	}
+
+	var idat bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&idat, zlibLevel(level))
+	if err != nil {
+		return err
+	}
+	row := make([]byte, 0, 1+4*b.Dx())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		// No filter
+		row = append(row[:0], 0)
+		for x := b.Min.X; x < b.Max.X; x++ {
+			px := im.NRGBAAt(x, y)
+			if colorType == pngColorGrayAlpha {
+				row = append(row, px.R, px.A)
+			} else {
+				row = append(row, px.R, px.G, px.B, px.A)
+			}
+		}
+		if _, err := zw.Write(row); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := cw.WriteChunk("IDAT", idat.Bytes()); err != nil {
+		return err
+	}
+	return cw.WriteChunk("IEND", nil)
+}
+
+// Maps level to zlib the same way Go's PNG encoder does.
+func zlibLevel(level png.CompressionLevel) int {
+	switch level {
+	case png.NoCompression:
+		return zlib.NoCompression
+	case png.BestSpeed:
+		return zlib.BestSpeed
+	case png.BestCompression:
+		return zlib.BestCompression
+	}
+	return zlib.DefaultCompression
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// The error for an image that can't take a color type names that type.
+func TestForceColorTypeError(t *testing.T) {
+	colorful := uniformNRGBA(color.NRGBA{0xFF, 0, 0, 0xFF})
+	translucent := uniformNRGBA(color.NRGBA{0x80, 0x80, 0x80, 0x80})
+	tests := []struct {
+		colorType string
+		im        *image.NRGBA
+	}{
+		{"gray", colorful},
+		{"gray", translucent},
+		{"grayalpha", colorful},
+		{"rgb", translucent},
+	}
+	for _, tt := range tests {
+		_, _, ec := forceColorType(tt.im, tt.colorType, false, png.DefaultCompression)
+		if ec == nil {
+			t.Errorf("%s: no error", tt.colorType)
+			continue
+		}
+		if msg := ec.Error(); !strings.HasSuffix(msg, "be "+tt.colorType) {
+			t.Errorf("%s: error %q doesn't name it", tt.colorType, msg)
+		}
+	}
+}
+
+// Gray muxes, found by AutoGray or forced by ColorType, are written as PNG color type 0, and still
+// declare the target gamma.
+func TestGrayOutput(t *testing.T) {
+	thumbnail := uniformNRGBA(color.NRGBA{0x80, 0x80, 0x80, 0xFF})
+	full := uniformNRGBA(color.NRGBA{0x40, 0x40, 0x40, 0xFF})
+	for _, tt := range []struct {
+		name string
+		opts Options
+	}{
+		{"auto gray", Options{AutoGray: true, Dither: true}},
+		{"color type", Options{ColorType: "gray"}},
+	} {
+		var buf bytes.Buffer
+		if ec := GammaMuxImagesData(thumbnail, full, &buf, tt.opts); ec != nil {
+			t.Fatal(ec)
+		}
+		var colorType, bitDepth byte = 0xFF, 0
+		var gama uint32
+		for _, c := range readChunks(t, buf.Bytes()) {
+			switch c.chunkType {
+			case "IHDR":
+				bitDepth, colorType = c.data[8], c.data[9]
+			case "gAMA":
+				gama = binary.BigEndian.Uint32(c.data)
+			}
+		}
+		if colorType != 0 || bitDepth != 8 {
+			t.Errorf("%s: color type %d with %d bits, want 0 with 8", tt.name, colorType, bitDepth)
+		}
+		if want := GamaChunkValue(DefaultTargetGamma); gama != want {
+			t.Errorf("%s: gAMA %d, want %d", tt.name, gama, want)
+		}
+		im, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := im.(*image.Gray); !ok {
+			t.Errorf("%s: decoded as %T, want *image.Gray", tt.name, im)
+		}
+	}
+}
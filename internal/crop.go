@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// Parses a rectangle written as "x,y,w,h".
+func ParseRect(s string) (image.Rectangle, *ErrChain) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, ChainErr(nil, fmt.Sprintf("Rectangle %q must be x,y,w,h", s))
+	}
+	var vals [4]int
+	for i, part := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return image.Rectangle{}, ChainErr(err, fmt.Sprintf("Bad rectangle %q", s))
+		}
+		vals[i] = v
+	}
+	if vals[2] <= 0 || vals[3] <= 0 {
+		return image.Rectangle{}, ChainErr(nil, fmt.Sprintf("Rectangle %q must not be empty", s))
+	}
+	return image.Rect(vals[0], vals[1], vals[0]+vals[2], vals[1]+vals[3]), nil
+}
+
+// Crops im to r, which is relative to the top left corner of im.  The zero rectangle leaves im
+// alone.
+func cropImage(im image.Image, r image.Rectangle, name string) (image.Image, *ErrChain) {
+	if r == (image.Rectangle{}) {
+		return im, nil
+	}
+	r = r.Add(im.Bounds().Min)
+	if r.Empty() || !r.In(im.Bounds()) {
+		return nil, ChainErr(nil, fmt.Sprintf("Crop %v is outside the %s image, %v",
+			r.Sub(im.Bounds().Min), name, im.Bounds().Sub(im.Bounds().Min)))
+	}
+	sub, ok := im.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	if !ok {
+		return nil, ChainErr(nil, fmt.Sprintf("Unable to crop the %s image", name))
+	}
+	return sub.SubImage(r), nil
+}
+
+// Parses an aspect ratio written as "w:h", such as "16:9".
+func ParseAspect(s string) (image.Point, *ErrChain) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return image.Point{}, ChainErr(nil, fmt.Sprintf("Aspect %q must be w:h", s))
+	}
+	var vals [2]int
+	for i, part := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return image.Point{}, ChainErr(err, fmt.Sprintf("Bad aspect %q", s))
+		}
+		if v <= 0 {
+			return image.Point{}, ChainErr(nil, fmt.Sprintf("Aspect %q must be positive", s))
+		}
+		vals[i] = v
+	}
+	return image.Pt(vals[0], vals[1]), nil
+}
+
+// Returns the largest rectangle of the given aspect centered in bounds.  The zero aspect returns
+// bounds as is.
+func aspectRect(bounds image.Rectangle, aspect image.Point) image.Rectangle {
+	return alignedAspectRect(bounds, aspect, image.Pt(1, 1))
+}
+
+// Like aspectRect, but placed in bounds by align, as returned by Options.align.
+func alignedAspectRect(bounds image.Rectangle, aspect, align image.Point) image.Rectangle {
+	if aspect == (image.Point{}) {
+		return bounds
+	}
+	w, h := bounds.Dx(), bounds.Dy()
+	// Compare w/h against aspect.X/aspect.Y without floats.
+	if w*aspect.Y > h*aspect.X {
+		w = h * aspect.X / aspect.Y
+	} else {
+		h = w * aspect.Y / aspect.X
+	}
+	min := bounds.Min.Add(image.Pt((bounds.Dx()-w)*align.X/2, (bounds.Dy()-h)*align.Y/2))
+	return image.Rectangle{Min: min, Max: min.Add(image.Pt(w, h))}
+}
+
+// Crops the middle of im to aspect.  Images already at the aspect are left alone.
+func cropToAspect(im image.Image, aspect image.Point, name string) (image.Image, *ErrChain) {
+	r := aspectRect(im.Bounds(), aspect)
+	if r == im.Bounds() {
+		return im, nil
+	}
+	return cropImage(im, r.Sub(im.Bounds().Min), name)
+}
+
+// Applies ThumbnailCrop, FullCrop, and Aspect to the inputs, and clears them from the returned
+// Options so they aren't applied again.
+func cropInputs(thumbnail, full image.Image, opts Options) (
+	image.Image, image.Image, Options, *ErrChain) {
+	var ec *ErrChain
+	if thumbnail, ec = cropImage(thumbnail, opts.ThumbnailCrop, "thumbnail"); ec != nil {
+		return nil, nil, opts, ec
+	}
+	if full, ec = cropImage(full, opts.FullCrop, "full"); ec != nil {
+		return nil, nil, opts, ec
+	}
+	if thumbnail, ec = cropToAspect(thumbnail, opts.Aspect, "thumbnail"); ec != nil {
+		return nil, nil, opts, ec
+	}
+	if full, ec = cropToAspect(full, opts.Aspect, "full"); ec != nil {
+		return nil, nil, opts, ec
+	}
+	opts.ThumbnailCrop, opts.FullCrop = image.Rectangle{}, image.Rectangle{}
+	opts.Aspect = image.Point{}
+	return thumbnail, full, opts, nil
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"image"
+	"testing"
+)
+
+func TestAspectRect(t *testing.T) {
+	tests := []struct {
+		name   string
+		bounds image.Rectangle
+		aspect image.Point
+		want   image.Rectangle
+	}{
+		{"none", image.Rect(0, 0, 40, 30), image.Point{}, image.Rect(0, 0, 40, 30)},
+		{"same", image.Rect(0, 0, 40, 30), image.Pt(4, 3), image.Rect(0, 0, 40, 30)},
+		// Wide images lose their sides, and tall ones their top and bottom.
+		{"wide to square", image.Rect(0, 0, 40, 30), image.Pt(1, 1), image.Rect(5, 0, 35, 30)},
+		{"tall to square", image.Rect(0, 0, 30, 40), image.Pt(1, 1), image.Rect(0, 5, 30, 35)},
+		{"square to wide", image.Rect(0, 0, 32, 32), image.Pt(16, 9), image.Rect(0, 7, 32, 25)},
+		{"square to tall", image.Rect(0, 0, 32, 32), image.Pt(9, 16), image.Rect(7, 0, 25, 32)},
+		{"offset", image.Rect(10, 20, 50, 50), image.Pt(1, 1), image.Rect(15, 20, 45, 50)},
+		// Odd margins leave the extra pixel on the far side.
+		{"odd margin", image.Rect(0, 0, 11, 10), image.Pt(1, 1), image.Rect(0, 0, 10, 10)},
+	}
+	for _, tt := range tests {
+		if got := aspectRect(tt.bounds, tt.aspect); got != tt.want {
+			t.Errorf("%s: aspectRect(%v, %v) = %v, want %v",
+				tt.name, tt.bounds, tt.aspect, got, tt.want)
+		}
+	}
+}
+
+func TestCropToAspect(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		size   image.Point
+		aspect image.Point
+		want   image.Rectangle
+	}{
+		{"wide", image.Pt(64, 16), image.Pt(2, 1), image.Rect(16, 0, 48, 16)},
+		{"tall", image.Pt(16, 64), image.Pt(1, 2), image.Rect(0, 16, 16, 48)},
+	} {
+		im := testPattern(tt.size.X, tt.size.Y)
+		got, ec := cropToAspect(im, tt.aspect, "test")
+		if ec != nil {
+			t.Fatalf("%s: %v", tt.name, ec)
+		}
+		if got.Bounds() != tt.want {
+			t.Errorf("%s: bounds %v, want %v", tt.name, got.Bounds(), tt.want)
+		}
+		// The crop shares pixels with the original, rather than copying them.
+		if got.At(tt.want.Min.X, tt.want.Min.Y) != im.At(tt.want.Min.X, tt.want.Min.Y) {
+			t.Errorf("%s: crop moved pixels", tt.name)
+		}
+	}
+}
+
+func TestCropInputs(t *testing.T) {
+	opts := Options{
+		ThumbnailCrop: image.Rect(10, 0, 70, 40),
+		Aspect:        image.Pt(1, 1),
+	}
+	thumbnail, full, opts, ec := cropInputs(testPattern(80, 40), testPattern(30, 60), opts)
+	if ec != nil {
+		t.Fatal(ec)
+	}
+	if want := image.Rect(20, 0, 60, 40); thumbnail.Bounds() != want {
+		t.Errorf("thumbnail bounds %v, want %v", thumbnail.Bounds(), want)
+	}
+	if want := image.Rect(0, 15, 30, 45); full.Bounds() != want {
+		t.Errorf("full bounds %v, want %v", full.Bounds(), want)
+	}
+	if opts.ThumbnailCrop != (image.Rectangle{}) || opts.Aspect != (image.Point{}) {
+		t.Errorf("crops left in options: %+v", opts)
+	}
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// Writes a self contained HTML page showing the muxed PNG as a viewer that ignores gamma would,
+// and switching to how a gamma aware viewer would on hover or click.  Like WriteHTMLSnippet, the
+// image is embedded without its gAMA chunk and a script does the gamma correction, so both views
+// are the same in every browser.
+func WriteDemoHTML(muxed io.Reader, dest io.Writer) *ErrChain {
+	stripped, gamma, ec := stripGamma(muxed)
+	if ec != nil {
+		return ec
+	}
+
+	_, err := fmt.Fprintf(dest, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gammux demo</title>
+<style>
+  body { font-family: sans-serif; text-align: center; }
+  .gammux { display: inline-block; position: relative; cursor: pointer; }
+  .gammux img { display: block; }
+  .gammux canvas { position: absolute; left: 0; top: 0; visibility: hidden; }
+  .gammux:hover canvas, .gammux.revealed canvas { visibility: visible; }
+</style>
+</head>
+<body>
+<p>Hover over or click the image to switch between how viewers that ignore gamma show it, and
+how those that honor it do.</p>
+<div class="gammux">
+  <img src="data:image/png;base64,%s" alt="">
+  <canvas></canvas>
+</div>
+<script>
+  (function(demo) {
+    var img = demo.querySelector("img");
+    var canvas = demo.querySelector("canvas");
+    function render() {
+      canvas.width = img.naturalWidth;
+      canvas.height = img.naturalHeight;
+      var ctx = canvas.getContext("2d");
+      ctx.drawImage(img, 0, 0);
+      var data = ctx.getImageData(0, 0, canvas.width, canvas.height);
+      var table = new Uint8ClampedArray(256);
+      for (var i = 0; i < 256; i++) {
+        table[i] = Math.round(255 * Math.pow(i / 255, %g));
+      }
+      for (var i = 0; i < data.data.length; i += 4) {
+        data.data[i] = table[data.data[i]];
+        data.data[i + 1] = table[data.data[i + 1]];
+        data.data[i + 2] = table[data.data[i + 2]];
+      }
+      ctx.putImageData(data, 0, 0);
+    }
+    if (img.complete) {
+      render();
+    } else {
+      img.addEventListener("load", render);
+    }
+    demo.addEventListener("click", function() {
+      demo.classList.toggle("revealed");
+    });
+  })(document.querySelector(".gammux"));
+</script>
+</body>
+</html>
+`, base64.StdEncoding.EncodeToString(stripped.Bytes()), gamma/sourceGamma)
+	if err != nil {
+		return ChainErr(err, "Unable to write demo page")
+	}
+	return nil
+}
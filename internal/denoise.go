@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"image/color"
+	"math"
+)
+
+// Blurs a linear image with a Gaussian reaching radius pixels, to soften camera noise before the
+// gamma transform amplifies it.  Edge pixels are repeated past the border.
+func denoiseImage(src nrgba64Image, radius int, precision int) nrgba64Image {
+	sigma := float64(radius) / 2
+	kernel := make([]float64, 2*radius+1)
+	var sum float64
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	b := src.Bounds()
+	clamp := func(v, min, max int) int {
+		if v < min {
+			return min
+		}
+		if v >= max {
+			return max - 1
+		}
+		return v
+	}
+	blur := func(src nrgba64Image, dx, dy int) nrgba64Image {
+		dst := newNRGBA64Image(b, precision)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				var r, g, bl float64
+				for i, k := range kernel {
+					px := src.NRGBA64At(
+						clamp(x+(i-radius)*dx, b.Min.X, b.Max.X), clamp(y+(i-radius)*dy, b.Min.Y, b.Max.Y))
+					r += float64(px.R) * k
+					g += float64(px.G) * k
+					bl += float64(px.B) * k
+				}
+				dst.SetNRGBA64(x, y, color.NRGBA64{
+					R: uint16(math.Round(r)),
+					G: uint16(math.Round(g)),
+					B: uint16(math.Round(bl)),
+					A: src.NRGBA64At(x, y).A,
+				})
+			}
+		}
+		return dst
+	}
+	return blur(blur(src, 1, 0), 0, 1)
+}
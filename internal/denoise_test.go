@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Returns the mean and variance of the red channel of im.
+func redStats(im image.Image) (mean, variance float64) {
+	at := nrgba64Reader(im)
+	b := im.Bounds()
+	var sum, sq float64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			v := float64(at(x, y).R)
+			sum += v
+			sq += v * v
+		}
+	}
+	n := float64(b.Dx() * b.Dy())
+	mean = sum / n
+	return mean, sq/n - mean*mean
+}
+
+// Returns a mid gray image with uniform noise of up to amount on each channel.
+func noisyImage(w, h int, amount int, seed int64) *image.NRGBA64 {
+	rnd := rand.New(rand.NewSource(seed))
+	im := image.NewNRGBA64(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			noise := func() uint16 {
+				return uint16(0x8000 + rnd.Intn(2*amount+1) - amount)
+			}
+			im.SetNRGBA64(x, y, color.NRGBA64{noise(), noise(), noise(), 0xFFFF})
+		}
+	}
+	return im
+}
+
+func TestDenoiseImage(t *testing.T) {
+	noisy := noisyImage(64, 64, 0x2000, 1)
+	mean, variance := redStats(noisy)
+	// Wider blurs take away more of the noise.
+	for _, tt := range []struct {
+		radius   int
+		fraction float64
+	}{{1, 0.5}, {2, 0.25}, {4, 0.125}} {
+		radius := tt.radius
+		for _, precision := range []int{8, 16} {
+			denoised := denoiseImage(noisy, radius, precision)
+			if denoised.Bounds() != noisy.Bounds() {
+				t.Fatalf("radius %d: bounds %v, want %v", radius, denoised.Bounds(), noisy.Bounds())
+			}
+			dmean, dvariance := redStats(denoised)
+			// A Gaussian keeps the average light.
+			if math.Abs(dmean-mean) > 0x100 {
+				t.Errorf("radius %d at %d bits: mean %v, want about %v",
+					radius, precision, dmean, mean)
+			}
+			if dvariance > variance*tt.fraction {
+				t.Errorf("radius %d at %d bits: variance %v, want under %v of %v",
+					radius, precision, dvariance, tt.fraction, variance)
+			}
+		}
+	}
+}
+
+// The Full image seen in the corrected rendering has less speckle when denoised.
+func TestDenoiseMux(t *testing.T) {
+	thumbnail := image.NewNRGBA(image.Rect(0, 0, 128, 128))
+	full := noisyImage(64, 64, 0x3000, 2)
+	fullVariance := func(denoise int) float64 {
+		opts := Options{Dither: true, Denoise: denoise}
+		muxed, ec := GammaMuxImagesOpts(thumbnail, full, opts)
+		if ec != nil {
+			t.Fatal(ec)
+		}
+		// The Full pixels are the top left of each block.
+		fulls := image.NewNRGBA64(image.Rect(0, 0, 64, 64))
+		at := nrgba64Reader(muxed)
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				fulls.SetNRGBA64(x, y, at(2*x, 2*y))
+			}
+		}
+		_, variance := redStats(fulls)
+		return variance
+	}
+	if plain, denoised := fullVariance(0), fullVariance(2); denoised > plain/2 {
+		t.Errorf("denoised Full variance %v, want under half of %v", denoised, plain)
+	}
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// DetectLattice reports whether im looks like a muxed image, even without its gAMA chunk, and if
+// so which corner of each block holds the Full image.  Muxed images have a bright Full pixel in
+// one corner of nearly every block, and Thumbnail pixels no brighter than the darkening allows in
+// the rest.  opts must have the FullScaling the image was muxed with.
+func DetectLattice(im image.Image, opts Options) (corner string, ok bool) {
+	scaling := opts.fullScaling()
+	b := im.Bounds()
+	if scaling < 2 || b.Dx() < scaling || b.Dy() < scaling {
+		return "", false
+	}
+	limit := uint8(math.Ceil(thumbnailDarkenFactor * nrgbaMax))
+	corners := [...]struct {
+		name string
+		x, y int
+	}{{"tl", 0, 0}, {"tr", 1, 0}, {"bl", 0, 1}, {"br", 1, 1}}
+	// For each corner, how many of its pixels are too bright to be Thumbnail pixels.
+	var bright [len(corners)]int
+	var blocks int
+	for y := b.Min.Y; y+scaling <= b.Max.Y; y += scaling {
+		for x := b.Min.X; x+scaling <= b.Max.X; x += scaling {
+			blocks++
+			for i, c := range corners {
+				px := color.NRGBAModel.Convert(im.At(x+c.x*(scaling-1), y+c.y*(scaling-1))).(color.NRGBA)
+				if px.R > limit || px.G > limit || px.B > limit {
+					bright[i]++
+				}
+			}
+		}
+	}
+	for i, c := range corners {
+		var others int
+		for j := range corners {
+			if j != i {
+				others += bright[j]
+			}
+		}
+		// Dithering and clamping leave room for a few stray pixels.
+		if bright[i] >= blocks*95/100 && others <= blocks*3/100 {
+			return c.name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+func TestLatticeCorners(t *testing.T) {
+	// 12 pixels is a whole number of blocks at every scaling, so there is no letterboxing.
+	thumbnail := image.NewNRGBA(image.Rect(0, 0, 12, 12))
+	draw.Draw(thumbnail, thumbnail.Rect, image.NewUniform(color.Gray{0x80}), image.Point{}, draw.Src)
+	full := uniformNRGBA(color.NRGBA{0xFF, 0xFF, 0xFF, 0xFF})
+	corners := []struct {
+		name string
+		x, y int
+	}{{"tl", 0, 0}, {"tr", 1, 0}, {"bl", 0, 1}, {"br", 1, 1}}
+	for _, scaling := range []int{2, 3} {
+		for _, c := range corners {
+			name := fmt.Sprintf("%s at %d", c.name, scaling)
+			opts := Options{LatticeCorner: c.name, FullScaling: scaling, Stretch: true}
+			muxed, ec := GammaMuxImagesOpts(thumbnail, full, opts)
+			if ec != nil {
+				t.Fatalf("%s: %v", name, ec)
+			}
+			at := nrgba64Reader(muxed)
+			b := muxed.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					isFull := (x-b.Min.X)%scaling == c.x*(scaling-1) &&
+						(y-b.Min.Y)%scaling == c.y*(scaling-1)
+					// White Full pixels stay white, and Thumbnail pixels are darkened.
+					if bright := at(x, y).R == nrgba64Max; bright != isFull {
+						t.Fatalf("%s: pixel %d,%d is %v, want Full pixel %v",
+							name, x, y, at(x, y), isFull)
+					}
+				}
+			}
+
+			if got, ok := DetectLattice(muxed, opts); !ok || got != c.name {
+				t.Errorf("%s: detected %q, %v", name, got, ok)
+			}
+
+			var buf, extracted bytes.Buffer
+			if err := png.Encode(&buf, muxed); err != nil {
+				t.Fatal(err)
+			}
+			if ec := ExtractFull(&buf, &extracted, Options{FullScaling: scaling}); ec != nil {
+				t.Fatalf("%s: %v", name, ec)
+			}
+			xim, err := png.Decode(&extracted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := xim.Bounds().Size(), b.Size().Div(scaling); got != want {
+				t.Errorf("%s: extracted %v, want %v", name, got, want)
+			}
+			white := color.NRGBA{0xFF, 0xFF, 0xFF, 0xFF}
+			if got := color.NRGBAModel.Convert(xim.At(0, 0)); got != white {
+				t.Errorf("%s: extracted %v, want white", name, got)
+			}
+		}
+	}
+}
+
+func TestDetectLatticeUnmuxed(t *testing.T) {
+	if corner, ok := DetectLattice(testPattern(16, 16), Options{}); ok {
+		t.Errorf("detected %q in an unmuxed image", corner)
+	}
+	if corner, ok := DetectLattice(image.NewGray(image.Rect(0, 0, 1, 1)), Options{}); ok {
+		t.Errorf("detected %q in a 1x1 image", corner)
+	}
+}
@@ -0,0 +1,76 @@
+package internal
+
+// How far error diffusion reaches left and right, and so how much padding each error row has.
+const ditherPad = 2
+
+// A pixel after the current one, and how much of the rounding error it gets.
+type ditherTap struct {
+	dx, dy int
+	weight float64
+}
+
+// An error diffusion kernel.  The taps are applied in order, and share a divisor.
+type ditherKernel struct {
+	taps    []ditherTap
+	divisor float64
+}
+
+var ditherKernels = map[string]*ditherKernel{
+	"floyd-steinberg": {
+		divisor: 16,
+		taps:    []ditherTap{{1, 0, 7}, {-1, 1, 3}, {0, 1, 5}, {1, 1, 1}},
+	},
+	// Only 6/8 of the error is spread, which keeps details crisp but clips shadows and
+	// highlights.
+	"atkinson": {
+		divisor: 8,
+		taps:    []ditherTap{{1, 0, 1}, {2, 0, 1}, {-1, 1, 1}, {0, 1, 1}, {1, 1, 1}, {0, 2, 1}},
+	},
+	"sierra": {
+		divisor: 32,
+		taps: []ditherTap{
+			{1, 0, 5}, {2, 0, 3},
+			{-2, 1, 2}, {-1, 1, 4}, {0, 1, 5}, {1, 1, 4}, {2, 1, 2},
+			{-1, 2, 2}, {0, 2, 3}, {1, 2, 2},
+		},
+	},
+}
+
+// The 4x4 Bayer matrix, for ordered dithering.
+var bayerMatrix = [4][4]float64{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// Returns how far to shift the pixel at x, y before rounding it, between -1/2 and 1/2 of a step.
+// The pattern repeats every 4 pixels, so it tiles.
+func bayerThreshold(x, y int) float64 {
+	return (bayerMatrix[y&3][x&3]+0.5)/16 - 0.5
+}
+
+// Returns the error diffusion kernel of DitherAlgorithm, or nil for ordered dithering or none.
+func (o Options) ditherKernel() (*ditherKernel, *ErrChain) {
+	switch o.DitherAlgorithm {
+	case "":
+		return ditherKernels["floyd-steinberg"], nil
+	case "ordered", "none":
+		return nil, nil
+	}
+	if k, ok := ditherKernels[o.DitherAlgorithm]; ok {
+		return k, nil
+	}
+	return nil, ChainErr(nil, "Unknown dither algorithm "+o.DitherAlgorithm+
+		", must be floyd-steinberg, atkinson, sierra, ordered, or none")
+}
+
+// Rotates the error rows up by one, so the next row becomes the current one, and clears the last.
+func nextErrorRow(errs [][]dithererr) {
+	last := errs[0]
+	copy(errs, errs[1:])
+	for i := range last {
+		last[i] = dithererr{}
+	}
+	errs[len(errs)-1] = last
+}
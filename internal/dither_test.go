@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestScaleClamp(t *testing.T) {
+	tests := []struct {
+		v, max, want float64
+	}{
+		{0, 255, 0},
+		{1, 255, 255},
+		{1.5, 255, 255},
+		// Halves round away from zero.
+		{0.25, 2, 1},
+		{0.75, 2, 2},
+		{0.2, 2, 0},
+		// Only the top is clamped; orderedRound keeps results above 0.
+		{-0.25, 2, -1},
+	}
+	for _, tt := range tests {
+		if got := scaleClamp(tt.v, tt.max); got != tt.want {
+			t.Errorf("scaleClamp(%v, %v) = %v, want %v", tt.v, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestOrderedRound(t *testing.T) {
+	tests := []struct {
+		v, threshold, want float64
+	}{
+		{0.5, 0, 128},
+		{0.5, 0.25, 128},
+		{0.5, -0.49, 127},
+		{0, -0.5, 0},
+		{1, 0.5, 255},
+	}
+	for _, tt := range tests {
+		if got := orderedRound(tt.v, 255, tt.threshold); got != tt.want {
+			t.Errorf("orderedRound(%v, 255, %v) = %v, want %v", tt.v, tt.threshold, got, tt.want)
+		}
+	}
+}
+
+// Returns error rows wide enough for width pixels, as the muxer makes them.
+func newErrorRows(width int) [][]dithererr {
+	errs := make([][]dithererr, 3)
+	for i := range errs {
+		errs[i] = make([]dithererr, width+2*ditherPad)
+	}
+	return errs
+}
+
+func TestCalculateFullPixel(t *testing.T) {
+	identity := func(v float64) float64 { return v }
+	gray := func(v uint16) color.NRGBA64 { return color.NRGBA64{v, v, v, 0xFFFF} }
+	all := ditherChannels{true, true, true}
+	fs := ditherKernels["floyd-steinberg"]
+	// Half gray is 0x8000/0xFFFF, which rounds up to 128/255.
+	const half = float64(0x8000) / 0xFFFF
+	type diffused struct {
+		dx, dy int
+		err    float64
+	}
+	tests := []struct {
+		name     string
+		px       color.NRGBA64
+		dir      int
+		incoming float64
+		minPixel float64
+		kernel   *ditherKernel
+		want     uint16
+		diffused []diffused
+	}{
+		{
+			name: "rounds up", px: gray(0x8000), dir: 1, kernel: fs,
+			want: 128 * 0x101,
+			diffused: []diffused{
+				{1, 0, (half - 128.0/255) * 7 / 16},
+				{-1, 1, (half - 128.0/255) * 3 / 16},
+				{0, 1, (half - 128.0/255) * 5 / 16},
+				{1, 1, (half - 128.0/255) * 1 / 16},
+			},
+		},
+		{
+			name: "right to left", px: gray(0x8000), dir: -1, kernel: fs,
+			want: 128 * 0x101,
+			diffused: []diffused{
+				{-1, 0, (half - 128.0/255) * 7 / 16},
+				{1, 1, (half - 128.0/255) * 3 / 16},
+				{0, 1, (half - 128.0/255) * 5 / 16},
+				{-1, 1, (half - 128.0/255) * 1 / 16},
+			},
+		},
+		{
+			name: "incoming error", px: gray(0x8000), dir: 1, incoming: 0.01, kernel: fs,
+			want: 130 * 0x101,
+			diffused: []diffused{
+				{1, 0, (half + 0.01 - 130.0/255) * 7 / 16},
+				{0, 1, (half + 0.01 - 130.0/255) * 5 / 16},
+			},
+		},
+		{
+			// The error is clamped to minPixel, so a dark run doesn't build up a debt.
+			name: "min pixel", px: gray(0), dir: 1, incoming: -0.5, minPixel: 0.001, kernel: fs,
+			want: 0,
+			diffused: []diffused{
+				{1, 0, 0.001 * 7 / 16},
+			},
+		},
+		{
+			// Error that is no longer finite is dropped, rather than spread to every later pixel.
+			name: "NaN", px: gray(0x8000), dir: 1, incoming: math.NaN(), kernel: fs,
+			want: 128 * 0x101,
+			diffused: []diffused{
+				{1, 0, (half - 128.0/255) * 7 / 16},
+				{0, 1, (half - 128.0/255) * 5 / 16},
+			},
+		},
+		{
+			name: "+Inf", px: gray(0x8000), dir: 1, incoming: math.Inf(1), kernel: fs,
+			want: 128 * 0x101,
+			diffused: []diffused{
+				{1, 0, (half - 128.0/255) * 7 / 16},
+			},
+		},
+		{
+			name: "-Inf", px: gray(0x8000), dir: 1, incoming: math.Inf(-1), kernel: fs,
+			want: 128 * 0x101,
+			diffused: []diffused{
+				{1, 0, (half - 128.0/255) * 7 / 16},
+			},
+		},
+		{
+			name: "atkinson", px: gray(0x8000), dir: 1, kernel: ditherKernels["atkinson"],
+			want: 128 * 0x101,
+			diffused: []diffused{
+				{1, 0, (half - 128.0/255) / 8},
+				{2, 0, (half - 128.0/255) / 8},
+				{0, 2, (half - 128.0/255) / 8},
+			},
+		},
+	}
+	const x = 3
+	for _, tt := range tests {
+		errs := newErrorRows(8)
+		errs[0][x+ditherPad] = dithererr{tt.incoming, tt.incoming, tt.incoming}
+		got := calculateFullPixel(x, tt.dir, tt.px, all, tt.kernel, 0, tt.minPixel, nrgbaMax,
+			identity, identity, errs)
+		if want := (color.NRGBA64{tt.want, tt.want, tt.want, 0xFFFF}); got != want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, want)
+		}
+		if math.IsNaN(tt.incoming) || math.IsInf(tt.incoming, 0) {
+			if e := errs[0][x+ditherPad]; e != (dithererr{}) {
+				t.Errorf("%s: error %v left in place, want it reset", tt.name, e)
+			}
+		}
+		for _, d := range tt.diffused {
+			e := errs[d.dy][x+ditherPad+d.dx]
+			for _, v := range []float64{e.r, e.g, e.b} {
+				if math.Abs(v-d.err) > 1e-12 {
+					t.Errorf("%s: error at %d,%d is %v, want %v", tt.name, d.dx, d.dy, v, d.err)
+				}
+			}
+		}
+	}
+}
+
+// Channels left out of DitherChannels round on their own, and never pass error to their
+// neighbors, nor pick any up, even from a DitherSeed.
+func TestCalculateFullPixelUndithered(t *testing.T) {
+	identity := func(v float64) float64 { return v }
+	px := color.NRGBA64{0x8000, 0x8000, 0x8000, 0xFFFF}
+	fs := ditherKernels["floyd-steinberg"]
+	tests := []struct {
+		name   string
+		dither ditherChannels
+		kernel *ditherKernel
+	}{
+		{"red only", ditherChannels{r: true}, fs},
+		{"green and blue", ditherChannels{g: true, b: true}, fs},
+		{"none", ditherChannels{}, fs},
+		{"ordered", ditherChannels{true, true, true}, nil},
+	}
+	const x = 3
+	for _, tt := range tests {
+		errs := newErrorRows(8)
+		errs[0][x+ditherPad] = dithererr{0.01, 0.01, 0.01}
+		got := calculateFullPixel(x, 1, px, tt.dither, tt.kernel, 0, 0, nrgbaMax,
+			identity, identity, errs)
+		// Only dithered channels spread error, and only with a kernel.
+		spreads := func(dithered bool) bool {
+			return dithered && tt.kernel != nil
+		}
+		channels := []struct {
+			name     string
+			dithered bool
+			v        uint16
+			err      func(dithererr) float64
+		}{
+			{"red", tt.dither.r, got.R, func(e dithererr) float64 { return e.r }},
+			{"green", tt.dither.g, got.G, func(e dithererr) float64 { return e.g }},
+			{"blue", tt.dither.b, got.B, func(e dithererr) float64 { return e.b }},
+		}
+		for _, c := range channels {
+			want := uint16(128 * 0x101)
+			if c.dithered {
+				// The 0.01 of error left for this pixel bumps it up two steps.
+				want = 130 * 0x101
+			}
+			if c.v != want {
+				t.Errorf("%s: %s = %d, want %d", tt.name, c.name, c.v, want)
+			}
+			for dy, row := range errs {
+				for i, e := range row {
+					if dy == 0 && i == x+ditherPad || spreads(c.dithered) {
+						continue
+					}
+					if v := c.err(e); v != 0 {
+						t.Errorf("%s: %s error %v spread to %d,%d",
+							tt.name, c.name, v, i-x-ditherPad, dy)
+					}
+				}
+			}
+		}
+	}
+}
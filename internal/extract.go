@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// ExtractFull recovers the Full image from a muxed PNG, and writes it as a PNG.  Shrinking the
+// muxed image would average the Full pixels away into the Thumbnail, so instead the Full pixel of
+// each block is picked out and gamma corrected, the way a viewer honoring gamma shows it.  The
+// result is one pixel per block, which is the size the Full image was muxed at, and any
+// letterboxing comes out black.  opts must have the FullScaling the image was muxed with.  If
+// opts has no LatticeCorner, it is detected.
+func ExtractFull(src io.Reader, dest io.Writer, opts Options) *ErrChain {
+	scaling, ec := opts.checkedFullScaling()
+	if ec != nil {
+		return ec
+	}
+	im, gamma, ec := decodeMuxed(src)
+	if ec != nil {
+		return ec
+	}
+	if opts.LatticeCorner == "" {
+		// Robust lattices aren't detected, but keep the Full pixel in the top left.
+		corner, ok := DetectLattice(im, opts)
+		if !ok {
+			corner = "tl"
+		}
+		opts.LatticeCorner = corner
+	}
+	cornerx, cornery, ec := opts.latticeCorner()
+	if ec != nil {
+		return ec
+	}
+	cornerx, cornery = cornerx*(scaling-1), cornery*(scaling-1)
+
+	b := im.Bounds()
+	full := image.NewNRGBA(image.Rect(0, 0, b.Dx()/scaling, b.Dy()/scaling))
+	table := correctionTable(gamma)
+	for y := 0; y < full.Rect.Dy(); y++ {
+		for x := 0; x < full.Rect.Dx(); x++ {
+			px := color.NRGBAModel.Convert(im.At(
+				b.Min.X+x*scaling+cornerx, b.Min.Y+y*scaling+cornery)).(color.NRGBA)
+			full.SetNRGBA(x, y, color.NRGBA{
+				R: table[px.R],
+				G: table[px.G],
+				B: table[px.B],
+				A: px.A,
+			})
+		}
+	}
+	if err := png.Encode(dest, full); err != nil {
+		return ChainErr(err, "Unable to encode extracted full image")
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"math"
+	"sync"
+)
+
+// Intervals the mantissa table of fastPow is split into.
+const fastPowSteps = 1024
+
+// Most gammas are only ever used once or twice, so the cache of tables is emptied rather than
+// grown past this.
+const gammaTablesMax = 16
+
+// gammaFunc applied to every 16 bit channel value.
+type gammaTable [nrgba64Max + 1]uint16
+
+type gammaTableKey struct {
+	p    float64
+	fast bool
+}
+
+var (
+	gammaTablesMu sync.Mutex
+	gammaTables   = make(map[gammaTableKey]*gammaTable)
+)
+
+// Returns the table of gammaFunc(p, fast), building it the first time p is used.  Tables are
+// shared between muxes, so a batch of images with the same gamma only builds one.
+func gammaLookup(p float64, fast bool) *gammaTable {
+	key := gammaTableKey{p: p, fast: fast}
+	gammaTablesMu.Lock()
+	defer gammaTablesMu.Unlock()
+	if t, ok := gammaTables[key]; ok {
+		return t
+	}
+	pow := gammaFunc(p, fast)
+	t := new(gammaTable)
+	for v := range t {
+		t[v] = uint16(nrgba64Max * pow(float64(v)/nrgba64Max))
+	}
+	if len(gammaTables) >= gammaTablesMax {
+		gammaTables = make(map[gammaTableKey]*gammaTable)
+	}
+	gammaTables[key] = t
+	return t
+}
+
+// Returns a func raising its argument to p, which must be positive.  If fast is set, it uses
+// tables rather than math.Pow, which is slow on some platforms such as wasm.  Over every 16 bit
+// input, the tables are within 0.03% of math.Pow for the target gamma, and 0.00004% for the
+// others, which is less than a tenth of a 16 bit step when linearizing.
+func gammaFunc(p float64, fast bool) func(float64) float64 {
+	if !fast {
+		return func(x float64) float64 {
+			return math.Pow(x, p)
+		}
+	}
+	return fastPow(p)
+}
+
+// Splits x into a mantissa in [0.5, 1) and a power of two, looks up each raised to p, and
+// interpolates between the mantissa entries.  Arguments over 1 are rare, and fall back to
+// math.Pow.
+func fastPow(p float64) func(float64) float64 {
+	// exps[i] is 2 raised to (1-i)*p, for every exponent Frexp returns for (0, 1].
+	exps := make([]float64, 1075)
+	for i := range exps {
+		exps[i] = math.Pow(2, float64(1-i)*p)
+	}
+	mants := make([]float64, fastPowSteps+1)
+	for i := range mants {
+		mants[i] = math.Pow(0.5+float64(i)/(2*fastPowSteps), p)
+	}
+	return func(x float64) float64 {
+		if x <= 0 {
+			return 0
+		}
+		if x > 1 {
+			return math.Pow(x, p)
+		}
+		frac, exp := math.Frexp(x)
+		t := (frac - 0.5) * (2 * fastPowSteps)
+		i := int(t)
+		f := t - float64(i)
+		return exps[1-exp] * (mants[i] + (mants[i+1]-mants[i])*f)
+	}
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"testing"
+)
+
+// Checks the largest relative errors of fastPow over every 16 bit input against those documented
+// on gammaFunc.
+func TestFastPowError(t *testing.T) {
+	tests := []struct {
+		p, maxErr float64
+	}{
+		{DefaultTargetGamma, 0.0003},
+		{1 / DefaultTargetGamma, 0.0000004},
+		{DefaultSourceGamma, 0.0000004},
+		{1 / DefaultSourceGamma, 0.0000004},
+	}
+	for _, tt := range tests {
+		fast := fastPow(tt.p)
+		var worst float64
+		for v := 1; v <= nrgba64Max; v++ {
+			x := float64(v) / nrgba64Max
+			want := math.Pow(x, tt.p)
+			if want == 0 {
+				continue
+			}
+			worst = math.Max(worst, math.Abs(fast(x)-want)/want)
+		}
+		t.Logf("p = %g: largest relative error %.3g", tt.p, worst)
+		if worst > tt.maxErr {
+			t.Errorf("p = %g: relative error %g, over %g", tt.p, worst, tt.maxErr)
+		}
+	}
+}
+
+func BenchmarkGammaFunc(b *testing.B) {
+	for _, p := range []float64{DefaultSourceGamma, 1 / DefaultTargetGamma} {
+		for _, fast := range []bool{false, true} {
+			name := "exact"
+			if fast {
+				name = "fast"
+			}
+			b.Run(strconv.FormatFloat(p, 'g', 4, 64)+"/"+name, func(b *testing.B) {
+				pow := gammaFunc(p, fast)
+				var sum float64
+				for i := 0; i < b.N; i++ {
+					sum += pow(float64(i%nrgba64Max+1) / nrgba64Max)
+				}
+				if sum < 0 {
+					b.Fatal(sum)
+				}
+			})
+		}
+	}
+}
+
+// Compares linearizing with math.Pow and with the fast tables, including building the table,
+// as the first mux with a new gamma does.
+func BenchmarkLinearImageFastGamma(b *testing.B) {
+	src := testPattern(512, 512)
+	for _, fast := range []bool{false, true} {
+		name := "exact"
+		if fast {
+			name = "fast"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				// A new gamma each time, so the table isn't cached.
+				table := gammaLookup(DefaultSourceGamma+float64(i)*1e-9, fast)
+				powImage(context.Background(), src, table, 16)
+			}
+		})
+	}
+}
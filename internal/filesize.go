@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+
+	"golang.org/x/image/draw"
+)
+
+// Thumbnails are shrunk by this much each time the output is still too big.
+const fitShrinkFactor = 0.75
+
+// Muxes and encodes, backing off in quality until the PNG fits in opts.MaxFileSize.  Each step
+// taken is logged.
+func fitMuxed(thumbnail, full image.Image, dest io.Writer, opts Options) *ErrChain {
+	// Crop up front, so the Thumbnail is shrunk from what is actually muxed.
+	thumbnail, full, opts, ec := cropInputs(thumbnail, full, opts)
+	if ec != nil {
+		return ec
+	}
+	attempt := func(thumbnail image.Image, opts Options) (*bytes.Buffer, *ErrChain) {
+		dim, ec := GammaMuxImagesOpts(thumbnail, full, opts)
+		if ec != nil {
+			return nil, ec
+		}
+		var buf bytes.Buffer
+		if ec := encodeMuxed(dim, &buf, opts); ec != nil {
+			return nil, ec
+		}
+		return &buf, nil
+	}
+	fits := func(buf *bytes.Buffer) bool {
+		return int64(buf.Len()) <= opts.MaxFileSize
+	}
+	write := func(buf *bytes.Buffer) *ErrChain {
+		if _, err := buf.WriteTo(dest); err != nil {
+			return ChainErr(err, "Unable to write PNG")
+		}
+		return nil
+	}
+
+	buf, ec := attempt(thumbnail, opts)
+	if ec != nil {
+		return ec
+	}
+	if fits(buf) {
+		return write(buf)
+	}
+
+	if opts.CompressionLevel != png.BestCompression {
+		log.Printf("Output is %d bytes, retrying with the best compression", buf.Len())
+		opts.CompressionLevel = png.BestCompression
+		if buf, ec = attempt(thumbnail, opts); ec != nil {
+			return ec
+		} else if fits(buf) {
+			return write(buf)
+		}
+	}
+
+	if !opts.AutoPalette {
+		log.Printf("Output is %d bytes, retrying as a paletted PNG", buf.Len())
+		opts.AutoPalette = true
+		if buf, ec = attempt(thumbnail, opts); ec != nil {
+			return ec
+		} else if fits(buf) {
+			return write(buf)
+		}
+	}
+
+	size := thumbnail.Bounds().Size()
+	for {
+		size = image.Point{
+			X: int(float64(size.X) * fitShrinkFactor),
+			Y: int(float64(size.Y) * fitShrinkFactor),
+		}
+		if size.X < 2*opts.fullScaling() || size.Y < 2*opts.fullScaling() {
+			return ChainErr(nil, fmt.Sprintf(
+				"Unable to fit output in %d bytes, smallest was %d bytes", opts.MaxFileSize, buf.Len()))
+		}
+		log.Printf("Output is %d bytes, retrying with a %dx%d Thumbnail", buf.Len(), size.X, size.Y)
+		smaller := scaleImage(
+			thumbnail, size, DefaultSourceGamma, opts.Precision, opts.PreserveAlpha)
+		if buf, ec = attempt(smaller, opts); ec != nil {
+			return ec
+		} else if fits(buf) {
+			return write(buf)
+		}
+	}
+}
+
+// Resamples an image encoded with gamma to size, in linear space.  Unless keepAlpha is set, the
+// image is flattened onto white first.
+func scaleImage(
+	im image.Image, size image.Point, gamma float64, precision int, keepAlpha bool) image.Image {
+	ctx := context.Background()
+	if !keepAlpha {
+		im = removeAlpha(ctx, im, 0, false, precision)
+	}
+	linear := linearImage(ctx, im, gamma, precision)
+	scaled, _, _ := resize(
+		linear, image.Rectangle{Max: size}, 1, 1, false, image.Pt(1, 1), draw.CatmullRom, precision)
+	return linearImage(ctx, scaled, 1/gamma, precision)
+}
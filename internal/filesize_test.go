@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand/v2"
+	"testing"
+)
+
+// Once fitMuxed shrinks the Thumbnail, it must still be decoded with the Thumbnail gamma, not the
+// SourceGamma of the Full image, and keep its alpha for PreserveAlpha.
+func TestFitMuxedShrink(t *testing.T) {
+	// Noise, so the output only gets smaller with fewer pixels.  The left quarter is transparent.
+	rng := rand.New(rand.NewPCG(1, 2))
+	thumbnail := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 16; x < 64; x++ {
+			v := rng.Uint32()
+			thumbnail.SetNRGBA(x, y, color.NRGBA{uint8(v), uint8(v >> 8), uint8(v >> 16), 0xFF})
+		}
+	}
+	full := testPattern(32, 32)
+	opts := Options{SourceGamma: 1.8, PreserveAlpha: true}
+
+	// What the first shrink should produce, after the compression and palette retries.
+	shrunkOpts := opts
+	shrunkOpts.CompressionLevel = png.BestCompression
+	shrunkOpts.AutoPalette = true
+	encode := func(thumbnail image.Image) []byte {
+		dim, ec := GammaMuxImagesOpts(thumbnail, full, shrunkOpts)
+		if ec != nil {
+			t.Fatal(ec)
+		}
+		var buf bytes.Buffer
+		if ec := encodeMuxed(dim, &buf, shrunkOpts); ec != nil {
+			t.Fatal(ec)
+		}
+		return buf.Bytes()
+	}
+	size := image.Pt(int(64*fitShrinkFactor), int(64*fitShrinkFactor))
+	want := encode(scaleImage(thumbnail, size, DefaultSourceGamma, 0, true))
+	if unshrunk := encode(thumbnail); len(unshrunk) <= len(want) {
+		t.Fatalf("unshrunk output is %d bytes, not more than %d", len(unshrunk), len(want))
+	}
+
+	opts.MaxFileSize = int64(len(want))
+	var buf bytes.Buffer
+	if ec := fitMuxed(thumbnail, full, &buf, opts); ec != nil {
+		t.Fatal(ec)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Error("output differs from a Thumbnail shrunk with the default source gamma")
+	}
+
+	im, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := nrgba64Reader(im)
+	b := im.Bounds()
+	var transparent, opaque int
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			switch at(x, y).A {
+			case 0:
+				transparent++
+			case nrgba64Max:
+				opaque++
+			}
+		}
+	}
+	if transparent == 0 || opaque == 0 {
+		t.Errorf("%d transparent and %d opaque pixels, want some of each", transparent, opaque)
+	}
+}
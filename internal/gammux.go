@@ -1,18 +1,28 @@
 package internal
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
-	"hash/crc32"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"image"
 	"image/color"
 	_ "image/gif"
-	_ "image/jpeg"
+	"image/jpeg"
 	"image/png"
 	"io"
+	"log"
 	"math"
+	"time"
 
+	_ "golang.org/x/image/bmp"
 	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff" // only the first page of multi-page TIFFs is decoded
+	_ "golang.org/x/image/webp"
 )
 
 const (
@@ -24,9 +34,24 @@ const (
 
 	nrgba64Max = 0xFFFF
 	nrgbaMax   = 0xFF
+
+	// DefaultTargetGamma is the gamma declared in muxed images.
+	DefaultTargetGamma = targetGamma
+
+	// DefaultSourceGamma is the gamma input images are assumed to have.
+	DefaultSourceGamma = sourceGamma
+
+	// DefaultMinPixel is the darkest linear value a Full pixel may have before the gamma transform.
+	DefaultMinPixel = 1.0 / nrgbaMax
 )
 
-var thumbnailDarkenFactor = math.Pow(math.Nextafter(0.5, 0)/nrgbaMax, sourceGamma/targetGamma)
+var thumbnailDarkenFactor = darkenFactor(sourceGamma, targetGamma)
+
+// Returns the most a Thumbnail may be scaled by, so that even its brightest value turns to black
+// after the gamma transform from source to target.
+func darkenFactor(source, target float64) float64 {
+	return math.Pow(math.Nextafter(0.5, 0)/nrgbaMax, source/target)
+}
 
 type ErrChain struct {
 	msg   string
@@ -35,12 +60,42 @@ type ErrChain struct {
 
 func (e *ErrChain) Error() string {
 	msg := e.msg
-	if e.cause != nil {
-		msg += "\n\tCaused by\n" + e.cause.Error()
+	if cause := e.Unwrap(); cause != nil {
+		msg += "\n\tCaused by\n" + cause.Error()
 	}
 	return msg
 }
 
+// Unwrap returns the cause, so errors.Is and errors.As can see through the chain.  A nil
+// *ErrChain cause, as passed by ChainErr(ec, ...) with no error, counts as no cause.
+func (e *ErrChain) Unwrap() error {
+	if e == nil {
+		return nil
+	}
+	if cause, ok := e.cause.(*ErrChain); ok && cause == nil {
+		return nil
+	}
+	return e.cause
+}
+
+// MarshalJSON writes the chain as nested {"message": ..., "cause": ...} objects.  Causes that
+// aren't an ErrChain only have a message.
+func (e *ErrChain) MarshalJSON() ([]byte, error) {
+	type jsonErr struct {
+		Message string      `json:"message"`
+		Cause   interface{} `json:"cause,omitempty"`
+	}
+	je := jsonErr{Message: e.msg}
+	if cause := e.Unwrap(); cause != nil {
+		if chain, ok := cause.(*ErrChain); ok {
+			je.Cause = chain
+		} else {
+			je.Cause = jsonErr{Message: cause.Error()}
+		}
+	}
+	return json.Marshal(je)
+}
+
 func ChainErr(cause error, message string) *ErrChain {
 	return &ErrChain{
 		msg:   message,
@@ -48,130 +103,622 @@ func ChainErr(cause error, message string) *ErrChain {
 	}
 }
 
-func removeAlpha(src image.Image) *image.NRGBA64 {
-	dst := image.NewNRGBA64(image.Rectangle{
+// DecodeError is the cause of an ErrChain when the Thumbnail or Full image can't be decoded, so
+// callers can tell which input was bad.
+type DecodeError struct {
+	// Which is "thumbnail" or "full".
+	Which string
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Chains err as the reason which, "thumbnail" or "full", couldn't be decoded.
+func decodeErr(err error, which string) *ErrChain {
+	return ChainErr(&DecodeError{Which: which, Err: err}, "Unable to decode "+which)
+}
+
+// Options controls how the Thumbnail and Full images are muxed together.
+type Options struct {
+	// Dither the Full image to hide banding.
+	Dither bool
+	// DitherAlgorithm is how the Full image is dithered: "floyd-steinberg", "atkinson", "sierra",
+	// "ordered", or "none".  Empty means Floyd-Steinberg.  Atkinson spreads less of the error,
+	// for cleaner details, and ordered uses a fixed Bayer pattern, which tiles.
+	DitherAlgorithm string
+	// Serpentine scans every other row right to left when dithering, which avoids the diagonal
+	// streaks that error diffusion leaves in smooth gradients.
+	Serpentine bool
+	// DitherChannels, if set, limits dithering to some of the channels, such as "g" or "rg".
+	// Empty means all of them.
+	DitherChannels string
+	// Stretch the Full image to fit the Thumbnail, rather than scaling it proportionally.
+	Stretch bool
+	// StretchAmount, when Stretch is false, partly stretches the Full image, from 0 for none to
+	// 1 for all the way.
+	StretchAmount float64
+	// Cover scales the Full image to fill the Thumbnail, cropping what doesn't fit, rather than
+	// letterboxing it.  Align picks which part is kept.  Stretch is ignored.
+	Cover bool
+	// AutoGray encodes the output as a grayscale PNG if every muxed pixel is gray.
+	AutoGray bool
+	// TargetGamma is the gamma declared in the output, which viewers that honor it decode with.
+	// Higher values hide the Thumbnail better, but leave the Full image fewer levels.  If 0,
+	// DefaultTargetGamma is used.
+	TargetGamma float64
+	// SourceGamma is the gamma the Full image is encoded with.  If 0, GammaMuxDataOpts uses the
+	// gamma declared by a PNG Full image, and otherwise DefaultSourceGamma is used.
+	SourceGamma float64
+	// FullScaling is how many output pixels wide and tall the block holding each Full pixel is.
+	// Bigger blocks survive more aggressive downscaling, but leave the Full image less resolution.
+	// If 0, 2 is used.
+	FullScaling int
+	// Scaler resamples the Full image to fit the Thumbnail.  If nil, draw.CatmullRom is used,
+	// which is sharpest, but rings around hard edges such as in pixel art and comics.
+	Scaler draw.Scaler
+	// MinPixel is the darkest linear value, between 0 and 1, a Full pixel is clamped to.  Higher
+	// values reduce the black mesh in dark areas, at the cost of brighter blacks.  If 0,
+	// DefaultMinPixel is used.
+	MinPixel float64
+	// RobustLattice draws each lattice pixel as a 2x2 block, so the Full image survives a 2x box
+	// filter downscale.  This halves the resolution of both the Thumbnail and Full images.
+	RobustLattice bool
+	// EmbedICC adds an iCCP chunk with an ICC profile declaring the target gamma, for viewers that
+	// ignore gAMA.  Viewers that support both use the ICC profile instead of the gAMA chunk.
+	EmbedICC bool
+	// Text, if set, is written to the output PNG as tEXt chunks, such as AttributionText.  Keys
+	// must be 1 to 79 printable Latin-1 characters, and values must be Latin-1.
+	Text map[string]string
+	// MaxDecodeTime abandons decoding an input image that takes longer than this.  If 0, there
+	// is no limit.
+	MaxDecodeTime time.Duration
+	// MaxPixels rejects an input image with more pixels than this, found from its header before
+	// it is decoded.  If 0, there is no limit.
+	MaxPixels int
+	// AlphaMode is how the alpha of the inputs is stored, "straight" or "premultiplied".  Empty
+	// means straight, which is what PNG requires, but some tools write premultiplied anyway.
+	AlphaMode string
+	// AlphaThreshold, if set, makes pixels less opaque than it fully transparent, and the rest fully
+	// opaque, instead of blending them onto the background.
+	AlphaThreshold uint8
+	// PreserveAlpha gives the output the alpha of the Thumbnail image, rather than leaving it
+	// opaque.  The images are still muxed over white, so partly transparent pixels keep their
+	// colors over white, and only show the Full image where the Thumbnail is opaque.
+	PreserveAlpha bool
+	// Background, if set, is what the margins around the Full image show, where it doesn't fill
+	// the Thumbnail.  The margins lose the Thumbnail image, unless Background is nil.
+	Background color.Color
+	// Align is where the Full image sits in the Thumbnail when it doesn't fill it: "center",
+	// "top", "bottom", "left", "right", or a corner such as "top-left".  Empty means center.
+	Align string
+	// Precision is the bits per channel, 8 or 16, of intermediate images.  8 bits halves the
+	// memory used, but linearizing at 8 bits causes banding in dark areas.  If 0, 16 is used.
+	Precision int
+	// FullGhosting, from 0 to 1, is how much of the Full image is mixed into the Thumbnail
+	// pixels, so it shows through faintly where gamma is ignored.  The Thumbnail stands out less,
+	// but the gamma corrected Full image is unaffected.
+	FullGhosting float64
+	// DitherSeed, if set, biases the error of each Full pixel, to stylize the dithering pattern.
+	// It must be the same size as the scaled Full image, half the size of the Thumbnail.  Mid
+	// gray has no effect, while darker and lighter pixels push the Full pixel down or up.
+	DitherSeed image.Image
+	// ThumbnailCrop and FullCrop, if set, trim the inputs before muxing.  They are relative to
+	// the top left corner of each image, and must fit inside it.
+	ThumbnailCrop image.Rectangle
+	FullCrop      image.Rectangle
+	// Feather, if positive, fades the edges of a letterboxed Full image into the letterbox over
+	// this many pixels.
+	Feather int
+	// Aspect, if set, crops the middle of both inputs to this width to height ratio, after
+	// ThumbnailCrop and FullCrop.
+	Aspect image.Point
+	// PostProcess, if set, is called with the muxed image before it is encoded, and returns the
+	// image to encode instead.  It may modify the image in place.  Changing pixels can weaken or
+	// break the effect, since each one is carefully balanced against its neighbors.
+	PostProcess func(muxed image.Image) image.Image
+	// AutoPalette encodes the output as a paletted PNG if it has at most 256 colors.
+	AutoPalette bool
+	// BitDepth is the bits per channel, 8 or 16, of the output.  Zero means 8.  16 bits rounds
+	// the Full pixels less, for smoother gradients, but doubles the size of the output.  16 bit
+	// output can only be written as a plain PNG.
+	BitDepth int
+	// CompressionLevel is the zlib compression used for the output PNG.
+	CompressionLevel png.CompressionLevel
+	// MaxFileSize, if set, is the largest output PNG allowed, in bytes.  Larger outputs are
+	// retried with the best compression, then as a paletted PNG, then with an ever smaller
+	// Thumbnail, until they fit.
+	MaxFileSize int64
+	// FastGamma, if set, approximates the gamma transforms of the Full image with tables, which
+	// is faster where math.Pow is slow, such as wasm.  A few pixels may be off by one step.
+	FastGamma bool
+	// ThumbnailVignette, if set, darkens the Thumbnail towards its corners, where this much of the
+	// light is removed.  It must be between 0 and 1.
+	ThumbnailVignette float64
+	// Denoise, if positive, blurs the Full image by this many pixels before muxing, to keep
+	// camera noise from turning into speckle.
+	Denoise int
+	// LatticeCorner is which pixel of each 2x2 block holds the Full image: "tl", "tr", "bl", or
+	// "br".  Empty means top left.  Some decoders sample a different corner when shrinking.
+	LatticeCorner string
+	// Encode, if set, replaces the standard PNG encoder.  It must write a PNG, which then has the
+	// gamma added like any other.
+	Encode func(w io.Writer, im image.Image) error
+	// AnimateThumbnail, if set, muxes each frame of an animated GIF or APNG Thumbnail with the
+	// Full image, and writes an APNG.  Only GammaMuxDataOpts supports it.
+	AnimateThumbnail bool
+	// FullFrame is which frame of an animated GIF Full image to use, counting from 0.  Frames
+	// that don't exist fall back to the first one.  Only GammaMuxDataOpts supports it.
+	FullFrame int
+	// ColorType, if set, forces the PNG color type: "gray", "grayalpha", "rgb", "rgba", or
+	// "palette".  It overrides AutoGray, and AutoPalette only makes "palette" optional.
+	ColorType string
+	// PrintDPI, if set, enlarges the output for printing at this many dots per inch, so each
+	// pixel is a whole number of dots, and declares the DPI in a pHYs chunk.  Only PNGs support it.
+	PrintDPI int
+	// Format is the encoding of the output, "png" or "webp".  Empty means PNG.
+	Format string
+	// Layout, if set, is filled in with where the Full image was placed.
+	Layout *Layout
+	// MemoryBudget, if set, muxes multiple pairs at once, as long as their estimated memory use
+	// stays within this many bytes.
+	MemoryBudget int64
+	// Strict, if set, fails the mux on any warning, rather than logging it.
+	Strict bool
+	// Verify, if set, decodes the output PNG before writing it, to check it is still valid after
+	// the gamma is added.
+	Verify bool
+	// Timings, if set, has the time spent in each stage added to it.
+	Timings *Timings
+
+	// ctx, if set by GammaMuxDataContext, stops muxing early once it is done.
+	ctx context.Context
+}
+
+// Logs warning, or returns it as an error if Strict is set.
+func (opts Options) warn(warning string) *ErrChain {
+	if opts.Strict {
+		return ChainErr(nil, warning)
+	}
+	log.Println(warning)
+	return nil
+}
+
+// Fingerprint identifies a mux of the given inputs.  Muxing is deterministic, so equal
+// fingerprints mean equal output.  Every option that can change the output is included; funcs are
+// only told apart by address.
+func Fingerprint(thumbnail, full []byte, opts Options) string {
+	h := sha256.New()
+	seed := opts.DitherSeed
+	// These only collect information, and pointers to them would make equal muxes look different.
+	opts.Timings, opts.Layout = nil, nil
+	// Neither does canceling, which only ever stops a mux.
+	opts.ctx = nil
+	// Printing the seed would include its pixel storage, but not reliably its pixels, so they are
+	// added on their own.
+	opts.DitherSeed = nil
+	fmt.Fprintf(h, "%d:%d:%+v:", len(thumbnail), len(full), opts)
+	if seed != nil {
+		at := nrgba64Reader(seed)
+		b := seed.Bounds()
+		fmt.Fprintf(h, "%v:", b)
+		px := make([]byte, 8)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := at(x, y)
+				binary.BigEndian.PutUint16(px[0:], c.R)
+				binary.BigEndian.PutUint16(px[2:], c.G)
+				binary.BigEndian.PutUint16(px[4:], c.B)
+				binary.BigEndian.PutUint16(px[6:], c.A)
+				h.Write(px)
+			}
+		}
+	}
+	h.Write(thumbnail)
+	h.Write(full)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns which pixel of each 2x2 block holds the Full image.
+func (o Options) latticeCorner() (x, y int, ec *ErrChain) {
+	switch o.LatticeCorner {
+	case "", "tl":
+		return 0, 0, nil
+	case "tr":
+		return 1, 0, nil
+	case "bl":
+		return 0, 1, nil
+	case "br":
+		return 1, 1, nil
+	}
+	return 0, 0, ChainErr(nil,
+		"Unknown lattice corner "+o.LatticeCorner+", must be tl, tr, bl, or br")
+}
+
+// Returns where to align the Full image, in halves of the margin: 0 for top or left, 1 for
+// center, and 2 for bottom or right.
+func (o Options) align() (image.Point, *ErrChain) {
+	switch o.Align {
+	case "", "center":
+		return image.Pt(1, 1), nil
+	case "top":
+		return image.Pt(1, 0), nil
+	case "bottom":
+		return image.Pt(1, 2), nil
+	case "left":
+		return image.Pt(0, 1), nil
+	case "right":
+		return image.Pt(2, 1), nil
+	case "top-left":
+		return image.Pt(0, 0), nil
+	case "top-right":
+		return image.Pt(2, 0), nil
+	case "bottom-left":
+		return image.Pt(0, 2), nil
+	case "bottom-right":
+		return image.Pt(2, 2), nil
+	}
+	return image.Point{}, ChainErr(nil, "Unknown align "+o.Align+", must be center, top, bottom,"+
+		" left, right, top-left, top-right, bottom-left, or bottom-right")
+}
+
+// Which color channels spread their rounding error to their neighbors.
+type ditherChannels struct {
+	r, g, b bool
+}
+
+// Returns which channels to dither, none of them if Dither isn't set.
+func (o Options) ditherChannels() (ditherChannels, *ErrChain) {
+	if !o.Dither || o.DitherAlgorithm == "none" {
+		return ditherChannels{}, nil
+	}
+	if o.DitherChannels == "" {
+		return ditherChannels{r: true, g: true, b: true}, nil
+	}
+	var dc ditherChannels
+	for _, c := range o.DitherChannels {
+		var seen bool
+		switch c {
+		case 'r':
+			seen, dc.r = dc.r, true
+		case 'g':
+			seen, dc.g = dc.g, true
+		case 'b':
+			seen, dc.b = dc.b, true
+		default:
+			seen = true
+		}
+		if seen {
+			return ditherChannels{}, ChainErr(nil, "Bad dither channels "+o.DitherChannels+
+				", must be some of r, g, and b, such as rgb or g")
+		}
+	}
+	return dc, nil
+}
+
+func (o Options) stretchAmount() float64 {
+	if o.Stretch {
+		return 1
+	}
+	return o.StretchAmount
+}
+
+func (o Options) targetGamma() float64 {
+	if o.TargetGamma == 0 {
+		return DefaultTargetGamma
+	}
+	return o.TargetGamma
+}
+
+func (o Options) fullGamma() float64 {
+	if o.SourceGamma == 0 {
+		return DefaultSourceGamma
+	}
+	return o.SourceGamma
+}
+
+// Returns the gamma declared by the gAMA chunk of the PNG in data, or 0 if it isn't a PNG or
+// declares none.
+func declaredGamma(data []byte) float64 {
+	info, ec := ReadPNGInfo(bytes.NewReader(data))
+	if ec != nil || !info.HasGamma {
+		return 0
+	}
+	return info.Gamma
+}
+
+func (o Options) fullScaling() int {
+	if o.FullScaling == 0 {
+		return fullScaling
+	}
+	return o.FullScaling
+}
+
+// Like fullScaling, but fails if the blocks are too small to hold any Thumbnail pixels.
+func (o Options) checkedFullScaling() (int, *ErrChain) {
+	scaling := o.fullScaling()
+	if scaling < 2 {
+		return 0, ChainErr(nil, fmt.Sprintf("Full scaling %d must be at least 2", scaling))
+	}
+	return scaling, nil
+}
+
+func (o Options) scaler() draw.Scaler {
+	if o.Scaler == nil {
+		return draw.CatmullRom
+	}
+	return o.Scaler
+}
+
+// ParseScaler returns the resampling filter named name: "catmullrom", "bilinear",
+// "approxbilinear", or "nearest".
+func ParseScaler(name string) (draw.Scaler, *ErrChain) {
+	switch name {
+	case "catmullrom":
+		return draw.CatmullRom, nil
+	case "bilinear":
+		return draw.BiLinear, nil
+	case "approxbilinear":
+		return draw.ApproxBiLinear, nil
+	case "nearest":
+		return draw.NearestNeighbor, nil
+	}
+	return nil, ChainErr(nil, "Unknown scaler "+name+
+		", must be catmullrom, bilinear, approxbilinear, or nearest")
+}
+
+// ParseCompressionLevel returns the PNG compression level named name: "default", "none",
+// "speed", or "best".
+func ParseCompressionLevel(name string) (png.CompressionLevel, *ErrChain) {
+	switch name {
+	case "default":
+		return png.DefaultCompression, nil
+	case "none":
+		return png.NoCompression, nil
+	case "speed":
+		return png.BestSpeed, nil
+	case "best":
+		return png.BestCompression, nil
+	}
+	return 0, ChainErr(nil, "Unknown compression "+name+", must be default, none, speed, or best")
+}
+
+func (o Options) context() context.Context {
+	if o.ctx == nil {
+		return context.Background()
+	}
+	return o.ctx
+}
+
+func (o Options) minPixel() float64 {
+	if o.MinPixel == 0 {
+		return DefaultMinPixel
+	}
+	return o.MinPixel
+}
+
+// Explain writes the default gamma values used for muxing, and why they were picked.
+func Explain(w io.Writer) error {
+	return ExplainOpts(w, Options{})
+}
+
+// ExplainOpts writes the gamma values used for muxing with opts, and why they were picked.
+func ExplainOpts(w io.Writer, opts Options) error {
+	target := opts.targetGamma()
+	darken := darkenFactor(sourceGamma, target)
+	_, err := fmt.Fprintf(w, `Source gamma:            %g
+Display gamma:           %g
+Target gamma:            %g
+Thumbnail darken factor: %.4f
+PNG gAMA chunk value:    %d
+
+The Full image is decoded with the source gamma.  The Thumbnail is darkened by %.4f so that
+even its brightest value, %d/%d, displays as less than half of the smallest step once a
+compliant viewer converts it from the target gamma to the display gamma.  Compliant viewers
+round it to black, leaving only the Full image visible.
+`,
+		opts.fullGamma(),
+		sourceGamma,
+		target,
+		darken,
+		GamaChunkValue(target),
+		darken,
+		uint8(darken*nrgbaMax),
+		nrgbaMax)
+	return err
+}
+
+// Returns a warning if the colors of im don't look like they match premultiplied, or "" if they
+// do or there's no way to tell.  Premultiplied colors are never brighter than their alpha, and
+// usually close to it, since they are scaled down by it.  Straight colors only look like that
+// when enough translucent pixels agree, as dark ones are never brighter than their alpha either.
+func alphaModeWarning(im image.Image, premultiplied bool) string {
+	// How many translucent pixels it takes to suspect straight colors of being premultiplied.
+	const minTranslucent = 16
+	at := nrgba64Reader(im)
+	var translucent, brighter, near int
+	for y := im.Bounds().Min.Y; y < im.Bounds().Max.Y; y++ {
+		for x := im.Bounds().Min.X; x < im.Bounds().Max.X; x++ {
+			px := at(x, y)
+			if px.A == 0 || px.A == nrgba64Max {
+				continue
+			}
+			translucent++
+			if brightest := max(px.R, px.G, px.B); brightest > px.A {
+				brighter++
+			} else if brightest >= px.A-px.A/8 {
+				near++
+			}
+		}
+	}
+	if premultiplied && brighter > 0 {
+		return "doesn't look premultiplied, since some colors are brighter than their alpha"
+	}
+	if !premultiplied && translucent >= minTranslucent && brighter == 0 && near*2 >= translucent {
+		return "may be premultiplied, since no colors are brighter than their alpha, and most" +
+			" are close to it"
+	}
+	return ""
+}
+
+// Flattens src onto a white background.  If alphaThreshold is set, pixels less opaque than it are
+// treated as fully transparent, and the rest as fully opaque, rather than blending.  If
+// premultiplied, the colors of src are taken to be already multiplied by alpha, even though it's
+// decoded as straight alpha.  Rows after ctx is done are left black.
+func removeAlpha(ctx context.Context, src image.Image, alphaThreshold uint8, premultiplied bool,
+	precision int) nrgba64Image {
+	dst := newNRGBA64Image(image.Rectangle{
 		Max: image.Point{
 			X: src.Bounds().Dx(),
 			Y: src.Bounds().Dy(),
 		},
+	}, precision)
+	at := nrgba64Reader(src)
+	b := src.Bounds()
+	forEachRow(ctx, b.Dy(), func(dsty int) {
+		for dstx := 0; dstx < b.Dx(); dstx++ {
+			px := at(b.Min.X+dstx, b.Min.Y+dsty)
+			dst.SetNRGBA64(dstx, dsty, removePixelAlpha(px, alphaThreshold, premultiplied))
+		}
 	})
-	var dsty int
-	for y := src.Bounds().Min.Y; y < src.Bounds().Max.Y; y++ {
-		var dstx int
-		for x := src.Bounds().Min.X; x < src.Bounds().Max.X; x++ {
-			px := color.NRGBA64Model.Convert(src.At(x, y)).(color.NRGBA64)
-			if px.A != nrgba64Max {
-				dst.SetNRGBA64(dstx, dsty, color.NRGBA64{
-					R: uint16(uint32(px.R)*uint32(px.A)>>16 + nrgba64Max - uint32(px.A)),
-					G: uint16(uint32(px.G)*uint32(px.A)>>16 + nrgba64Max - uint32(px.A)),
-					B: uint16(uint32(px.B)*uint32(px.A)>>16 + nrgba64Max - uint32(px.A)),
-					A: nrgba64Max,
-				})
-			} else {
-				dst.SetNRGBA64(dstx, dsty, color.NRGBA64{
-					R: px.R,
-					G: px.G,
-					B: px.B,
-					A: nrgba64Max,
-				})
+	return dst
+}
+
+// Composites one pixel over white, as removeAlpha does.
+func removePixelAlpha(px color.NRGBA64, alphaThreshold uint8, premultiplied bool) color.NRGBA64 {
+	if premultiplied && px.A != 0 && px.A != nrgba64Max {
+		unpremultiply := func(v uint16) uint16 {
+			if v >= px.A {
+				return nrgba64Max
 			}
-			dstx++
+			return uint16(uint32(v) * nrgba64Max / uint32(px.A))
 		}
-		dsty++
+		px.R, px.G, px.B = unpremultiply(px.R), unpremultiply(px.G), unpremultiply(px.B)
+	}
+	if alphaThreshold != 0 {
+		if px.A < uint16(alphaThreshold)*0x101 {
+			px.A = 0
+		} else {
+			px.A = nrgba64Max
+		}
+	}
+	if px.A != nrgba64Max {
+		return color.NRGBA64{
+			R: uint16(uint32(px.R)*uint32(px.A)>>16 + nrgba64Max - uint32(px.A)),
+			G: uint16(uint32(px.G)*uint32(px.A)>>16 + nrgba64Max - uint32(px.A)),
+			B: uint16(uint32(px.B)*uint32(px.A)>>16 + nrgba64Max - uint32(px.A)),
+			A: nrgba64Max,
+		}
+	}
+	return color.NRGBA64{
+		R: px.R,
+		G: px.G,
+		B: px.B,
+		A: nrgba64Max,
 	}
-	return dst
 }
 
 // Linearize image.  At leats 16 bits per channel are needed as per
 // http://lbodnar.dsl.pipex.com/imaging/gamma.html
-func linearImage(srcim image.Image, gamma float64) *image.NRGBA64 {
-	dstim := image.NewNRGBA64(image.Rectangle{
+func linearImage(ctx context.Context, srcim image.Image, gamma float64,
+	precision int) nrgba64Image {
+	return powImage(ctx, srcim, gammaLookup(gamma, false), precision)
+}
+
+// Looks up each color channel of srcim in table.  Rows after ctx is done are left black.
+func powImage(ctx context.Context, srcim image.Image, table *gammaTable,
+	precision int) nrgba64Image {
+	dstim := newNRGBA64Image(image.Rectangle{
 		Max: image.Point{
 			X: srcim.Bounds().Dx(),
 			Y: srcim.Bounds().Dy(),
 		},
-	})
-	var dsty int
-	for srcy := srcim.Bounds().Min.Y; srcy < srcim.Bounds().Max.Y; srcy++ {
-		var dstx int
-		for srcx := srcim.Bounds().Min.X; srcx < srcim.Bounds().Max.X; srcx++ {
-			nrgba64 := color.NRGBA64Model.Convert(srcim.At(srcx, srcy)).(color.NRGBA64)
-			nrgba64.R = uint16(nrgba64Max * math.Pow(float64(nrgba64.R)/nrgba64Max, gamma))
-			nrgba64.G = uint16(nrgba64Max * math.Pow(float64(nrgba64.G)/nrgba64Max, gamma))
-			nrgba64.B = uint16(nrgba64Max * math.Pow(float64(nrgba64.B)/nrgba64Max, gamma))
+	}, precision)
+	at := nrgba64Reader(srcim)
+	b := srcim.Bounds()
+	forEachRow(ctx, b.Dy(), func(dsty int) {
+		for dstx := 0; dstx < b.Dx(); dstx++ {
+			nrgba64 := at(b.Min.X+dstx, b.Min.Y+dsty)
+			nrgba64.R = table[nrgba64.R]
+			nrgba64.G = table[nrgba64.G]
+			nrgba64.B = table[nrgba64.B]
 			// Alpha is not affected
 			dstim.SetNRGBA64(dstx, dsty, nrgba64)
-			dstx++
 		}
-		dsty++
-	}
+	})
 	return dstim
 }
 
-func darkenImage(srcim image.Image, scale float64) *image.NRGBA64 {
-	dstim := image.NewNRGBA64(image.Rectangle{
+// Rows after ctx is done are left black.
+func darkenImage(ctx context.Context, srcim image.Image, scale float64,
+	precision int) nrgba64Image {
+	dstim := newNRGBA64Image(image.Rectangle{
 		Max: image.Point{
 			X: srcim.Bounds().Dx(),
 			Y: srcim.Bounds().Dy(),
 		},
-	})
-	var dsty int
-	for srcy := srcim.Bounds().Min.Y; srcy < srcim.Bounds().Max.Y; srcy++ {
-		var dstx int
-		for srcx := srcim.Bounds().Min.X; srcx < srcim.Bounds().Max.X; srcx++ {
-			nrgba64 := color.NRGBA64Model.Convert(srcim.At(srcx, srcy)).(color.NRGBA64)
+	}, precision)
+	at := nrgba64Reader(srcim)
+	b := srcim.Bounds()
+	forEachRow(ctx, b.Dy(), func(dsty int) {
+		for dstx := 0; dstx < b.Dx(); dstx++ {
+			nrgba64 := at(b.Min.X+dstx, b.Min.Y+dsty)
 			nrgba64.R = uint16(float64(nrgba64.R) * scale)
 			nrgba64.G = uint16(float64(nrgba64.G) * scale)
 			nrgba64.B = uint16(float64(nrgba64.B) * scale)
 			// Alpha is not affected
 			dstim.SetNRGBA64(dstx, dsty, nrgba64)
-			dstx++
 		}
-		dsty++
-	}
+	})
 	return dstim
 }
 
-// Assumes src is linear
-func resize(src image.Image, targetBounds image.Rectangle, targetScaleDown int, stretch bool) (
-	*image.NRGBA64, int, int) {
-	var xoffset, yoffset int
-	var newTargetBounds image.Rectangle
-	if stretch {
-		newTargetBounds = image.Rectangle{
-			Max: image.Point{
-				X: targetBounds.Dx() / targetScaleDown,
-				Y: targetBounds.Dy() / targetScaleDown,
-			},
-		}
+// Assumes src is linear.  stretch goes from 0, which keeps the aspect ratio of src, to 1, which
+// fills targetBounds.  align is where the scaled image sits, as returned by Options.align.  If
+// cover, src is instead cropped to fill targetBounds, keeping the part picked by align.
+func resize(src image.Image, targetBounds image.Rectangle, targetScaleDown int, stretch float64,
+	cover bool, align image.Point, scaler draw.Scaler, precision int) (nrgba64Image, int, int) {
+	srcRect := src.Bounds()
+	if cover {
+		srcRect = alignedAspectRect(srcRect, targetBounds.Size(), align)
+		stretch = 1
+	}
+	stretched := image.Point{
+		X: targetBounds.Dx() / targetScaleDown,
+		Y: targetBounds.Dy() / targetScaleDown,
+	}
+	// Check if the source image is wider than the dest, or narrower.   The odd multiplication
+	// avoids casting to float, at the risk of possibly overflow.  Don't use images taller or
+	// wider than 32K on 32 bits machines.
+	contained := stretched
+	if srcRect.Dx()*targetBounds.Dy() > targetBounds.Dx()*srcRect.Dy() {
+		// source image is wider.
+		contained.Y = srcRect.Dy() * targetBounds.Dx() / srcRect.Dx() / targetScaleDown
 	} else {
-		// Check if the source image is wider than the dest, or narrower.   The odd multiplication
-		// avoids casting to float, at the risk of possibly overflow.  Don't use images taller or
-		// wider than 32K on 32 bits machines.
-		if src.Bounds().Dx()*targetBounds.Dy() > targetBounds.Dx()*src.Bounds().Dy() {
-			// source image is wider.
-			newTargetBounds = image.Rectangle{
-				Max: image.Point{
-					X: targetBounds.Dx() / targetScaleDown,
-					Y: src.Bounds().Dy() * targetBounds.Dx() / src.Bounds().Dx() / targetScaleDown,
-				},
-			}
-			yoffset = (targetBounds.Dy() - newTargetBounds.Dy()*targetScaleDown) / 2
-		} else {
-			// source image is narrower.
-			newTargetBounds = image.Rectangle{
-				Max: image.Point{
-					X: src.Bounds().Dx() * targetBounds.Dy() / src.Bounds().Dy() / targetScaleDown,
-					Y: targetBounds.Dy() / targetScaleDown,
-				},
-			}
-			xoffset = (targetBounds.Dx() - newTargetBounds.Dx()*targetScaleDown) / 2
-		}
+		// source image is narrower.
+		contained.X = srcRect.Dx() * targetBounds.Dy() / srcRect.Dy() / targetScaleDown
+	}
+	newTargetBounds := image.Rectangle{
+		Max: image.Point{
+			X: contained.X + int(math.Round(float64(stretched.X-contained.X)*stretch)),
+			Y: contained.Y + int(math.Round(float64(stretched.Y-contained.Y)*stretch)),
+		},
 	}
+	xoffset := (targetBounds.Dx() - newTargetBounds.Dx()*targetScaleDown) * align.X / 2
+	yoffset := (targetBounds.Dy() - newTargetBounds.Dy()*targetScaleDown) * align.Y / 2
 
-	dst := image.NewNRGBA64(newTargetBounds)
-	scaler := draw.CatmullRom
-	scaler.Scale(dst, newTargetBounds, src, src.Bounds(), draw.Over, nil)
+	dst := newNRGBA64Image(newTargetBounds, precision)
+	if newTargetBounds.Size() == srcRect.Size() {
+		// Already the right size, so copy it rather than blur it with resampling.
+		draw.Draw(dst, newTargetBounds, src, srcRect.Min, draw.Src)
+		return dst, xoffset, yoffset
+	}
+	scaler.Scale(dst, newTargetBounds, src, srcRect, draw.Over, nil)
 	return dst, xoffset, yoffset
 }
 
@@ -179,22 +726,65 @@ type dithererr struct {
 	r, g, b float64
 }
 
+// Reset any channel that is no longer finite.  A single NaN would otherwise be diffused into
+// every following pixel, blanking the rest of the image.
+func (e *dithererr) sanitize() {
+	finite := func(v float64) float64 {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0
+		}
+		return v
+	}
+	e.r = finite(e.r)
+	e.g = finite(e.g)
+	e.b = finite(e.b)
+}
+
+// Scales v up to max, rounding half away from zero.  The product is rounded on its own, so no
+// platform fuses it into other arithmetic.
 func scaleClamp(v float64, max float64) float64 {
 	if v > 1.0 {
 		v = 1.0
 	}
-	return math.Round(v * max)
+	return math.Round(float64(v * max))
 }
 
-func calculateFullPixel(
-	srcx int, srcnrgba color.NRGBA64, dither bool, errcurr, errnext []dithererr) color.NRGBA {
-	const newMaxValue = nrgbaMax
+// Scales v up to max, shifted by threshold steps before rounding, and kept within 0 and max.
+func orderedRound(v, max, threshold float64) float64 {
+	if r := scaleClamp(v+threshold/max, max); r > 0 {
+		return r
+	}
+	return 0
+}
+
+// Converts a linear Full pixel to its output value with encode, which raises to 1/targetGamma, and
+// rounds it to newMaxValue steps, the most an output channel holds.  The rounding error of
+// dithered channels, measured back in linear space with decode, which raises to targetGamma, is
+// spread by kernel into errs, the error rows starting at the current one, or if kernel is nil,
+// threshold shifts them before rounding instead.  dir is 1 when the row is scanned left to right,
+// and -1 when right to left, which mirrors the kernel.
+func calculateFullPixel(srcx, dir int, srcnrgba color.NRGBA64, dither ditherChannels,
+	kernel *ditherKernel, threshold float64, minPixel float64, newMaxValue float64,
+	encode, decode func(float64) float64, errs [][]dithererr) color.NRGBA64 {
 	nonneg := func(in float64) float64 {
-		if low := 1.0 / newMaxValue; in < low {
+		if low := minPixel; in < low {
 			return low
 		}
 		return in
 	}
+	errcurr := errs[0]
+	errcurr[srcx+ditherPad].sanitize()
+	// Channels that aren't dithered ignore any error, such as from a DitherSeed.
+	incoming := errcurr[srcx+ditherPad]
+	if !dither.r {
+		incoming.r = 0
+	}
+	if !dither.g {
+		incoming.g = 0
+	}
+	if !dither.b {
+		incoming.b = 0
+	}
 
 	var (
 		// Make sure there are no zeros
@@ -207,14 +797,14 @@ func calculateFullPixel(
 		// Also, if there is a row of black pixels, the error can build up.  By clamping, negative
 		// will not get excessive.  (this consumes the first bright pixel after a string of dark
 		// pixels otherwise).
-		errorred   = nonneg(red + errcurr[srcx+1].r)
-		errorgreen = nonneg(green + errcurr[srcx+1].g)
-		errorblue  = nonneg(blue + errcurr[srcx+1].b)
+		errorred   = nonneg(red + incoming.r)
+		errorgreen = nonneg(green + incoming.g)
+		errorblue  = nonneg(blue + incoming.b)
 
 		// apply the new gamma
-		newred   = math.Pow(errorred, 1/targetGamma)
-		newgreen = math.Pow(errorgreen, 1/targetGamma)
-		newblue  = math.Pow(errorblue, 1/targetGamma)
+		newred   = encode(errorred)
+		newgreen = encode(errorgreen)
+		newblue  = encode(errorblue)
 
 		// bring value up to 0-newMaxValue range
 		roundred   = scaleClamp(newred, newMaxValue)
@@ -222,39 +812,143 @@ func calculateFullPixel(
 		roundblue  = scaleClamp(newblue, newMaxValue)
 	)
 
-	if dither {
+	if kernel == nil {
+		if dither.r {
+			roundred = orderedRound(newred, newMaxValue, threshold)
+		}
+		if dither.g {
+			roundgreen = orderedRound(newgreen, newMaxValue, threshold)
+		}
+		if dither.b {
+			roundblue = orderedRound(newblue, newMaxValue, threshold)
+		}
+	} else if dither.r || dither.g || dither.b {
 		// Undo the gamma transform once more to make the error linear
 		var (
-			diffred   = errorred - math.Pow(roundred/newMaxValue, targetGamma)
-			diffgreen = errorgreen - math.Pow(roundgreen/newMaxValue, targetGamma)
-			diffblue  = errorblue - math.Pow(roundblue/newMaxValue, targetGamma)
+			diffred   = errorred - decode(roundred/newMaxValue)
+			diffgreen = errorgreen - decode(roundgreen/newMaxValue)
+			diffblue  = errorblue - decode(roundblue/newMaxValue)
 		)
+		// Channels that aren't dithered just round, and keep their error to themselves.
+		if !dither.r {
+			diffred = 0
+		}
+		if !dither.g {
+			diffgreen = 0
+		}
+		if !dither.b {
+			diffblue = 0
+		}
 
-		errcurr[srcx+2].r += diffred * 7 / 16
-		errcurr[srcx+2].g += diffgreen * 7 / 16
-		errcurr[srcx+2].b += diffblue * 7 / 16
-
-		errnext[srcx].r += diffred * 3 / 16
-		errnext[srcx].g += diffgreen * 3 / 16
-		errnext[srcx].b += diffblue * 3 / 16
-
-		errnext[srcx+1].r += diffred * 5 / 16
-		errnext[srcx+1].g += diffgreen * 5 / 16
-		errnext[srcx+1].b += diffblue * 5 / 16
-
-		errnext[srcx+2].r += diffred * 1 / 16
-		errnext[srcx+2].g += diffgreen * 1 / 16
-		errnext[srcx+2].b += diffblue * 1 / 16
+		// The explicit conversions keep platforms with fused multiply-add, such as arm64, from
+		// rounding differently than the rest.
+		for _, t := range kernel.taps {
+			e := &errs[t.dy][srcx+ditherPad+dir*t.dx]
+			e.r += float64(diffred * t.weight / kernel.divisor)
+			e.g += float64(diffgreen * t.weight / kernel.divisor)
+			e.b += float64(diffblue * t.weight / kernel.divisor)
+		}
 	}
-	return color.NRGBA{
-		R: uint8(roundred),
-		G: uint8(roundgreen),
-		B: uint8(roundblue),
-		A: uint8(srcnrgba.A >> 8),
+	return color.NRGBA64{
+		R: uint16(roundred * nrgba64Max / newMaxValue),
+		G: uint16(roundgreen * nrgba64Max / newMaxValue),
+		B: uint16(roundblue * nrgba64Max / newMaxValue),
+		A: srcnrgba.A,
 	}
 }
 
 func GammaMuxImages(thumbnail, full image.Image, dither, stretch bool) (image.Image, *ErrChain) {
+	return GammaMuxImagesOpts(thumbnail, full, Options{
+		Dither:  dither,
+		Stretch: stretch,
+	})
+}
+
+func GammaMuxImagesOpts(thumbnail, full image.Image, opts Options) (image.Image, *ErrChain) {
+	thumbnail, full, opts, ec := cropInputs(thumbnail, full, opts)
+	if ec != nil {
+		return nil, ec
+	}
+
+	if opts.RobustLattice {
+		return robustGammaMuxImages(thumbnail, full, opts)
+	}
+	if ec := checkPrecision(opts.Precision); ec != nil {
+		return nil, ec
+	}
+	minPixel := opts.minPixel()
+	if minPixel < 0 || minPixel > 1 || math.IsNaN(minPixel) {
+		return nil, ChainErr(nil, fmt.Sprintf("Min pixel %v must be between 0 and 1", minPixel))
+	}
+	target := opts.targetGamma()
+	if ec := CheckGamma(target); ec != nil {
+		return nil, ChainErr(ec, "Bad target gamma")
+	}
+	if ec := CheckGamma(opts.fullGamma()); ec != nil {
+		return nil, ChainErr(ec, "Bad source gamma")
+	}
+	if warning := WarnGamma(target, sourceGamma); warning != "" {
+		if ec := opts.warn(warning); ec != nil {
+			return nil, ec
+		}
+	}
+	darken := darkenFactor(sourceGamma, target)
+	scaling, ec := opts.checkedFullScaling()
+	if ec != nil {
+		return nil, ec
+	}
+	cornerx, cornery, ec := opts.latticeCorner()
+	if ec != nil {
+		return nil, ec
+	}
+	align, ec := opts.align()
+	if ec != nil {
+		return nil, ec
+	}
+	dither, ec := opts.ditherChannels()
+	if ec != nil {
+		return nil, ec
+	}
+	kernel, ec := opts.ditherKernel()
+	if ec != nil {
+		return nil, ec
+	}
+	if opts.Feather < 0 {
+		return nil, ChainErr(nil, fmt.Sprintf("Feather %d must not be negative", opts.Feather))
+	}
+	if opts.ThumbnailVignette < 0 || opts.ThumbnailVignette > 1 ||
+		math.IsNaN(opts.ThumbnailVignette) {
+		return nil, ChainErr(nil, fmt.Sprintf(
+			"Thumbnail vignette %v must be between 0 and 1", opts.ThumbnailVignette))
+	}
+	if opts.Denoise < 0 {
+		return nil, ChainErr(nil, fmt.Sprintf("Denoise %d must not be negative", opts.Denoise))
+	}
+	if stretch := opts.stretchAmount(); stretch < 0 || stretch > 1 || math.IsNaN(stretch) {
+		return nil, ChainErr(nil, fmt.Sprintf("Stretch %v must be between 0 and 1", stretch))
+	}
+	if opts.AlphaMode != "" && opts.AlphaMode != "straight" && opts.AlphaMode != "premultiplied" {
+		return nil, ChainErr(nil,
+			"Unknown alpha mode "+opts.AlphaMode+", must be straight or premultiplied")
+	}
+	premultiplied := opts.AlphaMode == "premultiplied"
+	if warning := alphaModeWarning(thumbnail, premultiplied); warning != "" {
+		if ec := opts.warn("The thumbnail image " + warning); ec != nil {
+			return nil, ec
+		}
+	}
+	if warning := alphaModeWarning(full, premultiplied); warning != "" {
+		if ec := opts.warn("The full image " + warning); ec != nil {
+			return nil, ec
+		}
+	}
+	if opts.FullGhosting < 0 || opts.FullGhosting > 1 || math.IsNaN(opts.FullGhosting) {
+		return nil, ChainErr(nil, fmt.Sprintf(
+			"Full ghosting %v must be between 0 and 1", opts.FullGhosting))
+	}
+	if opts.BitDepth != 0 && opts.BitDepth != 8 && opts.BitDepth != 16 {
+		return nil, ChainErr(nil, fmt.Sprintf("Bit depth %d must be 8 or 16", opts.BitDepth))
+	}
 	noOffsetThumbnailRec := image.Rectangle{
 		Max: image.Point{
 			X: thumbnail.Bounds().Dx(),
@@ -262,146 +956,762 @@ func GammaMuxImages(thumbnail, full image.Image, dither, stretch bool) (image.Im
 		},
 	}
 
+	// Each stage stops early once ctx is done, so check it before using what the stage made.
+	ctx := opts.context()
+	canceled := func() *ErrChain {
+		if err := ctx.Err(); err != nil {
+			return ChainErr(err, "Muxing canceled")
+		}
+		return nil
+	}
+
+	start := time.Now()
+	opaquefull := removeAlpha(ctx, full, opts.AlphaThreshold, premultiplied, opts.Precision)
+	opaquethumbnail := removeAlpha(
+		ctx, thumbnail, opts.AlphaThreshold, premultiplied, opts.Precision)
+	opts.Timings.record("removeAlpha", start)
+
 	// linearize before resizing
-	linearfull := linearImage(removeAlpha(full), sourceGamma)
+	start = time.Now()
+	linearfull := powImage(
+		ctx, opaquefull, gammaLookup(opts.fullGamma(), opts.FastGamma), opts.Precision)
+	opts.Timings.record("linearize", start)
+	if ec := canceled(); ec != nil {
+		return nil, ec
+	}
+
+	if opts.Denoise > 0 {
+		start = time.Now()
+		linearfull = denoiseImage(linearfull, opts.Denoise, opts.Precision)
+		opts.Timings.record("denoise", start)
+	}
+
 	// Always resize, regardless of dimensions
-	smallfull, xoffset, yoffset := resize(linearfull, noOffsetThumbnailRec, fullScaling, stretch)
+	start = time.Now()
+	smallfull, xoffset, yoffset := resize(linearfull, noOffsetThumbnailRec, scaling,
+		opts.stretchAmount(), opts.Cover, align, opts.scaler(), opts.Precision)
+	opts.Timings.record("resize", start)
+	// Resampling can't be interrupted, so it is only checked once it finishes.
+	if ec := canceled(); ec != nil {
+		return nil, ec
+	}
+	opts.Layout.record(image.Rectangle{
+		Min: image.Point{X: xoffset, Y: yoffset},
+		Max: image.Point{
+			X: xoffset + smallfull.Bounds().Dx()*scaling,
+			Y: yoffset + smallfull.Bounds().Dy()*scaling,
+		},
+	}, xoffset, yoffset)
+
 	// thumbnailDarkenFactor is a max value that will turn to black after the gamma transform
-	darkThumbnail := darkenImage(removeAlpha(thumbnail), thumbnailDarkenFactor)
-	var errcurr, errnext []dithererr
-	errnext = make([]dithererr, smallfull.Bounds().Dx()+2)
+	start = time.Now()
+	darkThumbnail := darkenImage(ctx, opaquethumbnail, darken, opts.Precision)
+	if opts.ThumbnailVignette > 0 {
+		vignetteImage(darkThumbnail, opts.ThumbnailVignette)
+	}
+	opts.Timings.record("darken", start)
+	if ec := canceled(); ec != nil {
+		return nil, ec
+	}
 
-	dst := image.NewNRGBA(noOffsetThumbnailRec)
+	if seed := opts.DitherSeed; seed != nil && seed.Bounds().Size() != smallfull.Bounds().Size() {
+		return nil, ChainErr(nil, fmt.Sprintf(
+			"Dither seed is %v, but must match the scaled Full image, %v",
+			seed.Bounds().Size(), smallfull.Bounds().Size()))
+	}
+
+	start = time.Now()
+	defer opts.Timings.record("mux", start)
+	// The current error row, and the rows after it that the kernel reaches.
+	errs := make([][]dithererr, 3)
+	for i := range errs {
+		errs[i] = make([]dithererr, smallfull.Bounds().Dx()+2*ditherPad)
+	}
+
+	// Every pixel is set as 16 bits, and truncated for 8 bit output.
+	var dst draw.Image
+	var set func(x, y int, c color.NRGBA64)
+	maxValue := float64(nrgbaMax)
+	if opts.BitDepth == 16 {
+		dst64 := image.NewNRGBA64(noOffsetThumbnailRec)
+		dst, set, maxValue = dst64, dst64.SetNRGBA64, nrgba64Max
+	} else {
+		dst8 := image.NewNRGBA(noOffsetThumbnailRec)
+		dst, set = dst8, func(x, y int, c color.NRGBA64) {
+			dst8.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(c.R >> 8), G: uint8(c.G >> 8), B: uint8(c.B >> 8), A: uint8(c.A >> 8)})
+		}
+	}
 
 	for srcy := 0; srcy < dst.Bounds().Max.Y; srcy++ {
 		for srcx := 0; srcx < dst.Bounds().Max.X; srcx++ {
-			dst.SetNRGBA(srcx, srcy, color.NRGBAModel.Convert(darkThumbnail.NRGBA64At(srcx, srcy)).(color.NRGBA))
+			set(srcx, srcy, darkThumbnail.NRGBA64At(srcx, srcy))
+		}
+	}
+
+	// The Thumbnail pixels of each block, as offsets from its top left corner.
+	var neighbors []image.Point
+	for y := 0; y < scaling; y++ {
+		for x := 0; x < scaling; x++ {
+			if x != cornerx*(scaling-1) || y != cornery*(scaling-1) {
+				neighbors = append(neighbors, image.Pt(x, y))
+			}
 		}
 	}
+	thumbs := make([]color.NRGBA64, len(neighbors))
+	newthumbs := make([]color.NRGBA64, len(neighbors))
 
+	encode := gammaFunc(1/target, opts.FastGamma)
+	decode := gammaFunc(target, opts.FastGamma)
 	dsty := yoffset
 	for srcy := smallfull.Bounds().Min.Y; srcy < smallfull.Bounds().Max.Y; srcy++ {
-		errcurr = errnext
-		errnext = make([]dithererr, smallfull.Bounds().Dx()+2)
-		dstx := xoffset
-		for srcx := smallfull.Bounds().Min.X; srcx < smallfull.Bounds().Max.X; srcx++ {
+		if ec := canceled(); ec != nil {
+			return nil, ec
+		}
+		if srcy > smallfull.Bounds().Min.Y {
+			nextErrorRow(errs)
+		}
+		if opts.DitherSeed != nil {
+			seedRow(opts.DitherSeed, srcy, errs[0])
+		}
+		// Serpentine scans every other row right to left, with the kernel mirrored to match.
+		startx, endx, dir := smallfull.Bounds().Min.X, smallfull.Bounds().Max.X, 1
+		if opts.Serpentine && (srcy-smallfull.Bounds().Min.Y)%2 == 1 {
+			startx, endx, dir = endx-1, startx-1, -1
+		}
+		for srcx := startx; srcx != endx; srcx += dir {
+			dstx := xoffset + (srcx-smallfull.Bounds().Min.X)*scaling
 			srcnrgba := color.NRGBA64Model.Convert(smallfull.At(srcx, srcy)).(color.NRGBA64)
-			newFullPixel := calculateFullPixel(srcx, srcnrgba, dither, errcurr, errnext)
+			if opts.Feather > 0 {
+				srcnrgba = featherPixel(srcnrgba, srcx, srcy, smallfull.Bounds(),
+					xoffset > 0, yoffset > 0, opts.Feather, scaling)
+			}
+			newFullPixel := calculateFullPixel(srcx, dir, srcnrgba, dither, kernel,
+				bayerThreshold(srcx, srcy), minPixel, maxValue, encode, decode, errs)
+
+			fullx, fully := dstx+cornerx*(scaling-1), dsty+cornery*(scaling-1)
+			thumb := darkThumbnail.NRGBA64At(fullx, fully)
+			for i, n := range neighbors {
+				thumbs[i] = darkThumbnail.NRGBA64At(dstx+n.X, dsty+n.Y)
+			}
+			if opts.FullGhosting > 0 {
+				ghost := ghostPixel(srcnrgba, darken)
+				thumb = blendPixel(thumb, ghost, opts.FullGhosting)
+				for i := range thumbs {
+					thumbs[i] = blendPixel(thumbs[i], ghost, opts.FullGhosting)
+				}
+			}
 
-			thumbeast, thumbsouth, thumbsoutheast := removeHalo(
-				color.NRGBA64Model.Convert(newFullPixel).(color.NRGBA64),
-				darkThumbnail.NRGBA64At(dstx, dsty),
-				darkThumbnail.NRGBA64At(dstx+1, dsty),
-				darkThumbnail.NRGBA64At(dstx, dsty+1),
-				darkThumbnail.NRGBA64At(dstx+1, dsty+1))
+			removeHalo(newFullPixel, thumb, thumbs, darken, maxValue, newthumbs)
 
-			dst.SetNRGBA(dstx, dsty, newFullPixel)
-			dst.SetNRGBA(dstx+1, dsty, thumbeast)
-			dst.SetNRGBA(dstx, dsty+1, thumbsouth)
-			dst.SetNRGBA(dstx+1, dsty+1, thumbsoutheast)
-			dstx += fullScaling
+			set(fullx, fully, newFullPixel)
+			for i, n := range neighbors {
+				set(dstx+n.X, dsty+n.Y, newthumbs[i])
+			}
 		}
-		dsty += fullScaling
+		dsty += scaling
 	}
 
+	if opts.PreserveAlpha {
+		restoreAlpha(dst, thumbnail, opts.AlphaThreshold)
+	}
+	if opts.Background != nil {
+		paintBackground(dst, image.Rect(xoffset, yoffset,
+			xoffset+smallfull.Bounds().Dx()*scaling, yoffset+smallfull.Bounds().Dy()*scaling),
+			opts.Background, target, maxValue)
+	}
 	return dst, nil
 }
 
-// Do averaging using the arithmetic mean, since that's what the decoder will (wrongly) do.
-func removeHalo(full, thumb, thumbeast, thumbsouth, thumbsoutheast color.NRGBA64) (
-	newthumbeast, newthumbsouth, newthumbsoutheast color.NRGBA) {
-	clampround := func(val float64) uint8 {
-		v := math.Round(val) / 256
-		if v > thumbnailDarkenFactor*nrgbaMax {
-			return uint8(thumbnailDarkenFactor * nrgbaMax)
-		} else if v < 0 {
-			return 0
+// Gives each pixel of dst the alpha of the same pixel of src, after alphaThreshold.  Fully
+// transparent pixels are made transparent black, which compresses best.  Pixels of src past the
+// edges of dst are skipped.
+func restoreAlpha(dst draw.Image, src image.Image, alphaThreshold uint8) {
+	// Only the alpha is replaced, since setting a whole color would premultiply it.
+	setAlpha := func(x, y int, a uint16) {
+		switch dst := dst.(type) {
+		case *image.NRGBA:
+			dst.Pix[dst.PixOffset(x, y)+3] = uint8(a >> 8)
+		case *image.NRGBA64:
+			i := dst.PixOffset(x, y) + 6
+			dst.Pix[i], dst.Pix[i+1] = uint8(a>>8), uint8(a)
 		}
-		return uint8(v)
 	}
+	at := nrgba64Reader(src)
+	b := src.Bounds()
+	w, h := min(b.Dx(), dst.Bounds().Dx()), min(b.Dy(), dst.Bounds().Dy())
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			a := at(b.Min.X+x, b.Min.Y+y).A
+			if alphaThreshold != 0 {
+				if a < uint16(alphaThreshold)*0x101 {
+					a = 0
+				} else {
+					a = nrgba64Max
+				}
+			}
+			if a == 0 {
+				dst.Set(x, y, color.Transparent)
+				continue
+			}
+			setAlpha(x, y, a)
+		}
+	}
+}
 
-	var (
-		rdenom  = float64(thumbeast.R) + float64(thumbsouth.R) + float64(thumbsoutheast.R)
-		rfactor = (rdenom + float64(thumb.R) - float64(full.R)) / rdenom
+// Fades a linear Full pixel toward black within feather output pixels of the edges of the Full
+// image that border the letterbox, so they don't end abruptly.
+func featherPixel(linear color.NRGBA64, x, y int, bounds image.Rectangle, sides, ends bool,
+	feather, scaling int) color.NRGBA64 {
+	dist := math.MaxInt32
+	closer := func(d int) {
+		if d < dist {
+			dist = d
+		}
+	}
+	if sides {
+		closer(x - bounds.Min.X)
+		closer(bounds.Max.X - 1 - x)
+	}
+	if ends {
+		closer(y - bounds.Min.Y)
+		closer(bounds.Max.Y - 1 - y)
+	}
+	weight := (float64(dist) + 0.5) * float64(scaling) / float64(feather)
+	if weight >= 1 {
+		return linear
+	}
+	linear.R = uint16(float64(linear.R) * weight)
+	linear.G = uint16(float64(linear.G) * weight)
+	linear.B = uint16(float64(linear.B) * weight)
+	return linear
+}
 
-		gdenom  = float64(thumbeast.G) + float64(thumbsouth.G) + float64(thumbsoutheast.G)
-		gfactor = (gdenom + float64(thumb.G) - float64(full.G)) / gdenom
+// Converts a linear Full pixel into a Thumbnail pixel.  It is darkened just like the Thumbnail,
+// so it stays hidden after the gamma transform.
+func ghostPixel(linear color.NRGBA64, darken float64) color.NRGBA64 {
+	encode := func(v uint16) uint16 {
+		return uint16(nrgba64Max * math.Pow(float64(v)/nrgba64Max, 1/sourceGamma) * darken)
+	}
+	return color.NRGBA64{
+		R: encode(linear.R),
+		G: encode(linear.G),
+		B: encode(linear.B),
+		A: linear.A,
+	}
+}
 
-		bdenom  = float64(thumbeast.B) + float64(thumbsouth.B) + float64(thumbsoutheast.B)
-		bfactor = (bdenom + float64(thumb.B) - float64(full.B)) / bdenom
-	)
+// Mixes amount of b into a.
+func blendPixel(a, b color.NRGBA64, amount float64) color.NRGBA64 {
+	mix := func(x, y uint16) uint16 {
+		return uint16(math.Round(float64(x)*(1-amount) + float64(y)*amount))
+	}
+	return color.NRGBA64{
+		R: mix(a.R, b.R),
+		G: mix(a.G, b.G),
+		B: mix(a.B, b.B),
+		A: mix(a.A, b.A),
+	}
+}
+
+// Adds row y of seed to the error row.  Mid gray adds nothing, while black and white shift the
+// pixel by up to one step down or up.
+func seedRow(seed image.Image, y int, errrow []dithererr) {
+	min := seed.Bounds().Min
+	for x := 0; x < seed.Bounds().Dx(); x++ {
+		px := color.NRGBA64Model.Convert(seed.At(min.X+x, min.Y+y)).(color.NRGBA64)
+		errrow[x+ditherPad].r += (float64(px.R)/nrgba64Max - 0.5) * 2 / nrgbaMax
+		errrow[x+ditherPad].g += (float64(px.G)/nrgba64Max - 0.5) * 2 / nrgbaMax
+		errrow[x+ditherPad].b += (float64(px.B)/nrgba64Max - 0.5) * 2 / nrgbaMax
+	}
+}
 
-	newthumbeast = color.NRGBA{
-		R: clampround(float64(thumbeast.R) * rfactor),
-		G: clampround(float64(thumbeast.G) * gfactor),
-		B: clampround(float64(thumbeast.B) * bfactor),
-		A: uint8(thumbeast.A >> 8),
+// Mux against a half size Thumbnail, and then blow each pixel up into a 2x2 block.  A platform
+// that box filters the result by 2x gets back the plain lattice, rather than a blend of it.  Odd
+// Thumbnail dimensions lose their last row or column.
+func robustGammaMuxImages(thumbnail, full image.Image, opts Options) (image.Image, *ErrChain) {
+	const blockSize = 2
+	noOffsetThumbnailRec := image.Rectangle{
+		Max: image.Point{
+			X: thumbnail.Bounds().Dx(),
+			Y: thumbnail.Bounds().Dy(),
+		},
 	}
-	newthumbsouth = color.NRGBA{
-		R: clampround(float64(thumbsouth.R) * rfactor),
-		G: clampround(float64(thumbsouth.G) * gfactor),
-		B: clampround(float64(thumbsouth.B) * bfactor),
-		A: uint8(thumbsouth.A >> 8),
+	// The Thumbnail is flattened here, so the mux below never sees its alpha to warn about.
+	premultiplied := opts.AlphaMode == "premultiplied"
+	if warning := alphaModeWarning(thumbnail, premultiplied); warning != "" {
+		if ec := opts.warn("The thumbnail image " + warning); ec != nil {
+			return nil, ec
+		}
 	}
-	newthumbsoutheast = color.NRGBA{
-		R: clampround(float64(thumbsoutheast.R) * rfactor),
-		G: clampround(float64(thumbsoutheast.G) * gfactor),
-		B: clampround(float64(thumbsoutheast.B) * bfactor),
-		A: uint8(thumbsoutheast.A >> 8),
+	ctx := opts.context()
+	linearthumbnail := linearImage(ctx, removeAlpha(ctx, thumbnail, opts.AlphaThreshold,
+		premultiplied, opts.Precision), sourceGamma, opts.Precision)
+	smallthumbnail, _, _ := resize(linearthumbnail, noOffsetThumbnailRec, blockSize, 1, false,
+		image.Pt(1, 1), opts.scaler(), opts.Precision)
+
+	opts.RobustLattice = false
+	small, ec := GammaMuxImagesOpts(
+		linearImage(ctx, smallthumbnail, 1/sourceGamma, opts.Precision), full, opts)
+	if ec != nil {
+		return nil, ec
 	}
 
-	return newthumbeast, newthumbsouth, newthumbsoutheast
+	dstRect := image.Rectangle{
+		Max: image.Point{
+			X: small.Bounds().Dx() * blockSize,
+			Y: small.Bounds().Dy() * blockSize,
+		},
+	}
+	var dst draw.Image = image.NewNRGBA(dstRect)
+	if opts.BitDepth == 16 {
+		dst = image.NewNRGBA64(dstRect)
+	}
+	draw.NearestNeighbor.Scale(dst, dst.Bounds(), small, small.Bounds(), draw.Src, nil)
+	if opts.PreserveAlpha {
+		restoreAlpha(dst, thumbnail, opts.AlphaThreshold)
+	}
+	if l := opts.Layout; l != nil {
+		l.record(image.Rectangle{
+			Min: l.FullBounds.Min.Mul(blockSize),
+			Max: l.FullBounds.Max.Mul(blockSize),
+		}, l.OffsetX*blockSize, l.OffsetY*blockSize)
+	}
+	return dst, nil
 }
 
+// Do averaging using the arithmetic mean, since that's what the decoder will (wrongly) do.  The
+// light the Full pixel takes from, or adds to, thumb is made up by the other Thumbnail pixels of
+// the block, thumbs, in proportion to their own light.  The results are written to newthumbs,
+// truncated to maxValue steps.
+func removeHalo(full, thumb color.NRGBA64, thumbs []color.NRGBA64, darken, maxValue float64,
+	newthumbs []color.NRGBA64) {
+	clampround := func(val float64) uint16 {
+		v := math.Round(val) / ((nrgba64Max + 1) / (maxValue + 1))
+		if v > darken*maxValue {
+			v = darken * maxValue
+		} else if v < 0 {
+			v = 0
+		}
+		return uint16(math.Trunc(v) * nrgba64Max / maxValue)
+	}
+
+	var rdenom, gdenom, bdenom float64
+	for _, t := range thumbs {
+		rdenom += float64(t.R)
+		gdenom += float64(t.G)
+		bdenom += float64(t.B)
+	}
+	// Black Thumbnail pixels have no light to scale, so they are left as is, rather than turned
+	// into NaN.
+	factor := func(denom float64, thumb, full uint16) float64 {
+		if denom == 0 {
+			return 1
+		}
+		return (denom + float64(thumb) - float64(full)) / denom
+	}
+	var (
+		rfactor = factor(rdenom, thumb.R, full.R)
+		gfactor = factor(gdenom, thumb.G, full.G)
+		bfactor = factor(bdenom, thumb.B, full.B)
+	)
+
+	for i, t := range thumbs {
+		newthumbs[i] = color.NRGBA64{
+			R: clampround(float64(t.R) * rfactor),
+			G: clampround(float64(t.G) * gfactor),
+			B: clampround(float64(t.B) * bfactor),
+			A: t.A,
+		}
+	}
+}
+
+// Returns a grayscale copy of im, or nil if any pixel has color or transparency.
+func grayImage(im *image.NRGBA) *image.Gray {
+	dst := image.NewGray(im.Bounds())
+	for y := im.Bounds().Min.Y; y < im.Bounds().Max.Y; y++ {
+		for x := im.Bounds().Min.X; x < im.Bounds().Max.X; x++ {
+			px := im.NRGBAAt(x, y)
+			if px.R != px.G || px.G != px.B || px.A != nrgbaMax {
+				return nil
+			}
+			dst.SetGray(x, y, color.Gray{Y: px.R})
+		}
+	}
+	return dst
+}
+
+// GammaMuxData is GammaMuxDataOpts with only Dither and Stretch set.  New callers should use
+// GammaMuxDataOpts.
 func GammaMuxData(thumbnail, full io.Reader, dest io.Writer, dither, stretch bool) *ErrChain {
+	return GammaMuxDataOpts(thumbnail, full, dest, Options{
+		Dither:  dither,
+		Stretch: stretch,
+	})
+}
+
+// Returns a paletted copy of im, or nil if it has more than 256 colors.  No colors are merged,
+// since that would upset the balance between neighboring pixels.
+func palettedImage(im *image.NRGBA) *image.Paletted {
+	indexes := make(map[color.NRGBA]uint8)
+	var palette color.Palette
+	dst := image.NewPaletted(im.Bounds(), nil)
+	for y := im.Bounds().Min.Y; y < im.Bounds().Max.Y; y++ {
+		for x := im.Bounds().Min.X; x < im.Bounds().Max.X; x++ {
+			px := im.NRGBAAt(x, y)
+			index, ok := indexes[px]
+			if !ok {
+				if len(palette) == 256 {
+					return nil
+				}
+				index = uint8(len(palette))
+				indexes[px] = index
+				palette = append(palette, px)
+			}
+			dst.SetColorIndex(x, y, index)
+		}
+	}
+	dst.Palette = palette
+	return dst
+}
+
+// GammaMuxDataContext is GammaMuxDataOpts, but stops early once ctx is done.  Decoding and
+// resampling can't be interrupted, so it is checked between them and between rows of the rest.
+func GammaMuxDataContext(ctx context.Context, thumbnail, full io.Reader, dest io.Writer,
+	opts Options) *ErrChain {
+	opts.ctx = ctx
+	return GammaMuxDataOpts(thumbnail, full, dest, opts)
+}
+
+func GammaMuxDataOpts(thumbnail, full io.Reader, dest io.Writer, opts Options) *ErrChain {
+	if opts.AnimateThumbnail {
+		return gammuxAnimatedData(thumbnail, full, dest, opts)
+	}
 	// sadly, Go's own decoder does not handle Gamma properly.  This program shares shame
 	// with all the other non-compliant renderers.
-	tim, _, err := image.Decode(thumbnail)
+	start := time.Now()
+	tim, err := decodeImage(thumbnail, opts)
 	if err != nil {
-		return ChainErr(err, "Unable to decode thumbnail")
+		return decodeErr(err, "thumbnail")
 	}
-	fim, _, err := image.Decode(full)
+	fdata, err := io.ReadAll(full)
+	if err != nil {
+		return ChainErr(err, "Unable to read full")
+	}
+	if opts.SourceGamma == 0 {
+		opts.SourceGamma = declaredGamma(fdata)
+	}
+	var fim image.Image
+	if opts.FullFrame != 0 && bytes.HasPrefix(fdata, []byte("GIF8")) {
+		var ec *ErrChain
+		if fim, ec = decodeGIFFrame(fdata, opts.FullFrame, opts); ec != nil {
+			return decodeErr(ec, "full")
+		}
+	} else if fim, err = decodeImage(bytes.NewReader(fdata), opts); err != nil {
+		return decodeErr(err, "full")
+	}
+	opts.Timings.record("decode", start)
+
+	return GammaMuxImagesData(tim, fim, dest, opts)
+}
+
+// Decodes r, giving up after MaxDecodeTime of opts if it is positive.
+func decodeImage(r io.Reader, opts Options) (image.Image, error) {
+	var im image.Image
+	err := decodeWithin(opts.MaxDecodeTime, func() (err error) {
+		im, err = decodeFirstFrame(r, opts.MaxPixels)
+		return err
+	})
 	if err != nil {
-		return ChainErr(err, "Unable to decode full")
+		return nil, err
+	}
+	return im, nil
+}
+
+// Runs decode, giving up after timeout if it is positive.  Decoding can't be interrupted, so a
+// slow decode keeps running in the background until it finishes, but the caller can move on.
+// Whatever decode sets may only be read once it has returned.
+func decodeWithin(timeout time.Duration, decode func() error) error {
+	if timeout <= 0 {
+		return decode()
+	}
+	// Buffered, so the decoding goroutine can exit even if nobody is waiting.
+	res := make(chan error, 1)
+	go func() {
+		res <- decode()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-res:
+		return err
+	case <-timer.C:
+		return ChainErr(nil, fmt.Sprintf("Decoding took longer than %v", timeout))
 	}
+}
 
-	dim, ec := GammaMuxImages(tim, fim, dither, stretch)
+// Decodes r, or the first frame of r if it is an animated WebP image.  Unless maxPixels is 0,
+// images with more pixels than it are an error before they are decoded.
+func decodeFirstFrame(r io.Reader, maxPixels int) (image.Image, error) {
+	br := bufio.NewReader(r)
+	if header, _ := br.Peek(30); isAnimatedWebP(header) {
+		if len(header) == 30 {
+			// The canvas size of the VP8X chunk, which every frame fits in.
+			w, h := int(get24(header[24:]))+1, int(get24(header[27:]))+1
+			if err := checkPixels(w, h, maxPixels); err != nil {
+				return nil, err
+			}
+		}
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		return decodeWebPFirstFrame(data)
+	}
+	var in io.Reader = br
+	if maxPixels > 0 {
+		// Keep what DecodeConfig reads of the header, to decode it again with the rest.
+		var header bytes.Buffer
+		config, _, err := image.DecodeConfig(io.TeeReader(br, &header))
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPixels(config.Width, config.Height, maxPixels); err != nil {
+			return nil, err
+		}
+		in = io.MultiReader(&header, br)
+	}
+	im, _, err := image.Decode(in)
+	return im, err
+}
+
+// Fails if data is an image with more pixels than maxPixels, going by its header.  Data that
+// isn't an image passes, and is left for decoding to reject.
+func checkDataPixels(data []byte, maxPixels int) error {
+	if maxPixels <= 0 {
+		return nil
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	return checkPixels(config.Width, config.Height, maxPixels)
+}
+
+// Fails if a w by h image has more than maxPixels pixels, unless maxPixels is 0.
+func checkPixels(w, h, maxPixels int) error {
+	if maxPixels > 0 && int64(w)*int64(h) > int64(maxPixels) {
+		return ChainErr(nil, fmt.Sprintf(
+			"Image is %dx%d, more than the limit of %d pixels", w, h, maxPixels))
+	}
+	return nil
+}
+
+// Muxes already decoded images, and writes the result as a PNG.
+func GammaMuxImagesData(thumbnail, full image.Image, dest io.Writer, opts Options) *ErrChain {
+	if opts.MaxFileSize > 0 {
+		return fitMuxed(thumbnail, full, dest, opts)
+	}
+	dim, ec := GammaMuxImagesOpts(thumbnail, full, opts)
 	if ec != nil {
 		return ec
 	}
+	return encodeMuxed(dim, dest, opts)
+}
 
-	var buf bytes.Buffer
-	if err := png.Encode(&buf, dim); err != nil {
-		return ChainErr(err, "Unable to encode dest PNG")
+// Writes an already muxed image as a PNG, adding the gAMA chunk.  The output is never interlaced,
+// even if the inputs were; by the time they are decoded, interlacing makes no difference.
+func encodeMuxed(muxed image.Image, dest io.Writer, opts Options) *ErrChain {
+	dim := muxed
+	if opts.BitDepth == 16 &&
+		((opts.Format != "" && opts.Format != "png") || opts.ColorType != "" || opts.PrintDPI > 0) {
+		return ChainErr(nil, "16 bit output can only be written as a plain PNG")
+	}
+	if opts.PostProcess != nil {
+		if dim = opts.PostProcess(muxed); dim == nil {
+			return ChainErr(nil, "Post processing returned no image")
+		}
+	}
+	switch opts.Format {
+	case "", "png":
+	case "webp":
+		start := time.Now()
+		defer opts.Timings.record("encode", start)
+		return writeWebP(dest, dim, opts.targetGamma())
+	default:
+		return ChainErr(nil, "Unknown format "+opts.Format+", must be png or webp")
+	}
+	if opts.PrintDPI < 0 {
+		return ChainErr(nil, fmt.Sprintf("Print DPI %d must not be negative", opts.PrintDPI))
+	}
+	if opts.PrintDPI > 0 {
+		dim = upscaleNearest(dim, printScale(opts.PrintDPI))
+	}
+	var encode func(io.Writer, image.Image) error
+	if opts.ColorType != "" {
+		var ec *ErrChain
+		if dim, encode, ec = forceColorType(
+			dim, opts.ColorType, opts.AutoPalette, opts.CompressionLevel); ec != nil {
+			return ec
+		}
+	}
+	if nrgba, ok := dim.(*image.NRGBA); ok && opts.AutoGray && opts.ColorType == "" {
+		// Both the halo removal and dithering treat each channel the same, so gray inputs
+		// produce gray output.
+		if gray := grayImage(nrgba); gray != nil {
+			dim = gray
+		}
+	}
+	if nrgba, ok := dim.(*image.NRGBA); ok && opts.AutoPalette && opts.ColorType == "" {
+		if paletted := palettedImage(nrgba); paletted != nil {
+			dim = paletted
+		}
+	}
+
+	if encode == nil {
+		encode = opts.Encode
+	}
+	if encode == nil {
+		encoder := png.Encoder{CompressionLevel: opts.CompressionLevel}
+		encode = encoder.Encode
 	}
 
-	headerIndex := bytes.Index(buf.Bytes(), []byte{0, 0, 0, 13, 'I', 'H', 'D', 'R'})
-	if headerIndex <= 0 {
-		return ChainErr(nil, "PNG missing header")
+	start := time.Now()
+	if opts.Verify {
+		// The whole PNG is needed to verify it before any of it is written.
+		var buf bytes.Buffer
+		if err := encode(&buf, dim); err != nil {
+			return ChainErr(err, "Unable to encode dest PNG")
+		}
+		opts.Timings.record("encode", start)
+		start = time.Now()
+		defer opts.Timings.record("splice", start)
+		var spliced bytes.Buffer
+		if ec := spliceGamma(&spliced, &buf, dim, opts); ec != nil {
+			return ec
+		}
+		if ec := verifyPNG(spliced.Bytes(), dim.Bounds().Size(), opts.targetGamma()); ec != nil {
+			return ChainErr(ec, "Output failed verification")
+		}
+		if _, err := dest.Write(spliced.Bytes()); err != nil {
+			return ChainErr(err, "Unable to write dest PNG")
+		}
+		return nil
 	}
-	headerIndexEnd := headerIndex + 13 + 4 + 4 + 4
 
-	if _, err := dest.Write(buf.Bytes()[:headerIndexEnd]); err != nil {
-		return ChainErr(err, "Unable to write PNG header")
+	// Splice the chunks as the encoder writes them, rather than holding the whole PNG.  Encoding
+	// and splicing happen together, so both are timed as encode.
+	defer opts.Timings.record("encode", start)
+	pr, pw := io.Pipe()
+	encoded := make(chan error, 1)
+	go func() {
+		err := encode(pw, dim)
+		pw.CloseWithError(err)
+		encoded <- err
+	}()
+	ec := spliceGamma(dest, pr, dim, opts)
+	// Unblock the encoder if splicing stopped early.
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err := <-encoded; err != nil && err != io.ErrClosedPipe {
+		return ChainErr(err, "Unable to encode dest PNG")
 	}
-	if ec := writeGamaPngChunk(dest, targetGamma); ec != nil {
+	return ec
+}
+
+// Copies the encoded PNG of dim in src to dest, adding the chunks declaring its gamma.
+func spliceGamma(dest io.Writer, src io.Reader, dim image.Image, opts Options) *ErrChain {
+	return spliceAfterHeader(dest, src, nil, func(w io.Writer) *ErrChain {
+		if ec := writeGamaPngChunk(w, opts.targetGamma()); ec != nil {
+			return ec
+		}
+		if opts.PrintDPI > 0 {
+			if ec := writePhysPngChunk(w, opts.PrintDPI); ec != nil {
+				return ec
+			}
+		}
+		if opts.EmbedICC {
+			_, gray := dim.(*image.Gray)
+			if ec := writeIccpPngChunk(w, opts.targetGamma(), gray); ec != nil {
+				return ec
+			}
+		}
+		return writeTextPngChunks(w, opts.Text)
+	})
+}
+
+// Checks that data decodes as a PNG of the given size, declaring gamma.
+func verifyPNG(data []byte, size image.Point, gamma float64) *ErrChain {
+	info, ec := ReadPNGInfo(bytes.NewReader(data))
+	if ec != nil {
 		return ec
 	}
-	if _, err := dest.Write(buf.Bytes()[headerIndexEnd:]); err != nil {
-		return ChainErr(err, "Unable to write PNG header")
+	if !info.HasGamma || info.GamaValue != GamaChunkValue(gamma) {
+		return ChainErr(nil, "PNG doesn't declare the target gamma")
 	}
+	im, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ChainErr(err, "Unable to decode PNG")
+	}
+	if got := im.Bounds().Size(); got != size {
+		return ChainErr(nil, fmt.Sprintf("PNG is %v, but should be %v", got, size))
+	}
+	return nil
+}
 
+// Writes the Full image as a plain JPEG, for sharing where viewers may not honor the gAMA chunk.
+func GammaFallbackData(full io.Reader, dest io.Writer) *ErrChain {
+	fim, _, err := image.Decode(full)
+	if err != nil {
+		return decodeErr(err, "full")
+	}
+	opaque := removeAlpha(context.Background(), fim, 0, false, 16)
+	if err := jpeg.Encode(dest, opaque, &jpeg.Options{Quality: 90}); err != nil {
+		return ChainErr(err, "Unable to encode fallback JPEG")
+	}
 	return nil
 }
 
+// GamaChunkValue returns the value of a PNG gAMA chunk declaring gamma, which is 100000/gamma
+// rounded to a positive 31 bit integer.  It returns 0 if gamma can't be stored.
+func GamaChunkValue(gamma float64) uint32 {
+	if math.IsNaN(gamma) || math.IsInf(gamma, 0) || gamma <= 0 {
+		return 0
+	}
+	if v := math.Round(100000 / gamma); v <= maxPngChunkLength {
+		return uint32(v)
+	}
+	return 0
+}
+
+// CheckGamma returns an error if gamma can't be declared in a PNG gAMA chunk.
+func CheckGamma(gamma float64) *ErrChain {
+	if math.IsNaN(gamma) || math.IsInf(gamma, 0) || gamma <= 0 {
+		return ChainErr(nil, fmt.Sprintf("Gamma %v must be a positive number", gamma))
+	}
+	if GamaChunkValue(gamma) == 0 {
+		return ChainErr(nil, fmt.Sprintf("Gamma %v is too extreme to store in a PNG", gamma))
+	}
+	return nil
+}
+
+// WarnGamma returns a warning if target is too close to source for the Full image to show
+// clearly, or "" if it is fine.
+func WarnGamma(target, source float64) string {
+	if target < source*2 {
+		return fmt.Sprintf(
+			"Gamma %v is not much more than %v, so the Full image may not show", target, source)
+	}
+	return ""
+}
+
 func writeGamaPngChunk(w io.Writer, gamma float64) *ErrChain {
-	gamaBuf := make([]byte, 4+4+4+4)
-	copy(gamaBuf, []byte{0, 0, 0, 4, 'g', 'A', 'M', 'A'})
-	binary.BigEndian.PutUint32(gamaBuf[8:12], uint32(math.Round(100000/gamma)))
-	crc := crc32.NewIEEE()
-	crc.Write(gamaBuf[4:12])
-	binary.BigEndian.PutUint32(gamaBuf[12:16], crc.Sum32())
-	if _, err := w.Write(gamaBuf); err != nil {
+	if ec := CheckGamma(gamma); ec != nil {
+		return ec
+	}
+	gamaData := make([]byte, 4)
+	binary.BigEndian.PutUint32(gamaData, GamaChunkValue(gamma))
+	if err := writePngChunk(w, "gAMA", gamaData); err != nil {
 		return ChainErr(err, "Unable to write PNG gAMA chunk")
 	}
 	return nil
@@ -0,0 +1,529 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+type jsonErrChain struct {
+	Message string        `json:"message"`
+	Cause   *jsonErrChain `json:"cause"`
+}
+
+func TestErrChainMarshalJSON(t *testing.T) {
+	ec := ChainErr(ChainErr(io.EOF, "Unable to read"), "Unable to decode")
+	data, err := json.Marshal(ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got jsonErrChain
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := jsonErrChain{
+		Message: "Unable to decode",
+		Cause: &jsonErrChain{
+			Message: "Unable to read",
+			Cause:   &jsonErrChain{Message: io.EOF.Error()},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s, want %+v", data, want)
+	}
+}
+
+func TestErrChainNilCause(t *testing.T) {
+	var none *ErrChain
+	ec := ChainErr(none, "Unable to mux")
+	data, err := json.Marshal(ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), `{"message":"Unable to mux"}`; got != want {
+		t.Errorf("MarshalJSON() = %s, want %s", got, want)
+	}
+	if got, want := ec.Error(), "Unable to mux"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	if ec.Unwrap() != nil {
+		t.Errorf("Unwrap() = %v, want nil", ec.Unwrap())
+	}
+	if errors.Is(none, io.EOF) {
+		t.Error("nil ErrChain is io.EOF")
+	}
+}
+
+func TestErrChainUnwrap(t *testing.T) {
+	ec := ChainErr(decodeErr(io.ErrUnexpectedEOF, "full"), "Unable to mux")
+	if !errors.Is(ec, io.ErrUnexpectedEOF) {
+		t.Error("chain is not io.ErrUnexpectedEOF")
+	}
+	var de *DecodeError
+	if !errors.As(ec, &de) || de.Which != "full" {
+		t.Errorf("errors.As() = %v, want the full DecodeError", de)
+	}
+}
+
+// Returns an 8x8 image with every pixel c.
+func uniformNRGBA(c color.NRGBA) *image.NRGBA {
+	im := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for i := 0; i < len(im.Pix); i += 4 {
+		im.Pix[i], im.Pix[i+1], im.Pix[i+2], im.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return im
+}
+
+func TestAlphaModeWarning(t *testing.T) {
+	tests := []struct {
+		name                  string
+		im                    image.Image
+		straight, premultiply bool
+	}{
+		{"opaque", uniformNRGBA(color.NRGBA{200, 100, 50, 0xFF}), false, false},
+		// White edges, as antialiased straight images have, are brighter than their alpha.
+		{"straight", uniformNRGBA(color.NRGBA{0xFF, 0xFF, 0xFF, 0x80}), false, true},
+		// Straight, but dark, so never brighter than alpha.  That alone isn't enough to warn.
+		{"dark straight", uniformNRGBA(color.NRGBA{10, 20, 30, 0x80}), false, false},
+		{"premultiplied", uniformNRGBA(color.NRGBA{0x78, 0x80, 0x70, 0x80}), true, false},
+		{"few translucent", func() image.Image {
+			im := uniformNRGBA(color.NRGBA{0, 0, 0, 0xFF})
+			im.SetNRGBA(0, 0, color.NRGBA{0x80, 0x80, 0x80, 0x80})
+			return im
+		}(), false, false},
+	}
+	for _, tt := range tests {
+		if got := alphaModeWarning(tt.im, false); (got != "") != tt.straight {
+			t.Errorf("%s as straight: warning %q, want warning %v", tt.name, got, tt.straight)
+		}
+		if got := alphaModeWarning(tt.im, true); (got != "") != tt.premultiply {
+			t.Errorf("%s as premultiplied: warning %q, want warning %v",
+				tt.name, got, tt.premultiply)
+		}
+	}
+}
+
+func TestRemovePixelAlpha(t *testing.T) {
+	half := uint16(0x8000)
+	tests := []struct {
+		name          string
+		px            color.NRGBA64
+		premultiplied bool
+		threshold     uint8
+		want          color.NRGBA64
+	}{
+		{"opaque", color.NRGBA64{0x1234, 0x5678, 0x9ABC, 0xFFFF}, false, 0,
+			color.NRGBA64{0x1234, 0x5678, 0x9ABC, 0xFFFF}},
+		{"transparent", color.NRGBA64{0x1234, 0x5678, 0x9ABC, 0}, false, 0,
+			color.NRGBA64{0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF}},
+		// Black at half alpha over white is half gray, either way it's stored.
+		{"straight", color.NRGBA64{0, 0, 0, half}, false, 0,
+			color.NRGBA64{0x7FFF, 0x7FFF, 0x7FFF, 0xFFFF}},
+		{"premultiplied", color.NRGBA64{0, 0, 0, half}, true, 0,
+			color.NRGBA64{0x7FFF, 0x7FFF, 0x7FFF, 0xFFFF}},
+		// Premultiplied white at half alpha is stored as half, and stays white.
+		{"premultiplied white", color.NRGBA64{half, half, half, half}, true, 0,
+			color.NRGBA64{0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF}},
+		// A threshold of 0x80 is an alpha of 0x8080.  Below it is transparent, and the rest opaque.
+		{"straight below threshold", color.NRGBA64{0x4040, 0x4040, 0x4040, 0x807F}, false, 0x80,
+			color.NRGBA64{0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF}},
+		{"straight at threshold", color.NRGBA64{0x4040, 0x4040, 0x4040, 0x8080}, false, 0x80,
+			color.NRGBA64{0x4040, 0x4040, 0x4040, 0xFFFF}},
+		{"straight above threshold", color.NRGBA64{0x4040, 0x4040, 0x4040, 0x8081}, false, 0x80,
+			color.NRGBA64{0x4040, 0x4040, 0x4040, 0xFFFF}},
+		// Premultiplied colors are divided by their alpha before it is rounded to opaque.
+		{"premultiplied below threshold", color.NRGBA64{0x4040, 0x4040, 0x4040, 0x807F}, true,
+			0x80, color.NRGBA64{0xFFFF, 0xFFFF, 0xFFFF, 0xFFFF}},
+		{"premultiplied at threshold", color.NRGBA64{0x4040, 0x4040, 0x4040, 0x8080}, true, 0x80,
+			color.NRGBA64{0x7FFF, 0x7FFF, 0x7FFF, 0xFFFF}},
+		{"premultiplied above threshold", color.NRGBA64{0x4040, 0x4040, 0x4040, 0x8081}, true,
+			0x80, color.NRGBA64{0x7FFF, 0x7FFF, 0x7FFF, 0xFFFF}},
+	}
+	// Compositing rounds, so allow being off by one.
+	near := func(a, b uint16) bool {
+		d := int(a) - int(b)
+		return d >= -1 && d <= 1
+	}
+	for _, tt := range tests {
+		got := removePixelAlpha(tt.px, tt.threshold, tt.premultiplied)
+		if !near(got.R, tt.want.R) || !near(got.G, tt.want.G) || !near(got.B, tt.want.B) ||
+			got.A != tt.want.A {
+			t.Errorf("%s: removePixelAlpha(%v) = %v, want %v", tt.name, tt.px, got, tt.want)
+		}
+	}
+}
+
+// The 8x4 Thumbnail is 4x2 blocks, which the square Full image fills from the middle 2x2 to all.
+func TestStretchAmount(t *testing.T) {
+	thumbnail := uniformNRGBA(color.NRGBA{0x80, 0x80, 0x80, 0xFF})
+	thumbnail = thumbnail.SubImage(image.Rect(0, 0, 8, 4)).(*image.NRGBA)
+	full := uniformNRGBA(color.NRGBA{0xFF, 0xFF, 0xFF, 0xFF})
+	tests := []struct {
+		stretch float64
+		want    image.Rectangle
+	}{
+		{0, image.Rect(2, 0, 6, 4)},
+		{0.5, image.Rect(1, 0, 7, 4)},
+		{1, image.Rect(0, 0, 8, 4)},
+	}
+	for _, tt := range tests {
+		var layout Layout
+		opts := Options{StretchAmount: tt.stretch, Layout: &layout}
+		if _, ec := GammaMuxImagesOpts(thumbnail, full, opts); ec != nil {
+			t.Fatal(ec)
+		}
+		if layout.FullBounds != tt.want {
+			t.Errorf("stretch %v: Full bounds %v, want %v", tt.stretch, layout.FullBounds, tt.want)
+		}
+	}
+}
+
+// Returns the offset of the first chunkType chunk in the PNG data, or -1.
+func chunkOffset(data []byte, chunkType string) int {
+	for off := 8; off+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[off:]))
+		if string(data[off+4:off+8]) == chunkType {
+			return off
+		}
+		off += 4 + 4 + length + 4
+	}
+	return -1
+}
+
+func TestVerifyPNG(t *testing.T) {
+	thumbnail := uniformNRGBA(color.NRGBA{0x80, 0x80, 0x80, 0xFF})
+	full := uniformNRGBA(color.NRGBA{0xFF, 0xFF, 0xFF, 0xFF})
+	var buf bytes.Buffer
+	if ec := GammaMuxImagesData(thumbnail, full, &buf, Options{Verify: true}); ec != nil {
+		t.Fatal(ec)
+	}
+	good := buf.Bytes()
+	size := image.Pt(8, 8)
+	if ec := verifyPNG(good, size, DefaultTargetGamma); ec != nil {
+		t.Fatal(ec)
+	}
+
+	gama, idat := chunkOffset(good, "gAMA"), chunkOffset(good, "IDAT")
+	if gama < 0 || idat < 0 {
+		t.Fatalf("gAMA at %d, IDAT at %d", gama, idat)
+	}
+	corrupt := func(off int) []byte {
+		bad := append([]byte(nil), good...)
+		bad[off] ^= 0x40
+		return bad
+	}
+	tests := []struct {
+		name  string
+		data  []byte
+		size  image.Point
+		gamma float64
+	}{
+		{"gAMA value", corrupt(gama + 8 + 3), size, DefaultTargetGamma},
+		{"gAMA type", corrupt(gama + 4), size, DefaultTargetGamma},
+		{"IDAT data", corrupt(idat + 8 + 4), size, DefaultTargetGamma},
+		{"truncated", good[:idat+10], size, DefaultTargetGamma},
+		{"no gAMA", append(good[:gama:gama], good[gama+4+4+4+4:]...), size, DefaultTargetGamma},
+		{"wrong gamma", good, size, DefaultTargetGamma / 2},
+		{"wrong size", good, image.Pt(8, 4), DefaultTargetGamma},
+	}
+	for _, tt := range tests {
+		if ec := verifyPNG(tt.data, tt.size, tt.gamma); ec == nil {
+			t.Errorf("%s: verified", tt.name)
+		}
+	}
+}
+
+// Reports the bytes allocated by muxing at each precision, which is mostly the intermediate
+// images.  Run with -benchmem.
+func BenchmarkMuxPrecision(b *testing.B) {
+	thumbnail, full := testPattern(512, 512), testPattern(256, 256)
+	for _, precision := range []int{8, 16} {
+		b.Run(strconv.Itoa(precision), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, ec := GammaMuxImagesOpts(thumbnail, full, Options{
+					Dither:    true,
+					Precision: precision,
+				})
+				if ec != nil {
+					b.Fatal(ec)
+				}
+			}
+		})
+	}
+}
+
+func TestGamaChunkValue(t *testing.T) {
+	tests := []struct {
+		gamma float64
+		want  uint32
+	}{
+		{DefaultSourceGamma, 45455},
+		{DefaultTargetGamma, 2273},
+		{1, 100000},
+		{1 / DefaultSourceGamma, 220000},
+		// The largest gamma rounds to 1, and anything larger to 0.
+		{200000, 1},
+		{200001, 0},
+		// The smallest gamma gives the largest value a chunk holds.
+		{100000 / float64(maxPngChunkLength), maxPngChunkLength},
+		{100000 / float64(maxPngChunkLength+1), 0},
+		{0, 0},
+		{-2.2, 0},
+		{math.NaN(), 0},
+		{math.Inf(1), 0},
+		{math.Inf(-1), 0},
+		{math.SmallestNonzeroFloat64, 0},
+	}
+	for _, tt := range tests {
+		got := GamaChunkValue(tt.gamma)
+		if got != tt.want {
+			t.Errorf("GamaChunkValue(%v) = %d, want %d", tt.gamma, got, tt.want)
+		}
+		if ec := CheckGamma(tt.gamma); (ec == nil) != (got != 0) {
+			t.Errorf("CheckGamma(%v) = %v, but GamaChunkValue is %d", tt.gamma, ec, got)
+		}
+	}
+}
+
+func TestDecodeMaxPixels(t *testing.T) {
+	src := testPattern(8, 8)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		maxPixels int
+		timeout   time.Duration
+		ok        bool
+	}{
+		{0, 0, true},
+		{64, 0, true},
+		{63, 0, false},
+		{64, time.Minute, true},
+		{63, time.Minute, false},
+	}
+	for _, tt := range tests {
+		opts := Options{MaxPixels: tt.maxPixels, MaxDecodeTime: tt.timeout}
+		im, err := decodeImage(bytes.NewReader(buf.Bytes()), opts)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("max %d: decoded an 8x8 image", tt.maxPixels)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("max %d: %v", tt.maxPixels, err)
+			continue
+		}
+		// The header read to check the size is decoded again along with the rest.
+		if got, want := toNRGBA(im).Pix, src.Pix; !bytes.Equal(got, want) {
+			t.Errorf("max %d: decoded pixels differ", tt.maxPixels)
+		}
+	}
+}
+
+// An animated WebP is checked against its canvas, before any of it is read past the header.
+func TestDecodeMaxPixelsAnimatedWebP(t *testing.T) {
+	header := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0A\x00\x00\x00\x02\x00\x00\x00")
+	// A 16384x16384 canvas, stored as each size less one.
+	header = append(header, 0xFF, 0x3F, 0x00, 0xFF, 0x3F, 0x00)
+	_, err := decodeImage(bytes.NewReader(header), Options{MaxPixels: 1 << 20})
+	if err == nil || !strings.Contains(err.Error(), "16384x16384") {
+		t.Errorf("decodeImage() = %v, want the canvas too large", err)
+	}
+}
+
+func TestDecodeWithin(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	err := decodeWithin(time.Millisecond, func() error {
+		<-release
+		return nil
+	})
+	if err == nil {
+		t.Error("blocked decode finished")
+	}
+	if err := decodeWithin(time.Minute, func() error { return io.EOF }); err != io.EOF {
+		t.Errorf("decodeWithin() = %v, want %v", err, io.EOF)
+	}
+	if err := decodeWithin(0, func() error { return nil }); err != nil {
+		t.Errorf("decodeWithin() = %v, without a timeout", err)
+	}
+}
+
+// Even where the Full image is black, its pixels are kept at MinPixel, so the lattice doesn't
+// show as a black mesh over the Thumbnail.
+func TestMinPixelLattice(t *testing.T) {
+	black := color.NRGBA{0, 0, 0, 0xFF}
+	thumbnail, full := uniformNRGBA(black), uniformNRGBA(black)
+	for _, minPixel := range []float64{0, 0.001, 0.01, 0.1} {
+		dim, ec := GammaMuxImagesOpts(thumbnail, full, Options{MinPixel: minPixel})
+		if ec != nil {
+			t.Fatal(ec)
+		}
+		want := minPixel
+		if want == 0 {
+			want = DefaultMinPixel
+		}
+		// Encoding may round down by one 8 bit step.
+		low := math.Pow(math.Max(math.Pow(want, 1/DefaultTargetGamma)-1.0/nrgbaMax, 0),
+			DefaultTargetGamma)
+		var fulls int
+		at := nrgba64Reader(dim)
+		b := dim.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				v := at(x, y).R
+				if v == 0 {
+					continue
+				}
+				fulls++
+				if linear := math.Pow(float64(v)/nrgba64Max, DefaultTargetGamma); linear < low {
+					t.Errorf("min pixel %v: pixel %d,%d is %v linear, below %v",
+						minPixel, x, y, linear, want)
+				}
+			}
+		}
+		// Every other pixel of every other row is from the Full image.
+		if want := b.Dx() * b.Dy() / (fullScaling * fullScaling); fulls != want {
+			t.Errorf("min pixel %v: %d pixels above black, want the %d Full pixels",
+				minPixel, fulls, want)
+		}
+	}
+}
+
+// Fails the test if it is used to resample.
+type noScaler struct {
+	t *testing.T
+}
+
+func (s noScaler) Scale(draw.Image, image.Rectangle, image.Image, image.Rectangle, draw.Op,
+	*draw.Options) {
+	s.t.Error("image was resampled")
+}
+
+// A Full image already the size of the lattice is copied, rather than blurred by resampling.
+func TestResizeExactFit(t *testing.T) {
+	src := testPattern(12, 10)
+	// Offset, so the copy has to start from the source bounds.
+	sub := src.SubImage(image.Rect(2, 1, 10, 9))
+	for _, precision := range []int{8, 16} {
+		dst, xoffset, yoffset := resize(sub, image.Rect(0, 0, 16, 16), fullScaling, 1, false,
+			image.Pt(1, 1), noScaler{t}, precision)
+		if got, want := dst.Bounds(), image.Rect(0, 0, 8, 8); got != want {
+			t.Fatalf("precision %d: bounds %v, want %v", precision, got, want)
+		}
+		if xoffset != 0 || yoffset != 0 {
+			t.Errorf("precision %d: offset %d,%d, want none", precision, xoffset, yoffset)
+		}
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				want := color.NRGBA64Model.Convert(sub.At(x+2, y+1)).(color.NRGBA64)
+				if got := dst.NRGBA64At(x, y); got != want {
+					t.Errorf("precision %d: pixel %d,%d = %v, want %v", precision, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+// The fade grows from each feathered edge inward, and stops feather output pixels in, measured to
+// the middle of each lattice pixel.
+func TestFeatherPixel(t *testing.T) {
+	white := color.NRGBA64{nrgba64Max, nrgba64Max, nrgba64Max, nrgba64Max}
+	bounds := image.Rect(0, 0, 20, 20)
+	for _, tt := range []struct {
+		feather, scaling int
+	}{{8, 2}, {9, 3}, {1, 2}} {
+		// Walks in from the left, right, top, and bottom edges, all feathered.
+		for _, edge := range []struct {
+			name string
+			at   func(d int) (x, y int)
+		}{
+			{"left", func(d int) (int, int) { return d, 10 }},
+			{"right", func(d int) (int, int) { return 19 - d, 10 }},
+			{"top", func(d int) (int, int) { return 10, d }},
+			{"bottom", func(d int) (int, int) { return 10, 19 - d }},
+		} {
+			prev := -1
+			for d := 0; d < 10; d++ {
+				x, y := edge.at(d)
+				v := int(featherPixel(white, x, y, bounds, true, true, tt.feather, tt.scaling).R)
+				if (2*d+1)*tt.scaling >= 2*tt.feather {
+					if v != nrgba64Max {
+						t.Errorf("feather %d scaling %d: %s pixel %d in is %d, want unchanged",
+							tt.feather, tt.scaling, edge.name, d, v)
+					}
+				} else if v <= prev || v >= nrgba64Max {
+					t.Errorf("feather %d scaling %d: %s pixel %d in is %d, want between %d and %d",
+						tt.feather, tt.scaling, edge.name, d, v, prev, nrgba64Max)
+				}
+				prev = v
+			}
+		}
+	}
+
+	// Edges that don't border the letterbox aren't feathered.
+	if got := featherPixel(white, 0, 0, bounds, false, false, 8, 2); got != white {
+		t.Errorf("unfeathered corner is %v, want %v", got, white)
+	}
+	if got := featherPixel(white, 0, 10, bounds, false, true, 8, 2); got != white {
+		t.Errorf("side pixel with only the ends feathered is %v, want %v", got, white)
+	}
+}
+
+// RobustLattice flattens the Thumbnail itself, but must still warn about its alpha, and keep it for
+// PreserveAlpha.
+func TestRobustLatticeAlpha(t *testing.T) {
+	// Odd sized, so the output is a pixel smaller than the Thumbnail.
+	thumbnail := image.NewNRGBA(image.Rect(0, 0, 9, 9))
+	for y := 0; y < 9; y++ {
+		for x := 0; x < 9; x++ {
+			if x >= 4 {
+				thumbnail.SetNRGBA(x, y, color.NRGBA{0x80, 0x80, 0x80, 0xFF})
+			}
+		}
+	}
+	full := uniformNRGBA(color.NRGBA{0xFF, 0xFF, 0xFF, 0xFF})
+	opts := Options{RobustLattice: true, PreserveAlpha: true}
+	dim, ec := GammaMuxImagesOpts(thumbnail, full, opts)
+	if ec != nil {
+		t.Fatal(ec)
+	}
+	at := nrgba64Reader(dim)
+	b := dim.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			want := uint16(nrgba64Max)
+			if x < 4 {
+				want = 0
+			}
+			if got := at(x, y).A; got != want {
+				t.Errorf("pixel %d,%d alpha %d, want %d", x, y, got, want)
+			}
+		}
+	}
+
+	// Straight white edges, taken to be premultiplied, are warned about, as without RobustLattice.
+	straight := uniformNRGBA(color.NRGBA{0xFF, 0xFF, 0xFF, 0x80})
+	for _, robust := range []bool{false, true} {
+		opts := Options{RobustLattice: robust, AlphaMode: "premultiplied", Strict: true}
+		if _, ec := GammaMuxImagesOpts(straight, full, opts); ec == nil {
+			t.Errorf("robust %v: no alpha mode warning", robust)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// Returns the muxed PNG without any chunks declaring its color space, so it is shown as is, and
+// the gamma it declared.  PNGs without a gAMA chunk are assumed to have the default target gamma.
+func stripGamma(muxed io.Reader) (*bytes.Buffer, float64, *ErrChain) {
+	data, err := io.ReadAll(muxed)
+	if err != nil {
+		return nil, 0, ChainErr(err, "Unable to read muxed PNG")
+	}
+	gamma := float64(targetGamma)
+	info, ec := ReadPNGInfo(bytes.NewReader(data))
+	if ec != nil {
+		return nil, 0, ec
+	}
+	if info.HasGamma && info.Gamma > 0 {
+		gamma = info.Gamma
+	}
+
+	var stripped bytes.Buffer
+	drop := func(chunkType string) bool {
+		return chunkType == "gAMA" || chunkType == "sRGB" || chunkType == "iCCP"
+	}
+	noop := func(io.Writer) *ErrChain {
+		return nil
+	}
+	if ec := spliceAfterHeader(&stripped, bytes.NewReader(data), drop, noop); ec != nil {
+		return nil, 0, ec
+	}
+	return &stripped, gamma, nil
+}
+
+// Writes a self contained HTML snippet showing the muxed PNG the way a gamma aware viewer would,
+// regardless of whether the browser honors gAMA.  The image is embedded without its gAMA chunk,
+// and a script redoes the gamma correction on a canvas.  This works in any browser with canvas
+// support; without scripts, the Thumbnail is shown.
+func WriteHTMLSnippet(muxed io.Reader, dest io.Writer) *ErrChain {
+	stripped, gamma, ec := stripGamma(muxed)
+	if ec != nil {
+		return ec
+	}
+
+	// Without a gAMA chunk, a sample v is displayed as is.  A compliant viewer would have shown it
+	// as v^(target gamma / display gamma).
+	_, err := fmt.Fprintf(dest, `<figure class="gammux">
+  <img src="data:image/png;base64,%s" alt="">
+  <script>
+    (function(img) {
+      function render() {
+        var canvas = document.createElement("canvas");
+        canvas.width = img.naturalWidth;
+        canvas.height = img.naturalHeight;
+        var ctx = canvas.getContext("2d");
+        ctx.drawImage(img, 0, 0);
+        var data = ctx.getImageData(0, 0, canvas.width, canvas.height);
+        var table = new Uint8ClampedArray(256);
+        for (var i = 0; i < 256; i++) {
+          table[i] = Math.round(255 * Math.pow(i / 255, %g));
+        }
+        for (var i = 0; i < data.data.length; i += 4) {
+          data.data[i] = table[data.data[i]];
+          data.data[i + 1] = table[data.data[i + 1]];
+          data.data[i + 2] = table[data.data[i + 2]];
+        }
+        ctx.putImageData(data, 0, 0);
+        img.replaceWith(canvas);
+      }
+      if (img.complete) {
+        render();
+      } else {
+        img.addEventListener("load", render);
+      }
+    })(document.currentScript.previousElementSibling);
+  </script>
+</figure>
+`, base64.StdEncoding.EncodeToString(stripped.Bytes()), gamma/sourceGamma)
+	if err != nil {
+		return ChainErr(err, "Unable to write HTML snippet")
+	}
+	return nil
+}
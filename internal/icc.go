@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const iccProfileName = "gammux"
+
+// D50 relative sRGB primaries, and the D50 white point.
+var (
+	iccWhitePoint = [3]float64{0.9642, 1.0, 0.8249}
+	iccRed        = [3]float64{0.4360747, 0.2225045, 0.0139322}
+	iccGreen      = [3]float64{0.3850649, 0.7168786, 0.0971045}
+	iccBlue       = [3]float64{0.1430804, 0.0606169, 0.7141733}
+)
+
+type iccTag struct {
+	sig  string
+	data []byte
+}
+
+func iccS15Fixed16(v float64) uint32 {
+	return uint32(int32(math.Round(v * 0x10000)))
+}
+
+func iccXYZ(xyz [3]float64) []byte {
+	buf := make([]byte, 8+12)
+	copy(buf, "XYZ ")
+	for i, v := range xyz {
+		binary.BigEndian.PutUint32(buf[8+4*i:], iccS15Fixed16(v))
+	}
+	return buf
+}
+
+// A curve with a single entry is a pure power function.
+func iccCurve(gamma float64) []byte {
+	buf := make([]byte, 8+4+2)
+	copy(buf, "curv")
+	binary.BigEndian.PutUint32(buf[8:], 1)
+	binary.BigEndian.PutUint16(buf[12:], uint16(math.Round(gamma*0x100)))
+	return buf
+}
+
+func iccText(text string) []byte {
+	buf := make([]byte, 8+len(text)+1)
+	copy(buf, "text")
+	copy(buf[8:], text)
+	return buf
+}
+
+func iccDescription(desc string) []byte {
+	// ASCII description, followed by empty Unicode and ScriptCode descriptions.
+	buf := make([]byte, 8+4+len(desc)+1+4+4+2+1+67)
+	copy(buf, "desc")
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(desc)+1))
+	copy(buf[12:], desc)
+	return buf
+}
+
+// Builds a minimal version 2 display profile whose tone curves are the given gamma.  Grayscale
+// images need a gray profile.
+func iccProfile(gamma float64, gray bool) ([]byte, error) {
+	if gamma <= 0 || gamma >= 0x100 {
+		return nil, fmt.Errorf("gamma %v can't be represented in an ICC profile", gamma)
+	}
+	desc := fmt.Sprintf("gammux gamma %g", gamma)
+	curve := iccCurve(gamma)
+	var colorSpace string
+	var tags []iccTag
+	if gray {
+		colorSpace = "GRAY"
+		tags = []iccTag{
+			{"desc", iccDescription(desc)},
+			{"cprt", iccText("No copyright, use freely")},
+			{"wtpt", iccXYZ(iccWhitePoint)},
+			{"kTRC", curve},
+		}
+	} else {
+		colorSpace = "RGB "
+		tags = []iccTag{
+			{"desc", iccDescription(desc)},
+			{"cprt", iccText("No copyright, use freely")},
+			{"wtpt", iccXYZ(iccWhitePoint)},
+			{"rXYZ", iccXYZ(iccRed)},
+			{"gXYZ", iccXYZ(iccGreen)},
+			{"bXYZ", iccXYZ(iccBlue)},
+			{"rTRC", curve},
+			{"gTRC", curve},
+			{"bTRC", curve},
+		}
+	}
+
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntr")
+	copy(header[16:], colorSpace)
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+	for i, v := range iccWhitePoint {
+		binary.BigEndian.PutUint32(header[68+4*i:], iccS15Fixed16(v))
+	}
+
+	table := make([]byte, 4+12*len(tags))
+	binary.BigEndian.PutUint32(table, uint32(len(tags)))
+	var data bytes.Buffer
+	offset := len(header) + len(table)
+	for i, tag := range tags {
+		entry := table[4+12*i:]
+		copy(entry, tag.sig)
+		binary.BigEndian.PutUint32(entry[4:], uint32(offset+data.Len()))
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(tag.data)))
+		data.Write(tag.data)
+		// Tags start on 4 byte boundaries.
+		for data.Len()%4 != 0 {
+			data.WriteByte(0)
+		}
+	}
+
+	profile := append(append(header, table...), data.Bytes()...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile, nil
+}
+
+func writeIccpPngChunk(w io.Writer, gamma float64, gray bool) *ErrChain {
+	profile, err := iccProfile(gamma, gray)
+	if err != nil {
+		return ChainErr(err, "Unable to build ICC profile")
+	}
+	var iccpData bytes.Buffer
+	iccpData.WriteString(iccProfileName)
+	// Null separator, then the compression method, which is always zlib.
+	iccpData.Write([]byte{0, 0})
+	zw := zlib.NewWriter(&iccpData)
+	if _, err := zw.Write(profile); err != nil {
+		return ChainErr(err, "Unable to compress ICC profile")
+	}
+	if err := zw.Close(); err != nil {
+		return ChainErr(err, "Unable to compress ICC profile")
+	}
+	if err := writePngChunk(w, "iCCP", iccpData.Bytes()); err != nil {
+		return ChainErr(err, "Unable to write PNG iCCP chunk")
+	}
+	return nil
+}
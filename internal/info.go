@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// PNGInfo describes a PNG, from the chunks before its image data.
+type PNGInfo struct {
+	Width, Height int
+	BitDepth      uint8
+	ColorType     uint8
+	Interlaced    bool
+	// Chunks are the chunk types seen, in order.
+	Chunks []string
+	// HasGamma is set if there is a gAMA chunk.  GamaValue is its raw value, and Gamma is the
+	// equivalent gamma, as passed to the muxer.
+	HasGamma  bool
+	GamaValue uint32
+	Gamma     float64
+	// Text holds the tEXt chunks, by key.
+	Text map[string]string
+	// Truncated is set if the stream ended before the image data started.
+	Truncated bool
+}
+
+// Reads just enough of a PNG stream to describe it, stopping at the first image data chunk.  If
+// the stream ends early, but after the header, what was found so far is returned.  Damaged
+// chunks, such as those with bad CRCs, are an error.
+func ReadPNGInfo(r io.Reader) (*PNGInfo, *ErrChain) {
+	cr := NewPNGChunkReader(r)
+	var info *PNGInfo
+	for {
+		chunkType, length, err := cr.nextHeader()
+		if err == nil && chunkType == "IDAT" {
+			if info == nil {
+				return nil, ChainErr(nil, "PNG missing header")
+			}
+			info.Chunks = append(info.Chunks, chunkType)
+			return info, nil
+		}
+		var data []byte
+		if err == nil {
+			data, err = cr.readData(chunkType, length)
+		}
+		if err != nil {
+			if info == nil {
+				return nil, ChainErr(err, "Unable to read PNG header")
+			}
+			// Only running out of data is truncation.  Bad CRCs and failed reads are errors.
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, ChainErr(err, "Unable to read PNG")
+			}
+			info.Truncated = true
+			return info, nil
+		}
+
+		if info == nil {
+			if chunkType != "IHDR" || len(data) != 13 {
+				return nil, ChainErr(nil, "PNG missing header")
+			}
+			info = &PNGInfo{
+				Width:      int(binary.BigEndian.Uint32(data[0:4])),
+				Height:     int(binary.BigEndian.Uint32(data[4:8])),
+				BitDepth:   data[8],
+				ColorType:  data[9],
+				Interlaced: data[12] != 0,
+			}
+		}
+		info.Chunks = append(info.Chunks, chunkType)
+		if chunkType == "gAMA" && len(data) == 4 {
+			info.HasGamma = true
+			info.GamaValue = binary.BigEndian.Uint32(data)
+			if info.GamaValue != 0 {
+				info.Gamma = 100000 / float64(info.GamaValue)
+			}
+		}
+		if i := bytes.IndexByte(data, 0); chunkType == "tEXt" && i > 0 {
+			if info.Text == nil {
+				info.Text = make(map[string]string)
+			}
+			info.Text[fromLatin1(data[:i])] = fromLatin1(data[i+1:])
+		}
+		if chunkType == "IEND" {
+			return info, nil
+		}
+	}
+}
+
+// IsMuxed reports whether the PNG in src still declares a gamma high enough to hide a Thumbnail,
+// as muxed images do.  Ordinary PNGs, and those whose gamma would be overridden by an sRGB chunk,
+// are not muxed.  Chunks before the image data with bad CRCs are an error, since viewers may skip
+// them.
+func IsMuxed(src io.Reader) (bool, *ErrChain) {
+	cr := NewPNGChunkReader(src)
+	var gamma float64
+	for {
+		chunkType, length, err := cr.nextHeader()
+		if err == io.EOF || err == nil && chunkType == "IDAT" {
+			break
+		} else if err != nil {
+			return false, ChainErr(err, "Unable to read PNG")
+		}
+		data, err := cr.readData(chunkType, length)
+		if err != nil {
+			return false, ChainErr(err, "Unable to read PNG")
+		}
+		switch chunkType {
+		case "gAMA":
+			if len(data) != 4 || binary.BigEndian.Uint32(data) == 0 {
+				return false, nil
+			}
+			gamma = 100000 / float64(binary.BigEndian.Uint32(data))
+		case "sRGB":
+			return false, nil
+		}
+	}
+	return gamma > 0 && WarnGamma(gamma, sourceGamma) == "", nil
+}
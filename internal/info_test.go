@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// Returns a small PNG with a gAMA chunk, and the offset of the gAMA chunk.
+func testGammaPNG(t *testing.T) ([]byte, int) {
+	t.Helper()
+	var plain bytes.Buffer
+	if err := png.Encode(&plain, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if ec := RepairGamma(&plain, &buf, DefaultTargetGamma); ec != nil {
+		t.Fatal(ec)
+	}
+	// The signature, then the 25 byte IHDR chunk.
+	return buf.Bytes(), 8 + 25
+}
+
+func TestReadPNGInfoTruncated(t *testing.T) {
+	data, gama := testGammaPNG(t)
+	// Cut inside the gAMA chunk header, inside its data, and right after it.
+	for _, n := range []int{gama + 3, gama + 10, gama + 16} {
+		info, ec := ReadPNGInfo(bytes.NewReader(data[:n]))
+		if ec != nil {
+			t.Errorf("cut at %d: %v", n, ec)
+			continue
+		}
+		if !info.Truncated {
+			t.Errorf("cut at %d: not truncated", n)
+		}
+		if wantGamma := n == gama+16; info.HasGamma != wantGamma {
+			t.Errorf("cut at %d: HasGamma %v, want %v", n, info.HasGamma, wantGamma)
+		}
+	}
+
+	info, ec := ReadPNGInfo(bytes.NewReader(data))
+	if ec != nil {
+		t.Fatal(ec)
+	}
+	if info.Truncated || !info.HasGamma || info.GamaValue != GamaChunkValue(DefaultTargetGamma) {
+		t.Errorf("got %+v, want untruncated with gamma", info)
+	}
+}
+
+func TestReadPNGInfoBadCRC(t *testing.T) {
+	data, gama := testGammaPNG(t)
+	bad := append([]byte(nil), data...)
+	// Flip a bit of the gAMA value, so its CRC no longer matches.
+	bad[gama+8+3] ^= 1
+	if info, ec := ReadPNGInfo(bytes.NewReader(bad)); ec == nil {
+		t.Errorf("got %+v, want a CRC error", info)
+	}
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+)
+
+// testdata/interlaced.png is a 13x11 Adam7 interlaced RGB PNG of this pattern.  The odd size
+// leaves some passes short of a full 8x8 tile.
+func interlacedPattern(x, y int) color.NRGBA {
+	return color.NRGBA{R: uint8(x * 19), G: uint8(y * 23), B: uint8(x * y * 7), A: 0xFF}
+}
+
+func TestInterlacedInput(t *testing.T) {
+	interlaced, err := os.ReadFile("testdata/interlaced.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, ec := ReadPNGInfo(bytes.NewReader(interlaced))
+	if ec != nil {
+		t.Fatal(ec)
+	}
+	if !info.Interlaced {
+		t.Fatal("testdata/interlaced.png isn't interlaced")
+	}
+
+	im, err := png.Decode(bytes.NewReader(interlaced))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := im.Bounds(), image.Rect(0, 0, 13, 11); got != want {
+		t.Fatalf("bounds %v, want %v", got, want)
+	}
+	plain := image.NewNRGBA(im.Bounds())
+	for y := 0; y < 11; y++ {
+		for x := 0; x < 13; x++ {
+			want := interlacedPattern(x, y)
+			if got := color.NRGBAModel.Convert(im.At(x, y)); got != want {
+				t.Fatalf("pixel %d,%d = %v, want %v", x, y, got, want)
+			}
+			plain.SetNRGBA(x, y, want)
+		}
+	}
+	var plainPNG bytes.Buffer
+	if err := png.Encode(&plainPNG, plain); err != nil {
+		t.Fatal(err)
+	}
+
+	// Muxing the interlaced image must give the same output as muxing the same pixels without
+	// interlacing, both as the Thumbnail and the Full image.
+	mux := func(thumbnail, full []byte) []byte {
+		var dest bytes.Buffer
+		ec := GammaMuxDataOpts(bytes.NewReader(thumbnail), bytes.NewReader(full), &dest, Options{
+			Dither: true,
+		})
+		if ec != nil {
+			t.Fatal(ec)
+		}
+		return dest.Bytes()
+	}
+	want := mux(plainPNG.Bytes(), plainPNG.Bytes())
+	if got := mux(interlaced, interlaced); !bytes.Equal(got, want) {
+		t.Error("muxing the interlaced input differs from the plain one")
+	}
+
+	outInfo, ec := ReadPNGInfo(bytes.NewReader(want))
+	if ec != nil {
+		t.Fatal(ec)
+	}
+	if outInfo.Interlaced {
+		t.Error("output is interlaced")
+	}
+}
@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+// Layout is where the Full image ended up in the muxed output.
+type Layout struct {
+	// FullBounds is the area of the output covered by the scaled Full image.
+	FullBounds image.Rectangle `json:"fullBounds"`
+	// OffsetX and OffsetY are how far the Full image was moved to center it, when not stretched.
+	OffsetX int `json:"offsetX"`
+	OffsetY int `json:"offsetY"`
+}
+
+// Fills in l, if it is set.
+func (l *Layout) record(fullBounds image.Rectangle, xoffset, yoffset int) {
+	if l == nil {
+		return
+	}
+	*l = Layout{FullBounds: fullBounds, OffsetX: xoffset, OffsetY: yoffset}
+}
+
+func (l *Layout) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%-12s %v\n%-12s %d,%d\n",
+		"full bounds", l.FullBounds, "offset", l.OffsetX, l.OffsetY)
+	return err
+}
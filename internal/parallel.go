@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// Splits rows into a band for each CPU, and calls f with each row, working on the bands at the
+// same time.  f must only write its own row.  Once ctx is done, the remaining rows are skipped.
+func forEachRow(ctx context.Context, rows int, f func(y int)) {
+	band := func(start, end int) {
+		for y := start; y < end && ctx.Err() == nil; y++ {
+			f(y)
+		}
+	}
+	bands := runtime.NumCPU()
+	if bands > rows {
+		bands = rows
+	}
+	if bands <= 1 {
+		band(0, rows)
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < bands; i++ {
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			band(start, end)
+		}(rows*i/bands, rows*(i+1)/bands)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// AttributionText returns text noting that an image was muxed by gammux for gamma, to be passed
+// as Options.Text.
+func AttributionText(gamma float64) map[string]string {
+	return map[string]string{
+		"Software": "gammux",
+		"Comment":  fmt.Sprintf("Gamma muxed with a target gamma of %g", gamma),
+	}
+}
+
+// Converts s to Latin-1, which is all tEXt chunks can hold.
+func latin1(s string) ([]byte, bool) {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xFF {
+			return nil, false
+		}
+		b = append(b, byte(r))
+	}
+	return b, true
+}
+
+// Writes a tEXt chunk for each key of text, in key order so the output doesn't change between
+// runs.  Keys must be 1 to 79 printable Latin-1 characters, and values may not contain NUL.
+func writeTextPngChunks(w io.Writer, text map[string]string) *ErrChain {
+	keys := make([]string, 0, len(text))
+	for k := range text {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		key, ok := latin1(k)
+		if !ok || len(key) < 1 || len(key) > 79 {
+			return ChainErr(nil, fmt.Sprintf("Text key %q must be 1 to 79 Latin-1 characters", k))
+		}
+		for _, c := range key {
+			if c < 0x20 || c > 0x7E && c < 0xA1 {
+				return ChainErr(nil, fmt.Sprintf("Text key %q must be printable", k))
+			}
+		}
+		value, ok := latin1(text[k])
+		if !ok {
+			return ChainErr(nil, fmt.Sprintf("Text for %q must be Latin-1", k))
+		}
+		for _, c := range value {
+			if c == 0 {
+				return ChainErr(nil, fmt.Sprintf("Text for %q must not contain NUL", k))
+			}
+		}
+
+		data := append(append(key, 0), value...)
+		if err := writePngChunk(w, "tEXt", data); err != nil {
+			return ChainErr(err, "Unable to write PNG tEXt chunk")
+		}
+	}
+	return nil
+}
+
+func fromLatin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"golang.org/x/image/draw"
+)
+
+// An intermediate image, read and written with 16 bit channels regardless of how it is stored.
+type nrgba64Image interface {
+	draw.Image
+	NRGBA64At(x, y int) color.NRGBA64
+	SetNRGBA64(x, y int, c color.NRGBA64)
+}
+
+// Stores 8 bits per channel, for half the memory of image.NRGBA64.
+type nrgba8Image struct {
+	*image.NRGBA
+}
+
+func (p nrgba8Image) NRGBA64At(x, y int) color.NRGBA64 {
+	c := p.NRGBAAt(x, y)
+	return color.NRGBA64{
+		R: uint16(c.R) * 0x101,
+		G: uint16(c.G) * 0x101,
+		B: uint16(c.B) * 0x101,
+		A: uint16(c.A) * 0x101,
+	}
+}
+
+func (p nrgba8Image) SetNRGBA64(x, y int, c color.NRGBA64) {
+	p.SetNRGBA(x, y, color.NRGBA{
+		R: uint8(c.R >> 8),
+		G: uint8(c.G >> 8),
+		B: uint8(c.B >> 8),
+		A: uint8(c.A >> 8),
+	})
+}
+
+// Returns a function reading pixels of src as NRGBA64.  Images that already store NRGBA64, such as
+// *image.NRGBA64 and the intermediate images, skip the costly color model conversion.
+func nrgba64Reader(src image.Image) func(x, y int) color.NRGBA64 {
+	if p, ok := src.(interface {
+		NRGBA64At(x, y int) color.NRGBA64
+	}); ok {
+		return p.NRGBA64At
+	}
+	// JPEGs decode as one of these.  Reading them directly is only faster, since it skips the
+	// boxing and model conversion of At; the colors are the same either way.  They are always
+	// opaque, and YCbCrAt finds the right chroma sample for any subsampling, such as 4:2:0.
+	switch p := src.(type) {
+	case *image.YCbCr:
+		return func(x, y int) color.NRGBA64 {
+			r, g, b, _ := p.YCbCrAt(x, y).RGBA()
+			return color.NRGBA64{R: uint16(r), G: uint16(g), B: uint16(b), A: nrgba64Max}
+		}
+	case *image.CMYK:
+		return func(x, y int) color.NRGBA64 {
+			r, g, b, _ := p.CMYKAt(x, y).RGBA()
+			return color.NRGBA64{R: uint16(r), G: uint16(g), B: uint16(b), A: nrgba64Max}
+		}
+	}
+	return func(x, y int) color.NRGBA64 {
+		return color.NRGBA64Model.Convert(src.At(x, y)).(color.NRGBA64)
+	}
+}
+
+func newNRGBA64Image(r image.Rectangle, precision int) nrgba64Image {
+	if precision == 8 {
+		return nrgba8Image{image.NewNRGBA(r)}
+	}
+	return image.NewNRGBA64(r)
+}
+
+func checkPrecision(precision int) *ErrChain {
+	if precision != 0 && precision != 8 && precision != 16 {
+		return ChainErr(nil, fmt.Sprintf("Precision %d must be 8 or 16", precision))
+	}
+	return nil
+}
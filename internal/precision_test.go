@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// Returns a colorful image with hard edges, so chroma subsampling has something to blur.
+func testPattern(w, h int) *image.NRGBA {
+	im := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			im.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(x * 255 / w),
+				G: uint8(y * 255 / h),
+				B: uint8((x/3 + y/5) % 2 * 255),
+				A: 0xFF,
+			})
+		}
+	}
+	return im
+}
+
+func TestNRGBA64ReaderJPEG420(t *testing.T) {
+	var jbuf bytes.Buffer
+	if err := jpeg.Encode(&jbuf, testPattern(37, 23), &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	jim, err := jpeg.Decode(&jbuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ycbcr, ok := jim.(*image.YCbCr)
+	if !ok || ycbcr.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		t.Fatalf("JPEG decoded as %T, want 4:2:0 *image.YCbCr", jim)
+	}
+
+	// The reference goes through the standard library's conversion, and a 16 bit PNG.
+	ref := image.NewNRGBA64(jim.Bounds())
+	draw.Draw(ref, ref.Rect, jim, jim.Bounds().Min, draw.Src)
+	var pbuf bytes.Buffer
+	if err := png.Encode(&pbuf, ref); err != nil {
+		t.Fatal(err)
+	}
+	pim, err := png.Decode(&pbuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fast, generic := nrgba64Reader(ycbcr), nrgba64Reader(pim)
+	b := jim.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if got, want := fast(x, y), generic(x, y); got != want {
+				t.Fatalf("pixel %d,%d = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestNRGBA64ReaderCMYK(t *testing.T) {
+	im := image.NewCMYK(image.Rect(0, 0, 4, 4))
+	for i := range im.Pix {
+		im.Pix[i] = uint8(i * 17)
+	}
+	at := nrgba64Reader(im)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			want := color.NRGBA64Model.Convert(im.At(x, y)).(color.NRGBA64)
+			if got := at(x, y); got != want {
+				t.Errorf("pixel %d,%d = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+// Hides every method of an image but those of image.Image, so it takes the generic path.
+type plainImage struct {
+	image.Image
+}
+
+// Compares linearizing an *image.NRGBA64, which is read directly, with the generic path that
+// converts each pixel through its color model.
+func BenchmarkLinearImageNRGBA64(b *testing.B) {
+	src := image.NewNRGBA64(image.Rect(0, 0, 512, 512))
+	draw.Draw(src, src.Rect, testPattern(512, 512), image.Point{}, draw.Src)
+	ctx := context.Background()
+	for _, bm := range []struct {
+		name string
+		im   image.Image
+	}{{"fast", src}, {"generic", plainImage{src}}} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				linearImage(ctx, bm.im, DefaultSourceGamma, 16)
+			}
+		})
+	}
+}
+
+func TestNRGBA64ReaderGeneric(t *testing.T) {
+	src := image.NewNRGBA64(image.Rect(0, 0, 16, 16))
+	draw.Draw(src, src.Rect, testPattern(16, 16), image.Point{}, draw.Src)
+	fast, generic := nrgba64Reader(src), nrgba64Reader(plainImage{src})
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			if got, want := fast(x, y), generic(x, y); got != want {
+				t.Fatalf("pixel %d,%d = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Presets adjust Options for sites known to mangle muxed images.
+var Presets = map[string]func(opts *Options){
+	// Discord shrinks large images in its previews, which blends the lattice together.
+	"discord": func(opts *Options) {
+		opts.RobustLattice = true
+	},
+}
+
+// Applies the named preset to opts.  The empty name does nothing.
+func ApplyPreset(name string, opts *Options) *ErrChain {
+	if name == "" {
+		return nil
+	}
+	preset, ok := Presets[name]
+	if !ok {
+		var names []string
+		for n := range Presets {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return ChainErr(nil, fmt.Sprintf(
+			"Unknown preset %q, must be one of %s", name, strings.Join(names, ", ")))
+	}
+	preset(opts)
+	return nil
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"encoding/binary"
+	"image"
+	"io"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// How many pixels per inch images are shown at on screen, and so the size prints aim for.
+const screenPixelsPerInch = 96
+
+// Returns how many printer dots wide each muxed pixel is made when printing at dpi.  Each pixel
+// becomes a whole number of dots, so every lattice period does too, and the print comes out close
+// to the size the image has on screen.
+func printScale(dpi int) int {
+	if scale := int(math.Round(float64(dpi) / screenPixelsPerInch)); scale > 1 {
+		return scale
+	}
+	return 1
+}
+
+// Enlarges im by scale without blending, so each pixel of the lattice stays distinct.
+func upscaleNearest(im image.Image, scale int) *image.NRGBA {
+	b := im.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx()*scale, b.Dy()*scale))
+	draw.NearestNeighbor.Scale(dst, dst.Bounds(), im, b, draw.Src, nil)
+	return dst
+}
+
+// Writes a pHYs chunk saying each pixel is one dot at dpi.
+func writePhysPngChunk(w io.Writer, dpi int) *ErrChain {
+	physData := make([]byte, 9)
+	ppm := uint32(math.Round(float64(dpi) / 0.0254))
+	binary.BigEndian.PutUint32(physData[0:4], ppm)
+	binary.BigEndian.PutUint32(physData[4:8], ppm)
+	// The unit is meters
+	physData[8] = 1
+	if err := writePngChunk(w, "pHYs", physData); err != nil {
+		return ChainErr(err, "Unable to write PNG pHYs chunk")
+	}
+	return nil
+}
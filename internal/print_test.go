@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestPrintScale(t *testing.T) {
+	tests := []struct {
+		dpi, want int
+	}{
+		{0, 1},
+		{72, 1},
+		{96, 1},
+		// Halfway rounds up.
+		{144, 2},
+		{143, 1},
+		{192, 2},
+		{300, 3},
+		{600, 6},
+		{1200, 13},
+		{-300, 1},
+	}
+	for _, tt := range tests {
+		if got := printScale(tt.dpi); got != tt.want {
+			t.Errorf("printScale(%d) = %d, want %d", tt.dpi, got, tt.want)
+		}
+	}
+}
+
+func TestUpscaleNearest(t *testing.T) {
+	im := image.NewNRGBA(image.Rect(5, 5, 7, 6))
+	a, b := color.NRGBA{0xFF, 0, 0, 0xFF}, color.NRGBA{0, 0, 0xFF, 0x80}
+	im.SetNRGBA(5, 5, a)
+	im.SetNRGBA(6, 5, b)
+	got := upscaleNearest(im, 3)
+	if want := image.Rect(0, 0, 6, 3); got.Rect != want {
+		t.Fatalf("bounds %v, want %v", got.Rect, want)
+	}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 6; x++ {
+			want := a
+			if x >= 3 {
+				want = b
+			}
+			if c := got.NRGBAAt(x, y); c != want {
+				t.Errorf("pixel %d,%d = %v, want %v", x, y, c, want)
+			}
+		}
+	}
+}
+
+func TestWritePhysPngChunk(t *testing.T) {
+	var buf bytes.Buffer
+	if ec := writePhysPngChunk(&buf, 300); ec != nil {
+		t.Fatal(ec)
+	}
+	data := buf.Bytes()
+	if len(data) != 4+4+9+4 || string(data[4:8]) != "pHYs" {
+		t.Fatalf("chunk %x isn't a pHYs chunk", data)
+	}
+	// 300 dots per inch is 11811 per meter.
+	x, y := binary.BigEndian.Uint32(data[8:]), binary.BigEndian.Uint32(data[12:])
+	if x != 11811 || y != 11811 || data[16] != 1 {
+		t.Errorf("pHYs %d by %d per unit %d, want 11811 by 11811 per meter", x, y, data[16])
+	}
+}
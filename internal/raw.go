@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"fmt"
+	"image"
+)
+
+// MuxRaw muxes images already decoded into pixels.  Each slice holds 8 bit non-premultiplied
+// R, G, B, A bytes for each pixel, left to right, then top to bottom, with no padding between
+// rows.  The result is laid out the same way, and is as big as the Thumbnail, less the odd last row
+// or column dropped by RobustLattice.  It has no gamma of its own, so callers must declare
+// DefaultTargetGamma when storing it.  opts.BitDepth is ignored.
+func MuxRaw(thumbPix, fullPix []byte, tw, th, fw, fh int, opts Options) ([]byte, *ErrChain) {
+	thumbnail, ec := rawImage(thumbPix, tw, th, "thumbnail")
+	if ec != nil {
+		return nil, ec
+	}
+	full, ec := rawImage(fullPix, fw, fh, "full")
+	if ec != nil {
+		return nil, ec
+	}
+	opts.BitDepth = 8
+	dim, ec := GammaMuxImagesOpts(thumbnail, full, opts)
+	if ec != nil {
+		return nil, ec
+	}
+	return dim.(*image.NRGBA).Pix, nil
+}
+
+func rawImage(pix []byte, w, h int, name string) (*image.NRGBA, *ErrChain) {
+	if w <= 0 || h <= 0 {
+		return nil, ChainErr(nil, fmt.Sprintf("Bad %s size %dx%d", name, w, h))
+	}
+	if len(pix) != w*h*4 {
+		return nil, ChainErr(nil, fmt.Sprintf(
+			"Expected %d bytes for %dx%d %s, got %d", w*h*4, w, h, name, len(pix)))
+	}
+	return &image.NRGBA{Pix: pix, Stride: w * 4, Rect: image.Rect(0, 0, w, h)}, nil
+}
@@ -0,0 +1,330 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"time"
+)
+
+// RenderInterpretations simulates the two ways a muxed image is seen.  naive is what a viewer
+// that ignores gamma shows once it shrinks each block of pixels to one, averaging them.
+// corrected is what a viewer that honors the gAMA chunk shows.  opts must have the TargetGamma
+// and FullScaling the image was muxed with.
+func RenderInterpretations(muxed image.Image, opts Options) (naive, corrected *image.NRGBA) {
+	return renderInterpretations(muxed, opts.targetGamma(), opts.fullScaling())
+}
+
+// Maps each sample of an image declaring gamma to what a viewer honoring it displays.
+func correctionTable(gamma float64) *[nrgbaMax + 1]uint8 {
+	var table [nrgbaMax + 1]uint8
+	for i := range table {
+		table[i] = uint8(math.Round(nrgbaMax * math.Pow(float64(i)/nrgbaMax, gamma/sourceGamma)))
+	}
+	return &table
+}
+
+// Like RenderInterpretations, for a muxed image declaring gamma, with Full image blocks scaling
+// pixels wide and tall.
+func renderInterpretations(
+	muxed image.Image, gamma float64, scaling int) (naive, corrected *image.NRGBA) {
+	b := muxed.Bounds()
+	naive = image.NewNRGBA(image.Rect(0, 0, b.Dx()/scaling, b.Dy()/scaling))
+	corrected = image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+
+	table := correctionTable(gamma)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			px := color.NRGBAModel.Convert(muxed.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			corrected.SetNRGBA(x, y, color.NRGBA{
+				R: table[px.R],
+				G: table[px.G],
+				B: table[px.B],
+				A: px.A,
+			})
+		}
+	}
+
+	// Do averaging using the arithmetic mean, like most decoders do.
+	for y := 0; y < naive.Bounds().Dy(); y++ {
+		for x := 0; x < naive.Bounds().Dx(); x++ {
+			var r, g, bl, a uint32
+			for dy := 0; dy < scaling; dy++ {
+				for dx := 0; dx < scaling; dx++ {
+					px := color.NRGBAModel.Convert(
+						muxed.At(b.Min.X+x*scaling+dx, b.Min.Y+y*scaling+dy)).(color.NRGBA)
+					r += uint32(px.R)
+					g += uint32(px.G)
+					bl += uint32(px.B)
+					a += uint32(px.A)
+				}
+			}
+			n := uint32(scaling * scaling)
+			naive.SetNRGBA(x, y, color.NRGBA{
+				R: uint8((r + n/2) / n),
+				G: uint8((g + n/2) / n),
+				B: uint8((bl + n/2) / n),
+				A: uint8((a + n/2) / n),
+			})
+		}
+	}
+	return naive, corrected
+}
+
+// Decodes a muxed PNG, and returns it with the gamma it declares.  PNGs without a gAMA chunk are
+// assumed to have the default target gamma.
+func decodeMuxed(muxed io.Reader) (image.Image, float64, *ErrChain) {
+	data, err := io.ReadAll(muxed)
+	if err != nil {
+		return nil, 0, ChainErr(err, "Unable to read muxed image")
+	}
+	gamma := float64(targetGamma)
+	info, ec := ReadPNGInfo(bytes.NewReader(data))
+	if ec == nil && info.HasGamma && info.Gamma > 0 {
+		gamma = info.Gamma
+	}
+	// Go's decoder ignores gAMA, which is exactly what's needed here.
+	im, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, ChainErr(err, "Unable to decode muxed image")
+	}
+	return im, gamma, nil
+}
+
+// Decodes a muxed PNG, and writes the naive and gamma corrected renderings of it as PNGs.  Either
+// writer may be nil to skip it.  opts must have the FullScaling the image was muxed with.
+func WriteInterpretations(muxed io.Reader, naive, corrected io.Writer, opts Options) *ErrChain {
+	scaling, ec := opts.checkedFullScaling()
+	if ec != nil {
+		return ec
+	}
+	im, gamma, ec := decodeMuxed(muxed)
+	if ec != nil {
+		return ec
+	}
+	naiveim, correctedim := renderInterpretations(im, gamma, scaling)
+	if naive != nil {
+		if err := png.Encode(naive, naiveim); err != nil {
+			return ChainErr(err, "Unable to encode naive preview")
+		}
+	}
+	if corrected != nil {
+		if err := png.Encode(corrected, correctedim); err != nil {
+			return ChainErr(err, "Unable to encode corrected preview")
+		}
+	}
+	return nil
+}
+
+// Decodes a muxed PNG, and writes what a thumbnailer that ignores gamma shows once it shrinks each
+// block to a pixel, enlarged back to the muxed size so it can be compared with the gamma corrected
+// rendering.  Sizes that aren't a multiple of the block size lose their last rows or columns.
+// opts must have the FullScaling the image was muxed with.
+func WriteThumbnailPreview(muxed io.Reader, dest io.Writer, opts Options) *ErrChain {
+	scaling, ec := opts.checkedFullScaling()
+	if ec != nil {
+		return ec
+	}
+	im, gamma, ec := decodeMuxed(muxed)
+	if ec != nil {
+		return ec
+	}
+	naiveim, _ := renderInterpretations(im, gamma, scaling)
+	if err := png.Encode(dest, upscaleNearest(naiveim, scaling)); err != nil {
+		return ChainErr(err, "Unable to encode thumbnail preview")
+	}
+	return nil
+}
+
+// Decodes a muxed PNG, and writes an APNG flipping between its naive and gamma corrected
+// renderings every delay, forever.  The frames are plain images, so every viewer with APNG
+// support shows both the same way.  opts must have the FullScaling the image was muxed with.
+func WriteFlipAPNG(muxed io.Reader, dest io.Writer, delay time.Duration, opts Options) *ErrChain {
+	if delay <= 0 || delay > math.MaxUint16*time.Millisecond {
+		return ChainErr(nil, fmt.Sprintf("Flip delay %v must be between 1ms and %v",
+			delay, math.MaxUint16*time.Millisecond))
+	}
+	scaling, ec := opts.checkedFullScaling()
+	if ec != nil {
+		return ec
+	}
+	im, gamma, ec := decodeMuxed(muxed)
+	if ec != nil {
+		return ec
+	}
+	naiveim, correctedim := renderInterpretations(im, gamma, scaling)
+	// The naive rendering is one block per pixel, so it is enlarged back to match.  Sizes that
+	// aren't a multiple of the block size lose their last rows or columns.
+	naiveim = upscaleNearest(naiveim, scaling)
+	correctedim = correctedim.SubImage(naiveim.Bounds()).(*image.NRGBA)
+
+	aw := &apngWriter{dest: dest, plain: true, frames: 2}
+	ms := uint16(delay / time.Millisecond)
+	if ec := aw.writeFrame(naiveim, ms, 1000); ec != nil {
+		return ChainErr(ec, "Unable to write naive frame")
+	}
+	if ec := aw.writeFrame(correctedim, ms, 1000); ec != nil {
+		return ChainErr(ec, "Unable to write corrected frame")
+	}
+	return aw.close()
+}
+
+// RendererReport is how much of what a renderer shows comes from each image.
+type RendererReport struct {
+	// Gamma is what the renderer decodes samples with.  Renderers that ignore gAMA use about
+	// 2.2, and those that honor it use the declared gamma.
+	Gamma float64 `json:"gamma"`
+	// FullShare is the fraction, from 0 to 1, of the contrast from the Full image pixels.
+	FullShare float64 `json:"fullShare"`
+}
+
+// Dominant names the image the renderer mostly shows.
+func (r RendererReport) Dominant() string {
+	if r.FullShare > 0.5 {
+		return "full"
+	}
+	return "thumbnail"
+}
+
+// CompareRenderers reports, for each gamma, how much of the muxed image's contrast comes from the
+// Full image pixels once decoded with that gamma.  Contrast is how much the light of each block
+// varies across the image; a nearly even glow from one image is hardly noticed next to the
+// details of the other.  opts must have the LatticeCorner and FullScaling the image was muxed
+// with.
+func CompareRenderers(
+	muxed image.Image, gammas []float64, opts Options) ([]RendererReport, *ErrChain) {
+	cornerx, cornery, ec := opts.latticeCorner()
+	if ec != nil {
+		return nil, ec
+	}
+	scaling, ec := opts.checkedFullScaling()
+	if ec != nil {
+		return nil, ec
+	}
+	b := muxed.Bounds()
+	blocksx, blocksy := b.Dx()/scaling, b.Dy()/scaling
+	reports := make([]RendererReport, len(gammas))
+	for i, gamma := range gammas {
+		if gamma <= 0 || math.IsNaN(gamma) || math.IsInf(gamma, 0) {
+			return nil, ChainErr(nil, fmt.Sprintf("Renderer gamma %v must be positive", gamma))
+		}
+		var table [nrgbaMax + 1]float64
+		for v := range table {
+			table[v] = math.Pow(float64(v)/nrgbaMax, gamma)
+		}
+		// Sums and sums of squares of the light in each block, for the variances.
+		var fullSum, fullSq, thumbSum, thumbSq float64
+		for by := 0; by < blocksy; by++ {
+			for bx := 0; bx < blocksx; bx++ {
+				var full, thumb float64
+				for dy := 0; dy < scaling; dy++ {
+					for dx := 0; dx < scaling; dx++ {
+						px := color.NRGBAModel.Convert(muxed.At(
+							b.Min.X+bx*scaling+dx, b.Min.Y+by*scaling+dy)).(color.NRGBA)
+						light := table[px.R] + table[px.G] + table[px.B]
+						if dx == cornerx*(scaling-1) && dy == cornery*(scaling-1) {
+							full += light
+						} else {
+							thumb += light
+						}
+					}
+				}
+				fullSum += full
+				fullSq += full * full
+				thumbSum += thumb
+				thumbSq += thumb * thumb
+			}
+		}
+		reports[i] = RendererReport{Gamma: gamma}
+		if n := float64(blocksx * blocksy); n > 0 {
+			fullVar := fullSq/n - (fullSum/n)*(fullSum/n)
+			thumbVar := thumbSq/n - (thumbSum/n)*(thumbSum/n)
+			if fullVar+thumbVar > 0 {
+				reports[i].FullShare = fullVar / (fullVar + thumbVar)
+			}
+		}
+	}
+	return reports, nil
+}
+
+// RevealGamma finds the decoding gamma, between 1 and the declared gamma, above which the muxed
+// image mostly shows the Full image.
+func RevealGamma(muxed image.Image, opts Options) (float64, *ErrChain) {
+	share := func(gamma float64) (float64, *ErrChain) {
+		reports, ec := CompareRenderers(muxed, []float64{gamma}, opts)
+		if ec != nil {
+			return 0, ec
+		}
+		return reports[0].FullShare, nil
+	}
+	low, high := 1.0, opts.targetGamma()
+	for i := 0; i < 20; i++ {
+		mid := (low + high) / 2
+		s, ec := share(mid)
+		if ec != nil {
+			return 0, ec
+		}
+		if s > 0.5 {
+			high = mid
+		} else {
+			low = mid
+		}
+	}
+	return high, nil
+}
+
+// Writes reports as a table.
+func WriteRendererReports(w io.Writer, reports []RendererReport) error {
+	if _, err := fmt.Fprintf(w, "%-8s %-10s %s\n", "gamma", "full share", "shows"); err != nil {
+		return err
+	}
+	for _, r := range reports {
+		_, err := fmt.Fprintf(w, "%-8g %-10s %s\n", r.Gamma,
+			fmt.Sprintf("%.1f%%", r.FullShare*100), r.Dominant())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChannelImages splits muxed into its red, green, and blue channels, each as its own gray image.
+// The halo removal works on each channel separately, so color fringes show up as a lattice that
+// differs between them.
+func ChannelImages(muxed image.Image) (r, g, b *image.Gray) {
+	bounds := muxed.Bounds()
+	rect := image.Rect(0, 0, bounds.Dx(), bounds.Dy())
+	r, g, b = image.NewGray(rect), image.NewGray(rect), image.NewGray(rect)
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			px := color.NRGBAModel.Convert(muxed.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			r.SetGray(x, y, color.Gray{Y: px.R})
+			g.SetGray(x, y, color.Gray{Y: px.G})
+			b.SetGray(x, y, color.Gray{Y: px.B})
+		}
+	}
+	return r, g, b
+}
+
+// Decodes a muxed PNG, and writes each of its channels as a gray PNG, without gamma.
+func WriteChannels(muxed io.Reader, r, g, b io.Writer) *ErrChain {
+	im, _, err := image.Decode(muxed)
+	if err != nil {
+		return ChainErr(err, "Unable to decode muxed image")
+	}
+	rim, gim, bim := ChannelImages(im)
+	for _, c := range []struct {
+		name string
+		w    io.Writer
+		im   *image.Gray
+	}{{"red", r, rim}, {"green", g, gim}, {"blue", b, bim}} {
+		if err := png.Encode(c.w, c.im); err != nil {
+			return ChainErr(err, "Unable to encode "+c.name+" channel")
+		}
+	}
+	return nil
+}
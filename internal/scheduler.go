@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MemoryScheduler limits how many jobs run at once by their estimated memory use, rather than by
+// count, so a few large jobs don't run out of memory while many small ones still run together.
+type MemoryScheduler struct {
+	budget int64
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	used int64
+}
+
+func NewMemoryScheduler(budget int64) *MemoryScheduler {
+	s := &MemoryScheduler{budget: budget}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Acquire blocks until cost fits in the budget, and reports if it had to wait.  A job bigger than
+// the whole budget runs by itself.  Release must be called with the same cost when done.
+func (s *MemoryScheduler) Acquire(cost int64) (waited bool) {
+	cost = s.clamp(cost)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.used > 0 && s.used+cost > s.budget {
+		waited = true
+		s.cond.Wait()
+	}
+	s.used += cost
+	return waited
+}
+
+func (s *MemoryScheduler) Release(cost int64) {
+	cost = s.clamp(cost)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= cost
+	s.cond.Broadcast()
+}
+
+func (s *MemoryScheduler) clamp(cost int64) int64 {
+	if cost > s.budget {
+		return s.budget
+	}
+	return cost
+}
+
+// Estimates the peak bytes used while muxing images of the given sizes with opts, counting the
+// intermediate images but not the decoded inputs.
+func EstimateMuxMemory(thumbnail, full image.Point, opts Options) int64 {
+	bytesPerPixel := int64(8)
+	if opts.Precision == 8 {
+		bytesPerPixel = 4
+	}
+	scaling := int64(opts.fullScaling())
+	thumbnailPixels := int64(thumbnail.X) * int64(thumbnail.Y)
+	fullPixels := int64(full.X) * int64(full.Y)
+	// Opaque and linear Full copies, opaque and darkened Thumbnail copies, the Full image scaled
+	// down to the lattice, and the 8 bit output.
+	return 2*fullPixels*bytesPerPixel +
+		2*thumbnailPixels*bytesPerPixel +
+		thumbnailPixels/(scaling*scaling)*bytesPerPixel +
+		thumbnailPixels*4
+}
+
+// Parses a byte count with an optional KB, MB, or GB suffix, such as "512MB".
+func ParseByteSize(s string) (int64, *ErrChain) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	str := strings.ToUpper(strings.TrimSpace(s))
+	scale := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(str, u.suffix) {
+			str, scale = strings.TrimSpace(strings.TrimSuffix(str, u.suffix)), u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n < 0 {
+		return 0, ChainErr(err, fmt.Sprintf("Bad byte size %q", s))
+	}
+	return n * scale, nil
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"image"
+	"testing"
+)
+
+// The Full image is scaled down to the lattice, which is smaller with a larger FullScaling.
+func TestEstimateMuxMemoryScaling(t *testing.T) {
+	thumbnail, full := image.Pt(1200, 1200), image.Pt(600, 600)
+	base := EstimateMuxMemory(thumbnail, full, Options{FullScaling: 100})
+	for _, tt := range []struct {
+		scaling int
+		lattice int64
+	}{
+		{0, 600 * 600 * 8},
+		{2, 600 * 600 * 8},
+		{3, 400 * 400 * 8},
+	} {
+		got := EstimateMuxMemory(thumbnail, full, Options{FullScaling: tt.scaling})
+		if want := base - 12*12*8 + tt.lattice; got != want {
+			t.Errorf("scaling %d: estimated %d bytes, want %d", tt.scaling, got, want)
+		}
+	}
+}
+
+func TestMemorySchedulerOversized(t *testing.T) {
+	s := NewMemoryScheduler(100)
+	// Bigger than the whole budget, so it runs alone rather than waiting forever.
+	if s.Acquire(1000) {
+		t.Error("first job waited")
+	}
+	s.Release(1000)
+	if s.Acquire(60) || s.Acquire(40) {
+		t.Error("jobs within the budget waited")
+	}
+}
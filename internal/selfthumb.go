@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math"
+)
+
+// Makes a Thumbnail from the Full image by shrinking it by scale and blowing it back up to the
+// original size, so the Thumbnail is a blurry teaser of what is hidden.  Smaller scales blur more.
+// The Full image is resampled in linear space, decoded with the SourceGamma of opts.
+func ThumbnailFromFull(full image.Image, scale float64, opts Options) (image.Image, *ErrChain) {
+	if scale <= 0 || scale > 1 || math.IsNaN(scale) {
+		return nil, ChainErr(nil, fmt.Sprintf("Thumbnail scale %v must be above 0, up to 1", scale))
+	}
+	size := full.Bounds().Size()
+	small := image.Point{
+		X: int(math.Max(1, math.Round(float64(size.X)*scale))),
+		Y: int(math.Max(1, math.Round(float64(size.Y)*scale))),
+	}
+	gamma := opts.fullGamma()
+	shrunk := scaleImage(full, small, gamma, opts.Precision, false)
+	return scaleImage(shrunk, size, gamma, opts.Precision, false), nil
+}
+
+// Muxes the Full image with a Thumbnail made from itself, and writes the result as a PNG.
+func GammaMuxFromFullData(full io.Reader, dest io.Writer, scale float64, opts Options) *ErrChain {
+	fim, err := decodeImage(full, opts)
+	if err != nil {
+		return decodeErr(err, "full")
+	}
+	tim, ec := ThumbnailFromFull(fim, scale, opts)
+	if ec != nil {
+		return ec
+	}
+	return GammaMuxImagesData(tim, fim, dest, opts)
+}
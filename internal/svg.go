@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image/png"
+	"io"
+)
+
+// Writes a self contained SVG showing the muxed PNG the way a gamma aware viewer would.  Like
+// WriteHTMLSnippet, the image is embedded without its gAMA chunk, but the gamma correction is
+// redone by an SVG filter instead of a script.  Viewers without filter support show the
+// Thumbnail.  The filter works on displayed pixels, so the SVG must be shown at its natural size.
+func WriteSVG(muxed io.Reader, dest io.Writer) *ErrChain {
+	stripped, gamma, ec := stripGamma(muxed)
+	if ec != nil {
+		return ec
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(stripped.Bytes()))
+	if err != nil {
+		return ChainErr(err, "Unable to read muxed PNG size")
+	}
+
+	// Filters default to working in linear light, which would undo the sRGB decoding first.  The
+	// exponent is the same as in WriteHTMLSnippet.
+	_, err = fmt.Fprintf(dest, `<svg xmlns="http://www.w3.org/2000/svg" `+
+		`xmlns:xlink="http://www.w3.org/1999/xlink" width="%[1]d" height="%[2]d" `+
+		`viewBox="0 0 %[1]d %[2]d">
+  <filter id="gammux" color-interpolation-filters="sRGB">
+    <feComponentTransfer>
+      <feFuncR type="gamma" amplitude="1" exponent="%[3]g" offset="0"/>
+      <feFuncG type="gamma" amplitude="1" exponent="%[3]g" offset="0"/>
+      <feFuncB type="gamma" amplitude="1" exponent="%[3]g" offset="0"/>
+    </feComponentTransfer>
+  </filter>
+  <image width="%[1]d" height="%[2]d" filter="url(#gammux)" style="image-rendering: pixelated" `+
+		`xlink:href="data:image/png;base64,%[4]s"/>
+</svg>
+`, config.Width, config.Height, gamma/sourceGamma,
+		base64.StdEncoding.EncodeToString(stripped.Bytes()))
+	if err != nil {
+		return ChainErr(err, "Unable to write SVG")
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"image"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// BasicFace is the bundled fallback font.  It only comes in one size, so scale it when rendering.
+var BasicFace font.Face = basicfont.Face7x13
+
+// Loads a TrueType or OpenType font from path, at size pixels per em.
+func LoadFace(path string, size float64) (font.Face, *ErrChain) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, ChainErr(err, "Unable to read font file")
+	}
+	f, err := opentype.Parse(data)
+	if err != nil {
+		return nil, ChainErr(err, "Unable to parse font")
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    size,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, ChainErr(err, "Unable to load font face")
+	}
+	return face, nil
+}
+
+// Renders black text onto a white canvas, centering each line.  The text is blown up by scale,
+// for faces that are too small.
+func TextImage(text string, face font.Face, scale int, canvas image.Rectangle) *image.NRGBA {
+	lines := strings.Split(text, "\n")
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	var width int
+	for _, line := range lines {
+		if w := font.MeasureString(face, line).Ceil(); w > width {
+			width = w
+		}
+	}
+
+	textim := image.NewNRGBA(image.Rect(0, 0, width, lineHeight*len(lines)))
+	draw.Draw(textim, textim.Bounds(), image.White, image.Point{}, draw.Src)
+	for i, line := range lines {
+		d := &font.Drawer{
+			Dst:  textim,
+			Src:  image.Black,
+			Face: face,
+			Dot: fixed.Point26_6{
+				X: (fixed.I(width) - font.MeasureString(face, line)) / 2,
+				Y: fixed.I(lineHeight*i) + metrics.Ascent,
+			},
+		}
+		d.DrawString(line)
+	}
+
+	dst := image.NewNRGBA(canvas)
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	scaled := textim.Bounds().Size().Mul(scale)
+	topLeft := canvas.Min.Add(canvas.Size().Sub(scaled).Div(2))
+	draw.NearestNeighbor.Scale(
+		dst, image.Rectangle{Min: topLeft, Max: topLeft.Add(scaled)}, textim, textim.Bounds(),
+		draw.Src, nil)
+	return dst
+}
+
+// Muxes text, rendered onto a Thumbnail the size of the Full image, and writes the result as a
+// PNG.
+func GammaMuxTextData(
+	text string, face font.Face, scale int, full io.Reader, dest io.Writer, opts Options) *ErrChain {
+	fim, err := decodeImage(full, opts)
+	if err != nil {
+		return decodeErr(err, "full")
+	}
+	tim := TextImage(text, face, scale, fim.Bounds())
+	return GammaMuxImagesData(tim, fim, dest, opts)
+}
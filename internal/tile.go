@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+// Muxes each Thumbnail with the Full image at the same index, and lays the results out left to
+// right on a black background.  Every tile shares the same gamma, so one gAMA chunk covers them
+// all.
+func GammaMuxTiles(thumbnails, fulls []image.Image, opts Options) (*image.NRGBA, *ErrChain) {
+	if len(thumbnails) != len(fulls) {
+		return nil, ChainErr(nil, fmt.Sprintf(
+			"Need a Full image for each Thumbnail, got %d and %d", len(thumbnails), len(fulls)))
+	}
+	if len(thumbnails) == 0 {
+		return nil, ChainErr(nil, "No images to tile")
+	}
+	if opts.BitDepth == 16 {
+		return nil, ChainErr(nil, "Tiles can only be written with 8 bits")
+	}
+
+	tiles, ec := muxPairs(thumbnails, fulls, opts)
+	if ec != nil {
+		return nil, ec
+	}
+	var width, height int
+	scaling := opts.fullScaling()
+	for _, tile := range tiles {
+		// Start each tile on a lattice boundary, so downscaling treats every tile the same.
+		width += (tile.Bounds().Dx() + scaling - 1) / scaling * scaling
+		if tile.Bounds().Dy() > height {
+			height = tile.Bounds().Dy()
+		}
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.Black, image.Point{}, draw.Src)
+	var x int
+	for _, tile := range tiles {
+		draw.Draw(dst, tile.Bounds().Sub(tile.Bounds().Min).Add(image.Pt(x, 0)), tile,
+			tile.Bounds().Min, draw.Src)
+		x += (tile.Bounds().Dx() + scaling - 1) / scaling * scaling
+	}
+	return dst, nil
+}
+
+// Muxes each pair, at the same time if MemoryBudget is set.
+func muxPairs(thumbnails, fulls []image.Image, opts Options) ([]image.Image, *ErrChain) {
+	muxed := make([]image.Image, len(thumbnails))
+	// Each pair has its own layout, so there is no single one to report.
+	opts.Layout = nil
+	if opts.MemoryBudget <= 0 {
+		for i := range thumbnails {
+			tile, ec := GammaMuxImagesOpts(thumbnails[i], fulls[i], opts)
+			if ec != nil {
+				return nil, ChainErr(ec, fmt.Sprintf("Unable to mux pair %d", i))
+			}
+			muxed[i] = tile
+		}
+		return muxed, nil
+	}
+
+	sched := NewMemoryScheduler(opts.MemoryBudget)
+	errs := make([]*ErrChain, len(thumbnails))
+	var wg sync.WaitGroup
+	for i := range thumbnails {
+		cost := EstimateMuxMemory(thumbnails[i].Bounds().Size(), fulls[i].Bounds().Size(), opts)
+		if sched.Acquire(cost) {
+			log.Printf("Pair %d waited for %d bytes of the memory budget", i, cost)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer sched.Release(cost)
+			muxed[i], errs[i] = GammaMuxImagesOpts(thumbnails[i], fulls[i], opts)
+		}(i)
+	}
+	wg.Wait()
+	for i, ec := range errs {
+		if ec != nil {
+			return nil, ChainErr(ec, fmt.Sprintf("Unable to mux pair %d", i))
+		}
+	}
+	return muxed, nil
+}
+
+// Muxes each pair of images, tiles them, and writes the result as a PNG.
+func GammaMuxTilesData(thumbnails, fulls []io.Reader, dest io.Writer, opts Options) *ErrChain {
+	if len(thumbnails) != len(fulls) {
+		return ChainErr(nil, fmt.Sprintf(
+			"Need a Full image for each Thumbnail, got %d and %d", len(thumbnails), len(fulls)))
+	}
+	tims := make([]image.Image, len(thumbnails))
+	fims := make([]image.Image, len(fulls))
+	for i := range thumbnails {
+		var err error
+		if tims[i], err = decodeImage(thumbnails[i], opts); err != nil {
+			return ChainErr(&DecodeError{Which: "thumbnail", Err: err},
+				fmt.Sprintf("Unable to decode thumbnail %d", i))
+		}
+		if fims[i], err = decodeImage(fulls[i], opts); err != nil {
+			return ChainErr(&DecodeError{Which: "full", Err: err},
+				fmt.Sprintf("Unable to decode full %d", i))
+		}
+	}
+
+	dim, ec := GammaMuxTiles(tims, fims, opts)
+	if ec != nil {
+		return ec
+	}
+	return encodeMuxed(dim, dest, opts)
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// StageTiming is the total time spent in one stage of muxing.
+type StageTiming struct {
+	Stage    string        `json:"stage"`
+	Duration time.Duration `json:"nanos"`
+}
+
+// Timings collects how long each stage of muxing takes, in the order the stages first ran.  A nil
+// *Timings ignores everything recorded to it.
+type Timings struct {
+	Stages []StageTiming
+
+	mu sync.Mutex
+}
+
+// Adds the time since start to stage.
+func (t *Timings) record(stage string, start time.Time) {
+	if t == nil {
+		return
+	}
+	elapsed := time.Since(start)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.Stages {
+		if t.Stages[i].Stage == stage {
+			t.Stages[i].Duration += elapsed
+			return
+		}
+	}
+	t.Stages = append(t.Stages, StageTiming{Stage: stage, Duration: elapsed})
+}
+
+func (t *Timings) WriteText(w io.Writer) error {
+	var total time.Duration
+	for _, s := range t.Stages {
+		if _, err := fmt.Fprintf(w, "%-12s %v\n", s.Stage, s.Duration); err != nil {
+			return err
+		}
+		total += s.Duration
+	}
+	_, err := fmt.Fprintf(w, "%-12s %v\n", "total", total)
+	return err
+}
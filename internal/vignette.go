@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"math"
+)
+
+// Darkens the edges of an already darkened Thumbnail, in place.  strength is how much of the
+// linear light is taken away at the corners, falling off with the square of the distance from
+// the center.  Pixels only ever get darker, so none rise above the darken factor and show
+// through the corrected image.
+func vignetteImage(im nrgba64Image, strength float64) {
+	b := im.Bounds()
+	halfw, halfh := float64(b.Dx())/2, float64(b.Dy())/2
+	cx, cy := float64(b.Min.X)+halfw, float64(b.Min.Y)+halfh
+	corner := halfw*halfw + halfh*halfh
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dx, dy := float64(x)+0.5-cx, float64(y)+0.5-cy
+			r2 := (dx*dx + dy*dy) / corner
+			if r2 > 1 {
+				r2 = 1
+			}
+			// The light is scaled in linear space, so the samples are scaled by its gamma root.
+			scale := math.Pow(1-strength*r2, 1/sourceGamma)
+			px := im.NRGBA64At(x, y)
+			px.R = uint16(float64(px.R) * scale)
+			px.G = uint16(float64(px.G) * scale)
+			px.B = uint16(float64(px.B) * scale)
+			im.SetNRGBA64(x, y, px)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestVignetteImage(t *testing.T) {
+	limit := uint16(thumbnailDarkenFactor * nrgba64Max)
+	for _, strength := range []float64{0, 0.5, 1} {
+		im := newNRGBA64Image(image.Rect(3, 5, 23, 15), 16)
+		b := im.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				im.SetNRGBA64(x, y, color.NRGBA64{limit, limit, limit, 0xFFFF})
+			}
+		}
+		vignetteImage(im, strength)
+
+		center := im.NRGBA64At(b.Min.X+b.Dx()/2, b.Min.Y+b.Dy()/2).R
+		corner := im.NRGBA64At(b.Min.X, b.Min.Y).R
+		if strength > 0 && corner >= center {
+			t.Errorf("strength %v: corner %d isn't darker than the center %d",
+				strength, corner, center)
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if px := im.NRGBA64At(x, y); px.R > limit || px.G > limit || px.B > limit {
+					t.Fatalf("strength %v: pixel %d,%d is %v, over %d", strength, x, y, px, limit)
+				} else if strength == 0 && px.R != limit {
+					t.Fatalf("strength 0: pixel %d,%d is %v, want %d", x, y, px, limit)
+				}
+			}
+		}
+	}
+}
+
+// However dark the vignette, a compliant viewer still shows none of the Thumbnail.
+func TestVignetteDoesNotLeak(t *testing.T) {
+	thumbnail := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for i := range thumbnail.Pix {
+		thumbnail.Pix[i] = 0xFF
+	}
+	full := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for _, strength := range []float64{0.3, 1} {
+		opts := Options{Dither: true, ThumbnailVignette: strength}
+		muxed, ec := GammaMuxImagesOpts(thumbnail, full, opts)
+		if ec != nil {
+			t.Fatal(ec)
+		}
+		_, corrected := RenderInterpretations(muxed, opts)
+		for y := 0; y < 32; y++ {
+			for x := 0; x < 32; x++ {
+				if x%2 == 0 && y%2 == 0 {
+					continue
+				}
+				if px := corrected.NRGBAAt(x, y); px.R != 0 || px.G != 0 || px.B != 0 {
+					t.Fatalf("strength %v: Thumbnail pixel %d,%d shows as %v", strength, x, y, px)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,458 @@
+package internal
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"sort"
+
+	"golang.org/x/image/draw"
+)
+
+// WebP has no gamma chunk, so muxed WebP images declare the gamma in an ICC profile instead.  Only
+// viewers that honor ICC profiles in WebP images will show the Full image.
+
+const (
+	webpMaxSize = 1 << 14
+
+	// Alphabet sizes of the five prefix codes of a VP8L image without a color cache.
+	vp8lGreenSymbols    = 256 + 24
+	vp8lColorSymbols    = 256
+	vp8lDistanceSymbols = 40
+
+	vp8lMaxCodeLength           = 15
+	vp8lMaxCodeLengthCodeLength = 7
+)
+
+// The order code length code lengths are written in.
+var vp8lCodeLengthCodeOrder = [19]int{
+	17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+// Writes bits least significant first, as VP8L expects.
+type vp8lBitWriter struct {
+	buf   bytes.Buffer
+	bits  uint64
+	nbits uint
+}
+
+func (w *vp8lBitWriter) writeBits(v uint32, n uint) {
+	w.bits |= uint64(v) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf.WriteByte(byte(w.bits))
+		w.bits >>= 8
+		w.nbits -= 8
+	}
+}
+
+// Writes a prefix code, which is read one bit at a time starting from its most significant bit.
+func (w *vp8lBitWriter) writeCode(code uint32, length int) {
+	var reversed uint32
+	for i := 0; i < length; i++ {
+		reversed |= (code >> uint(i) & 1) << uint(length-1-i)
+	}
+	w.writeBits(reversed, uint(length))
+}
+
+func (w *vp8lBitWriter) flush() []byte {
+	if w.nbits > 0 {
+		w.buf.WriteByte(byte(w.bits))
+		w.bits, w.nbits = 0, 0
+	}
+	return w.buf.Bytes()
+}
+
+type huffmanNode struct {
+	freq   int
+	symbol int
+	left   *huffmanNode
+	right  *huffmanNode
+}
+
+type huffmanHeap []*huffmanNode
+
+func (h huffmanHeap) Len() int { return len(h) }
+func (h huffmanHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].symbol < h[j].symbol
+}
+func (h huffmanHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *huffmanHeap) Push(x interface{}) { *h = append(*h, x.(*huffmanNode)) }
+func (h *huffmanHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// Returns Huffman code lengths for freqs, none longer than maxLength.  Codes that would be too
+// long are avoided by flattening the frequencies until they fit.  At least two symbols always get
+// a length, so the code is complete.
+func huffmanLengths(freqs []int, maxLength int) []int {
+	freqs = append([]int(nil), freqs...)
+	var used int
+	for _, f := range freqs {
+		if f > 0 {
+			used++
+		}
+	}
+	for i := 0; used < 2; i++ {
+		if freqs[i] == 0 {
+			freqs[i] = 1
+			used++
+		}
+	}
+
+	for {
+		h := make(huffmanHeap, 0, used)
+		for sym, f := range freqs {
+			if f > 0 {
+				h = append(h, &huffmanNode{freq: f, symbol: sym})
+			}
+		}
+		heap.Init(&h)
+		for h.Len() > 1 {
+			a := heap.Pop(&h).(*huffmanNode)
+			b := heap.Pop(&h).(*huffmanNode)
+			heap.Push(&h, &huffmanNode{freq: a.freq + b.freq, symbol: a.symbol, left: a, right: b})
+		}
+
+		lengths := make([]int, len(freqs))
+		var maxSeen int
+		var walk func(n *huffmanNode, depth int)
+		walk = func(n *huffmanNode, depth int) {
+			if n.left == nil {
+				lengths[n.symbol] = depth
+				if depth > maxSeen {
+					maxSeen = depth
+				}
+				return
+			}
+			walk(n.left, depth+1)
+			walk(n.right, depth+1)
+		}
+		walk(h[0], 0)
+		if maxSeen <= maxLength {
+			return lengths
+		}
+		for i, f := range freqs {
+			if f > 0 {
+				freqs[i] = (f + 1) / 2
+			}
+		}
+	}
+}
+
+// Assigns canonical codes to lengths, shortest codes first, ties broken by symbol.
+func canonicalCodes(lengths []int) []uint32 {
+	symbols := make([]int, 0, len(lengths))
+	for sym, l := range lengths {
+		if l > 0 {
+			symbols = append(symbols, sym)
+		}
+	}
+	sort.SliceStable(symbols, func(i, j int) bool {
+		return lengths[symbols[i]] < lengths[symbols[j]]
+	})
+	codes := make([]uint32, len(lengths))
+	var code uint32
+	prevLength := 0
+	for _, sym := range symbols {
+		code <<= uint(lengths[sym] - prevLength)
+		prevLength = lengths[sym]
+		codes[sym] = code
+		code++
+	}
+	return codes
+}
+
+// A prefix code as written to a VP8L image.  Codes with one symbol use no bits at all.
+type vp8lPrefixCode struct {
+	lengths []int
+	codes   []uint32
+}
+
+func (c *vp8lPrefixCode) write(w *vp8lBitWriter, sym int) {
+	w.writeCode(c.codes[sym], c.lengths[sym])
+}
+
+// Builds a prefix code for freqs, and writes its description.
+func writePrefixCode(w *vp8lBitWriter, freqs []int) *vp8lPrefixCode {
+	var symbols []int
+	for sym, f := range freqs {
+		if f > 0 {
+			symbols = append(symbols, sym)
+		}
+	}
+	if len(symbols) == 0 {
+		symbols = append(symbols, 0)
+	}
+
+	if len(symbols) <= 2 && symbols[len(symbols)-1] < 256 {
+		// A simple code, with its one or two symbols written directly.
+		c := &vp8lPrefixCode{lengths: make([]int, len(freqs)), codes: make([]uint32, len(freqs))}
+		w.writeBits(1, 1)
+		w.writeBits(uint32(len(symbols)-1), 1)
+		w.writeBits(1, 1)
+		w.writeBits(uint32(symbols[0]), 8)
+		if len(symbols) == 2 {
+			w.writeBits(uint32(symbols[1]), 8)
+			c.lengths[symbols[0]], c.lengths[symbols[1]] = 1, 1
+			c.codes[symbols[1]] = 1
+		}
+		return c
+	}
+
+	lengths := huffmanLengths(freqs, vp8lMaxCodeLength)
+	codeLengthFreqs := make([]int, len(vp8lCodeLengthCodeOrder))
+	for _, l := range lengths {
+		codeLengthFreqs[l]++
+	}
+	codeLengthLengths := huffmanLengths(codeLengthFreqs, vp8lMaxCodeLengthCodeLength)
+	codeLengthCodes := canonicalCodes(codeLengthLengths)
+
+	numCodeLengths := len(vp8lCodeLengthCodeOrder)
+	for numCodeLengths > 4 && codeLengthLengths[vp8lCodeLengthCodeOrder[numCodeLengths-1]] == 0 {
+		numCodeLengths--
+	}
+	w.writeBits(0, 1)
+	w.writeBits(uint32(numCodeLengths-4), 4)
+	for _, sym := range vp8lCodeLengthCodeOrder[:numCodeLengths] {
+		w.writeBits(uint32(codeLengthLengths[sym]), 3)
+	}
+	// Every symbol's length follows, rather than stopping at a max symbol.
+	w.writeBits(0, 1)
+	for _, l := range lengths {
+		w.writeCode(codeLengthCodes[l], codeLengthLengths[l])
+	}
+	return &vp8lPrefixCode{lengths: lengths, codes: canonicalCodes(lengths)}
+}
+
+// Encodes im as a lossless VP8L bitstream, with every pixel written as a literal.
+func encodeVP8L(im *image.NRGBA) []byte {
+	b := im.Bounds()
+	green := make([]int, vp8lGreenSymbols)
+	red := make([]int, vp8lColorSymbols)
+	blue := make([]int, vp8lColorSymbols)
+	alpha := make([]int, vp8lColorSymbols)
+	opaque := true
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := im.NRGBAAt(x, y)
+			red[c.R]++
+			green[c.G]++
+			blue[c.B]++
+			alpha[c.A]++
+			opaque = opaque && c.A == 0xFF
+		}
+	}
+
+	w := new(vp8lBitWriter)
+	w.writeBits(0x2f, 8)
+	w.writeBits(uint32(b.Dx()-1), 14)
+	w.writeBits(uint32(b.Dy()-1), 14)
+	if opaque {
+		w.writeBits(0, 1)
+	} else {
+		w.writeBits(1, 1)
+	}
+	// Version
+	w.writeBits(0, 3)
+	// No transforms, no color cache, and one set of prefix codes for the whole image.
+	w.writeBits(0, 1)
+	w.writeBits(0, 1)
+	w.writeBits(0, 1)
+
+	greenCode := writePrefixCode(w, green)
+	redCode := writePrefixCode(w, red)
+	blueCode := writePrefixCode(w, blue)
+	alphaCode := writePrefixCode(w, alpha)
+	writePrefixCode(w, make([]int, vp8lDistanceSymbols))
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := im.NRGBAAt(x, y)
+			greenCode.write(w, int(c.G))
+			redCode.write(w, int(c.R))
+			blueCode.write(w, int(c.B))
+			alphaCode.write(w, int(c.A))
+		}
+	}
+	return w.flush()
+}
+
+func writeRiffChunk(w io.Writer, chunkType string, data []byte) error {
+	var header [8]byte
+	copy(header[:4], chunkType)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(data)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if len(data)%2 == 1 {
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes im as a lossless WebP image, with an ICC profile declaring gamma.
+func writeWebP(dest io.Writer, src image.Image, gamma float64) *ErrChain {
+	im := toNRGBA(src)
+	size := im.Bounds().Size()
+	if size.X < 1 || size.Y < 1 || size.X > webpMaxSize || size.Y > webpMaxSize {
+		return ChainErr(nil, fmt.Sprintf(
+			"WebP images must be between 1x1 and %dx%d, got %dx%d",
+			webpMaxSize, webpMaxSize, size.X, size.Y))
+	}
+	profile, err := iccProfile(gamma, false)
+	if err != nil {
+		return ChainErr(err, "Unable to build ICC profile")
+	}
+
+	// The extended header announces the ICC profile, which must come before the image data.
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x20
+	vp8x[4], vp8x[5], vp8x[6] = byte(size.X-1), byte((size.X-1)>>8), byte((size.X-1)>>16)
+	vp8x[7], vp8x[8], vp8x[9] = byte(size.Y-1), byte((size.Y-1)>>8), byte((size.Y-1)>>16)
+
+	var chunks bytes.Buffer
+	chunks.WriteString("WEBP")
+	if err := writeRiffChunk(&chunks, "VP8X", vp8x); err != nil {
+		return ChainErr(err, "Unable to write WebP VP8X chunk")
+	}
+	if err := writeRiffChunk(&chunks, "ICCP", profile); err != nil {
+		return ChainErr(err, "Unable to write WebP ICCP chunk")
+	}
+	if err := writeRiffChunk(&chunks, "VP8L", encodeVP8L(im)); err != nil {
+		return ChainErr(err, "Unable to write WebP VP8L chunk")
+	}
+	if err := writeRiffChunk(dest, "RIFF", chunks.Bytes()); err != nil {
+		return ChainErr(err, "Unable to write WebP")
+	}
+	return nil
+}
+
+// Animated WebP images keep their frames in ANMF chunks, which the x/image decoder doesn't read.
+// An animated image is decoded as its first frame, placed on the canvas.
+func decodeWebPFirstFrame(data []byte) (image.Image, error) {
+	if len(data) < 30 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" ||
+		string(data[12:16]) != "VP8X" {
+		return nil, fmt.Errorf("webp: not an extended WebP image")
+	}
+	canvas := image.Rect(0, 0, int(get24(data[24:]))+1, int(get24(data[27:]))+1)
+	for chunks := data[12:]; len(chunks) >= 8; {
+		id := string(chunks[:4])
+		size := int(binary.LittleEndian.Uint32(chunks[4:8]))
+		if size > len(chunks)-8 {
+			break
+		}
+		payload := chunks[8 : 8+size]
+		chunks = chunks[8+size+size%2:]
+		if id != "ANMF" || len(payload) < 16 {
+			continue
+		}
+
+		frame, err := webpFrameImage(payload[16:])
+		if err != nil {
+			return nil, err
+		}
+		fim, _, err := image.Decode(bytes.NewReader(frame))
+		if err != nil {
+			return nil, err
+		}
+		// Frame offsets are stored halved.
+		offset := image.Pt(2*int(get24(payload[0:])), 2*int(get24(payload[3:])))
+		dst := image.NewNRGBA(canvas)
+		draw.Draw(dst, fim.Bounds().Sub(fim.Bounds().Min).Add(offset), fim, fim.Bounds().Min,
+			draw.Src)
+		return dst, nil
+	}
+	return nil, fmt.Errorf("webp: animated image has no frames")
+}
+
+// Wraps the chunks of one ANMF frame as a standalone WebP image.
+func webpFrameImage(chunks []byte) ([]byte, error) {
+	var alph, bitstream []byte
+	var bitstreamID string
+	var width, height int
+	for len(chunks) >= 8 {
+		id := string(chunks[:4])
+		size := int(binary.LittleEndian.Uint32(chunks[4:8]))
+		if size > len(chunks)-8 {
+			break
+		}
+		payload := chunks[8 : 8+size]
+		chunks = chunks[8+size+size%2:]
+		switch id {
+		case "ALPH":
+			alph = payload
+		case "VP8 ":
+			if len(payload) < 10 {
+				return nil, fmt.Errorf("webp: short VP8 frame")
+			}
+			bitstream, bitstreamID = payload, id
+			width = int(binary.LittleEndian.Uint16(payload[6:])) & 0x3fff
+			height = int(binary.LittleEndian.Uint16(payload[8:])) & 0x3fff
+		case "VP8L":
+			if len(payload) < 5 {
+				return nil, fmt.Errorf("webp: short VP8L frame")
+			}
+			bitstream, bitstreamID = payload, id
+			bits := binary.LittleEndian.Uint32(payload[1:])
+			width, height = int(bits&0x3fff)+1, int(bits>>14&0x3fff)+1
+		}
+	}
+	if bitstream == nil {
+		return nil, fmt.Errorf("webp: animation frame has no image data")
+	}
+
+	var out bytes.Buffer
+	out.WriteString("WEBP")
+	// Lossy frames keep their transparency in a separate ALPH chunk, which needs an extended
+	// header.
+	if alph != nil && bitstreamID == "VP8 " {
+		vp8x := make([]byte, 10)
+		vp8x[0] = 0x10
+		put24(vp8x[4:], uint32(width-1))
+		put24(vp8x[7:], uint32(height-1))
+		if err := writeRiffChunk(&out, "VP8X", vp8x); err != nil {
+			return nil, err
+		}
+		if err := writeRiffChunk(&out, "ALPH", alph); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeRiffChunk(&out, bitstreamID, bitstream); err != nil {
+		return nil, err
+	}
+	var riff bytes.Buffer
+	if err := writeRiffChunk(&riff, "RIFF", out.Bytes()); err != nil {
+		return nil, err
+	}
+	return riff.Bytes(), nil
+}
+
+func get24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func put24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// Reports whether data starts like an animated WebP image.
+func isAnimatedWebP(data []byte) bool {
+	const animationBit = 0x02
+	return len(data) >= 21 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP" &&
+		string(data[12:16]) == "VP8X" && data[20]&animationBit != 0
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestWebPRoundTrip(t *testing.T) {
+	fill := func(w, h int, at func(x, y int) color.NRGBA) *image.NRGBA {
+		im := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				im.SetNRGBA(x, y, at(x, y))
+			}
+		}
+		return im
+	}
+	rnd := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name string
+		im   *image.NRGBA
+	}{
+		// Every channel has one symbol, which takes no bits per pixel.
+		{"one pixel", fill(1, 1, func(x, y int) color.NRGBA {
+			return color.NRGBA{0x12, 0x34, 0x56, 0xFF}
+		})},
+		{"one color", fill(5, 3, func(x, y int) color.NRGBA {
+			return color.NRGBA{0xFF, 0, 0x80, 0xFF}
+		})},
+		// Every channel has two symbols, which take one bit each.
+		{"two colors", fill(7, 5, func(x, y int) color.NRGBA {
+			if (x+y)%2 == 0 {
+				return color.NRGBA{0, 0, 0, 0xFF}
+			}
+			return color.NRGBA{0xFF, 0xFF, 0xFF, 0xFF}
+		})},
+		// Only some channels have two symbols.
+		{"two greens", fill(4, 4, func(x, y int) color.NRGBA {
+			return color.NRGBA{0x40, uint8(x % 2 * 0xFF), 0x40, 0xFF}
+		})},
+		{"translucent", fill(16, 16, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x * 16), uint8(y * 16), 0x80, uint8(x*16 + y)}
+		})},
+		{"transparent", fill(3, 3, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x), uint8(y), 0, 0}
+		})},
+		{"noise", fill(37, 29, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)),
+				uint8(rnd.Intn(256))}
+		})},
+		// A few rare values among a common one, which get long codes.
+		{"skewed", fill(300, 300, func(x, y int) color.NRGBA {
+			v := uint8(0)
+			if i := y*300 + x; i%4096 == 0 {
+				v = uint8(i / 4096)
+			}
+			return color.NRGBA{v, v, v, 0xFF}
+		})},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if ec := writeWebP(&buf, tt.im, DefaultTargetGamma); ec != nil {
+			t.Errorf("%s: %v", tt.name, ec)
+			continue
+		}
+		got, err := webp.Decode(&buf)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got.Bounds() != tt.im.Bounds() {
+			t.Errorf("%s: bounds %v, want %v", tt.name, got.Bounds(), tt.im.Bounds())
+			continue
+		}
+	pixels:
+		for y := 0; y < tt.im.Rect.Dy(); y++ {
+			for x := 0; x < tt.im.Rect.Dx(); x++ {
+				want := tt.im.NRGBAAt(x, y)
+				if c := color.NRGBAModel.Convert(got.At(x, y)); c != want {
+					t.Errorf("%s: pixel %d,%d = %v, want %v", tt.name, x, y, c, want)
+					break pixels
+				}
+			}
+		}
+	}
+}
+
+func TestHuffmanLengthsLimit(t *testing.T) {
+	// Fibonacci frequencies make the deepest unlimited Huffman trees.
+	freqs := make([]int, 30)
+	a, b := 1, 1
+	for i := range freqs {
+		freqs[i] = a
+		a, b = b, a+b
+	}
+	lengths := huffmanLengths(freqs, 15)
+	kraft := 0.0
+	for sym, l := range lengths {
+		if l > 15 {
+			t.Errorf("symbol %d has length %d, over 15", sym, l)
+		}
+		if l > 0 {
+			kraft += 1 / float64(uint(1)<<uint(l))
+		}
+	}
+	if kraft > 1 {
+		t.Errorf("lengths %v aren't a prefix code", lengths)
+	}
+}
@@ -1,95 +1,539 @@
 package main
 
 import (
-	"bytes"
+	"encoding/json"
+	"expvar"
 	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
-	"./internal"
+	"github.com/carl-mastrangelo/gammux/internal"
+	"github.com/carl-mastrangelo/gammux/web"
+	"golang.org/x/image/draw"
 )
 
 var (
-	stretch = flag.Bool("stretch", true, "If true, stretches the Full(back) image to fit the"+
-		" Thumbnail(front) image.  If false, the Full image will be scaled proportionally to fit"+
-		" and centered.")
+	stretch = stretchFlag(1)
 
 	dither = flag.Bool("dither", true, "If true, dithers the Full(back) image to hide banding."+
 		"  Use if the Full image doesn't contain text nor is already using few colors"+
 		" (such as comics).")
 
-	thumbnail   = flag.String("thumbnail", "", "The file path of the Thumbnail(front) image")
-	full        = flag.String("full", "", "The file path of the Full(back) image")
-	dest        = flag.String("dest", "", "The dest file path of the PNG image")
+	ditherchannels = flag.String("dither-channels", "", "If set, only dithers these channels of"+
+		" the Full(back) image, such as g or rg.  The rest are rounded, which can look cleaner"+
+		" than color noise.  Defaults to all of them.")
+
+	ditheralgorithm = flag.String("dither-algorithm", "floyd-steinberg", "How to dither the"+
+		" Full(back) image: floyd-steinberg, atkinson, sierra, ordered, or none.  Atkinson keeps"+
+		" details cleaner, and ordered uses a fixed pattern that tiles.")
+
+	serpentine = flag.Bool("serpentine", false, "If true, dithers every other row of the"+
+		" Full(back) image right to left, which avoids diagonal streaks in smooth gradients.")
+
+	autogray = flag.Bool("auto-gray", false, "If true, writes a grayscale PNG when the muxed"+
+		" image has no color, such as when both the Thumbnail and Full images are grayscale.")
+
+	autopalette = flag.Bool("auto-palette", false, "If true, writes a paletted PNG when the muxed"+
+		" image has at most 256 colors.")
+
+	verify = flag.Bool("verify", false, "If true, decodes the dest PNG before writing it, and"+
+		" fails if it isn't a valid PNG of the right size with the gamma declared.")
+
+	strict = flag.Bool("strict", false, "If true, fails with a nonzero exit on any warning, rather"+
+		" than logging it.  Warnings are: a Thumbnail or Full image whose transparency doesn't"+
+		" look like -alpha-mode.")
+
+	colortype = flag.String("color-type", "", "If set, forces the output PNG color type, one of"+
+		" gray, grayalpha, rgb, rgba, or palette.  It is an error if the muxed image can't be"+
+		" represented, except that palette is skipped with -auto-palette.")
+
+	compression = flag.String("compression", "default", "The zlib compression of the dest PNG:"+
+		" default, none, speed, or best.  Best makes the smallest files, and speed is the"+
+		" fastest.")
+
+	targetgamma = flag.Float64("target-gamma", internal.DefaultTargetGamma, "The gamma declared in"+
+		" the dest image.  Higher values hide the Thumbnail(front) image better in viewers that"+
+		" honor gamma, but leave the Full(back) image fewer levels.")
+
+	sourcegamma = flag.Float64("source-gamma", 0, "The gamma the Full(back) image is encoded with."+
+		"  Defaults to the gamma declared by a PNG Full image, or else 2.2, the sRGB gamma.  Use"+
+		" 1 for linear images.")
+
+	minpixel = flag.Float64("min-pixel", internal.DefaultMinPixel, "The darkest linear value, between"+
+		" 0 and 1, a Full(back) pixel is clamped to.  Higher values reduce the black mesh in dark"+
+		" areas, but make blacks brighter.")
+
+	robustlattice = flag.Bool("robust-lattice", false, "If true, draws the muxed pattern in 2x2"+
+		" blocks so it survives sites that downscale by half.  Both images lose half their"+
+		" resolution, and the output compresses less well.")
+
+	embedicc = flag.Bool("embed-icc", false, "If true, also embeds an ICC profile declaring the"+
+		" gamma, for viewers that ignore the PNG gamma.  Viewers that honor both will use the ICC"+
+		" profile.")
+
+	attribution = flag.Bool("attribution", false, "If true, notes in tEXt chunks of the dest PNG"+
+		" that it was made by gammux, and the target gamma used.")
+
+	withfallback = flag.Bool("with-fallback", false, "If true, also writes the Full(back) image as"+
+		" a plain JPEG next to the dest file, for sharing where gamma may not be honored.")
+
+	maxdecodetime = flag.Duration("max-decode-time", 0, "If positive, gives up on input images"+
+		" that take longer than this to decode, such as decompression bombs.")
+	maxpixels = flag.Int("max-pixels", 0, "If positive, rejects input images with more pixels"+
+		" than this, before decoding them.")
+
+	timing  = flag.Bool("timing", false, "If true, prints how long each stage of muxing took.")
+	jsonout = flag.Bool("json", false, "If true, prints -timing and -layout output, and"+
+		" errors, as JSON.")
+
+	printlayout = flag.Bool("layout", false, "If true, prints where the Full(back) image was"+
+		" placed in the dest image.")
+
+	alphathreshold = flag.Uint("alpha-threshold", 0, "If set, pixels with alpha, from 0 to 255,"+
+		" below this become the background, and the rest become fully opaque.  Use for crisp"+
+		" edges instead of blending.")
+
+	htmlsnippet = flag.String("html-snippet", "", "If set, also writes an HTML snippet to this"+
+		" file path that shows the Full(back) image in any browser with JavaScript and canvas.")
+
+	printoptimize = flag.Int("print-optimize", 0, "Experimental.  If set, the DPI the dest"+
+		" image will be printed at.  The image is enlarged so each pixel is a whole number of"+
+		" printer dots at about its on screen size, and the DPI is written into it.")
+
+	flipapng = flag.String("flip-apng", "", "If set, also writes an animated PNG to this file"+
+		" path that flips between the Thumbnail(front) and Full(back) images, as viewers that"+
+		" ignore or honor gamma show them.  Any viewer with APNG support shows both.")
+
+	flipdelay = flag.Duration("flip-delay", time.Second, "How long -flip-apng shows each image.")
+
+	demoout = flag.String("demo-out", "", "If set, also writes a self contained HTML page to this"+
+		" file path that switches between the Thumbnail(front) and Full(back) images on hover or"+
+		" click, the way viewers that ignore or honor gamma would show them.")
+
+	svgout = flag.String("svg-out", "", "If set, also writes an SVG to this file path that shows"+
+		" the Full(back) image in any browser supporting SVG filters.")
+
+	comparerenderers = flag.String("compare-renderers", "", "If set, a comma separated list of"+
+		" gammas, such as 1.0,1.8,2.2,2.4, to decode the dest image with.  Prints which image"+
+		" each one mostly shows.")
+
+	precision = flag.Int("precision", 16, "The bits per channel, 8 or 16, of intermediate images."+
+		"  8 uses half the memory, but can cause banding in dark areas.")
+
+	bitdepth = flag.Int("bit-depth", 8, "The bits per channel, 8 or 16, of the dest image.  16"+
+		" gives smoother gradients, but doubles the file size, and only works for plain PNGs.")
+
+	ditherseed = flag.String("dither-seed", "", "The file path of an image, half the size of the"+
+		" Thumbnail(front) image, used to bias the dithering of the Full(back) image.  Mid gray"+
+		" has no effect.")
+
+	previewout = flag.String("preview-out", "", "If set, also writes how a gamma aware viewer"+
+		" shows the dest image to this file path, to compare against the target site.")
+	naivepreviewout = flag.String("naive-preview-out", "", "If set, also writes how a viewer that"+
+		" ignores gamma shows the dest image, shrunk by half, to this file path.")
+
+	thumbnailopacity = flag.Float64("thumbnail-opacity", 1, "How opaque, from 0 to 1, the"+
+		" Thumbnail(front) image is where gamma is ignored.  Lower values let the Full(back) image"+
+		" show through as a ghost, making the Thumbnail stand out less.")
+
+	thumbcrop = flag.String("thumb-crop", "", "If set, crops the Thumbnail(front) image to x,y,w,h"+
+		" before muxing.")
+	fullcrop = flag.String("full-crop", "", "If set, crops the Full(back) image to x,y,w,h before"+
+		" muxing.")
+
+	maxfilesize = flag.String("max-filesize", "", "If set, the largest dest PNG allowed, such as"+
+		" 8MB.  Bigger outputs are retried with better compression, then a palette, then a"+
+		" smaller Thumbnail(front) image, until they fit.")
+
+	thumbvignette = flag.Float64("thumb-vignette", 0, "If positive, darkens the Thumbnail(front)"+
+		" image towards its corners, removing up to this fraction of the light, between 0 and 1."+
+		"  The Full(back) image is unaffected.")
+
+	fastgamma = flag.Bool("fast-gamma", false, "If true, approximates the gamma math of the"+
+		" Full(back) image with tables.  It is faster where floating point powers are slow, but"+
+		" a few pixels may be off by one step.")
+
+	denoise = flag.Int("denoise", 0, "If positive, blurs the Full(back) image by this many pixels"+
+		" before muxing.  Use for noisy photos, whose noise otherwise shows up as speckle.")
+
+	thumbfromfull = flag.Bool("thumbnail-from-full", false, "If true, makes the Thumbnail(front)"+
+		" image from the Full(back) image, as a blurry teaser of it, so only -full is needed.")
+	thumbscale = flag.Float64("thumb-scale", 0.05, "How much, from 0 to 1, -thumbnail-from-full"+
+		" shrinks the Full(back) image before blowing it back up.  Smaller is blurrier.")
+
+	watch = flag.Bool("watch", false, "If true, keeps running, and writes the dest image again"+
+		" whenever the Thumbnail(front) or Full(back) image file changes.")
+
+	format = flag.String("format", "png", "The format of the dest image, png or webp.  WebP has"+
+		" no gamma, so the gamma is declared in an ICC profile, which fewer viewers honor.")
+
+	cover = flag.Bool("cover", false, "If true, scales the Full(back) image to fill the"+
+		" Thumbnail(front) image, cropping what doesn't fit, rather than stretching or"+
+		" letterboxing it.  -align picks which part is kept.")
+	align = flag.String("align", "center", "Where the Full(back) image sits when it doesn't fill"+
+		" the Thumbnail(front) image: center, top, bottom, left, right, or a corner such as"+
+		" top-left.")
+	latticecorner = flag.String("lattice-corner", "tl", "Which pixel of each 2x2 block holds the"+
+		" Full(back) image: tl, tr, bl, or br.  Try another if a site shows the wrong image.")
+
+	fullscaling = flag.Int("full-scaling", 2, "How many pixels wide and tall each block holding"+
+		" one Full(back) image pixel is.  Bigger blocks survive sites that downscale harder, but"+
+		" leave the Full(back) image less resolution.  Must be at least 2.")
+
+	animatethumbnail = flag.Bool("animate-thumbnail", false, "If true, and the Thumbnail(front)"+
+		" image is an animated GIF or APNG, muxes every frame with the still Full(back) image into"+
+		" an APNG.")
+
+	fullframe = flag.Int("full-frame", 0, "Which frame of an animated GIF Full(back) image to use,"+
+		" counting from 0.  Frames that don't exist fall back to the first.")
+
+	scaler = flag.String("scaler", "catmullrom", "The filter that resamples the Full(back) image:"+
+		" catmullrom, bilinear, approxbilinear, or nearest.  Use nearest for pixel art and comics,"+
+		" where catmullrom rings around hard edges.")
+
+	aspect = flag.String("aspect", "", "If set, crops the middle of both images to this aspect"+
+		" ratio, such as 16:9, so they line up without letterboxing or distortion.")
+
+	feather = flag.Int("feather", 0, "If positive, fades the edges of the Full(back) image into"+
+		" the letterbox over this many pixels, when it isn't fully stretched.")
+
+	debugchannels = flag.String("debug-channels", "", "If set, also writes the red, green, and"+
+		" blue channels of the dest image as gray images into this dir, to debug color fringes.")
+
+	background = flag.String("background", "", "If set, the color, such as #000000 or"+
+		" transparent, that the Full(back) image shows around it where it doesn't fill the"+
+		" Thumbnail(front) image.  The Thumbnail image is hidden there too.")
+	preservealpha = flag.Bool("preserve-alpha", false, "If true, the dest image keeps the"+
+		" transparency of the Thumbnail(front) image, such as for stickers, rather than being"+
+		" opaque.")
+	alphamode = flag.String("alpha-mode", "straight", "How the alpha of the input images is"+
+		" stored, straight or premultiplied.  Use premultiplied if translucent areas come out too"+
+		" dark.")
+
+	configfile = flag.String("config", "", "The file path of a JSON object of default flag"+
+		" values, such as {\"dither\": false}.  Flags on the command line take precedence."+
+		"  Defaults to "+defaultConfigFile+", if it exists.")
+
+	explain = flag.Bool("explain", false, "If true, prints the gamma values used for muxing.")
+
+	thumbnailtext = flag.String("thumbnail-text", "", "If set, uses this text, drawn onto a canvas"+
+		" the size of the Full(back) image, as the Thumbnail(front) image.")
+	thumbfont = flag.String("thumb-font", "", "The file path of a TrueType or OpenType font for"+
+		" -thumbnail-text.  If unset or unreadable, a basic bundled font is used.")
+	thumbsize = flag.Float64("thumb-size", 48, "The size in pixels of the -thumbnail-text font.")
+
+	parallelpairs = flag.Bool("parallel-pairs", false, "If true, muxes -tile-pairs at the same"+
+		" time, within -mem-budget.")
+	membudget = flag.String("mem-budget", "1GB", "The estimated memory, such as 512MB, that"+
+		" -parallel-pairs and -batch may use at once.  Pairs wait their turn beyond this.")
+	batch = flag.String("batch", "", "If set, a directory of image pairs to mux, such as"+
+		" name.thumb.png and name.full.png, each into name.muxed.png.  Failed pairs are reported"+
+		" at the end, rather than stopping the rest.")
+	batchthumbsuffix = flag.String("batch-thumb-suffix", ".thumb.png", "The end of the names of"+
+		" the Thumbnail(front) images of -batch")
+	batchfullsuffix = flag.String("batch-full-suffix", ".full.png", "The end of the names of the"+
+		" Full(back) images of -batch")
+	batchworkers = flag.Int("batch-workers", runtime.NumCPU(), "How many -batch pairs to mux at"+
+		" the same time")
+	tilepairs = flag.Bool("tile-pairs", false, "If true, muxes each Thumbnail and Full file path"+
+		" pair given as arguments, and tiles them left to right into the dest image.")
+
+	thumbnail = flag.String(
+		"thumbnail", "", "The file path of the Thumbnail(front) image, or - for stdin")
+	full        = flag.String("full", "", "The file path of the Full(back) image, or - for stdin")
+	dest        = flag.String("dest", "", "The dest file path of the PNG image, or - for stdout")
 	webfallback = flag.Bool(
-		"webfallback", true, "If true, enable a web UI fallback at http://localhost:8080/")
+		"webfallback", true, "If true, enable a web UI fallback at -addr")
+	addr = flag.String("addr", "localhost:8080", "The host and port the web UI listens on.  Use"+
+		" 0.0.0.0:8080 to accept connections from other machines.")
+
+	cachesize = flag.Int("cache-size", 0, "If positive, the web UI keeps this many recent"+
+		" outputs, and reuses them for repeated requests.")
+	maxupload = flag.String("max-upload", "25MB", "The largest upload, such as 25MB, that the web"+
+		" UI accepts.  Bigger uploads are refused.")
 )
 
 func runHttpServer() {
-	http.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet {
-			w.Write([]byte(`
-      <!doctype html>
-      <html>
-      <head>
-        <meta charset="utf-8">
-        <title>Gammux - Gamma Muxer</title>
-      </head>
-      <body>
-      <h1>Gammux - Gamma Muxer</h1>
-      <fieldset>
-        <form action="/" method="post" enctype="multipart/form-data">
-          <dl>
-            <dt style="display:inline-block">Thumbnail Image</dt>
-            <dd style="display:inline-block"><input type="file" name="thumbnail" /></dd>
-          </dl>
-          <dl>
-            <dt style="display:inline-block">Full Image</dt>
-            <dd style="display:inline-block"><input type="file" name="full" /></dd>
-          </dl>
-          <input type="submit" value="Submit" />
-        </form>
-      </fieldset>
-      </body>
-      </html>
-      `))
-			return
+	if *cachesize > 0 {
+		resultCache = internal.NewCache(*cachesize)
+		// Served with the other expvars at /debug/vars.
+		expvar.Publish("cache_hits", expvar.Func(func() interface{} {
+			hits, _ := resultCache.Stats()
+			return hits
+		}))
+		expvar.Publish("cache_misses", expvar.Func(func() interface{} {
+			_, misses := resultCache.Stats()
+			return misses
+		}))
+	}
+	http.Handle("/", web.NewHandler(options(), maxUpload, resultCache))
+	log.Println("Open up your Web Browser to: http://" + *addr + "/")
+	log.Println(http.ListenAndServe(*addr, nil))
+	os.Exit(1)
+}
+
+// stretchFlag is how far to stretch, from 0 to 1.  It also accepts true and false, so -stretch
+// still works as a bool flag.
+type stretchFlag float64
+
+func (s *stretchFlag) String() string {
+	return strconv.FormatFloat(float64(*s), 'g', -1, 64)
+}
+
+func (s *stretchFlag) Set(v string) error {
+	if b, err := strconv.ParseBool(v); err == nil {
+		if b {
+			*s = 1
+		} else {
+			*s = 0
 		}
-		thumbnail, _, err := r.FormFile("thumbnail")
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return err
+	}
+	if f < 0 || f > 1 || math.IsNaN(f) {
+		return fmt.Errorf("stretch %v must be between 0 and 1", f)
+	}
+	*s = stretchFlag(f)
+	return nil
+}
+
+func (s *stretchFlag) IsBoolFlag() bool {
+	return true
+}
+
+func init() {
+	flag.Var(&stretch, "stretch", "If true, stretches the Full(back) image to fit the"+
+		" Thumbnail(front) image.  If false, the Full image will be scaled proportionally to fit"+
+		" and placed by -align.  A number between 0 and 1 stretches part way.  Since -stretch"+
+		" alone means true, numbers and false must be given after =, as in -stretch=0.5.")
+}
+
+// textFlag collects key=value pairs, from each time the flag is given.
+type textFlag map[string]string
+
+func (t *textFlag) String() string {
+	pairs := make([]string, 0, len(*t))
+	for k, v := range *t {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (t *textFlag) Set(v string) error {
+	i := strings.IndexByte(v, '=')
+	if i < 0 {
+		return fmt.Errorf("text %q must be key=value", v)
+	}
+	if *t == nil {
+		*t = make(textFlag)
+	}
+	(*t)[v[:i]] = v[i+1:]
+	return nil
+}
+
+var text textFlag
+
+func init() {
+	flag.Var(&text, "text", "A key=value pair written to the dest PNG in a tEXt chunk, such as"+
+		" -text Author=me.  May be given more than once.")
+}
+
+// Returns the tEXt chunks to write, with -attribution filling in keys not given with -text.
+func pngText() map[string]string {
+	if !*attribution {
+		return text
+	}
+	all := internal.AttributionText(*targetgamma)
+	for k, v := range text {
+		all[k] = v
+	}
+	return all
+}
+
+var (
+	resultCache     *internal.Cache
+	maxFileSize     int64
+	maxUpload       int64
+	memoryBudget    int64
+	timings         *internal.Timings
+	layout          *internal.Layout
+	ditherSeedImage image.Image
+	thumbCropRect   image.Rectangle
+	aspectRatio     image.Point
+	fullScaler      draw.Scaler
+	backgroundColor color.Color
+	pngCompression  png.CompressionLevel
+	fullCropRect    image.Rectangle
+)
+
+func loadDitherSeed(path string) (image.Image, *internal.ErrChain) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, internal.ChainErr(err, "Unable to open dither seed file")
+	}
+	defer f.Close()
+	im, _, err := image.Decode(f)
+	if err != nil {
+		return nil, internal.ChainErr(err, "Unable to decode dither seed")
+	}
+	return im, nil
+}
+
+func options() internal.Options {
+	return internal.Options{
+		Dither:            *dither,
+		DitherChannels:    *ditherchannels,
+		DitherAlgorithm:   *ditheralgorithm,
+		Serpentine:        *serpentine,
+		StretchAmount:     float64(stretch),
+		AutoGray:          *autogray,
+		AutoPalette:       *autopalette,
+		Strict:            *strict,
+		Verify:            *verify,
+		ColorType:         *colortype,
+		CompressionLevel:  pngCompression,
+		PrintDPI:          *printoptimize,
+		TargetGamma:       *targetgamma,
+		SourceGamma:       *sourcegamma,
+		MinPixel:          *minpixel,
+		RobustLattice:     *robustlattice,
+		EmbedICC:          *embedicc,
+		Text:              pngText(),
+		MaxDecodeTime:     *maxdecodetime,
+		MaxPixels:         *maxpixels,
+		AlphaThreshold:    uint8(*alphathreshold),
+		PreserveAlpha:     *preservealpha,
+		Background:        backgroundColor,
+		Precision:         *precision,
+		BitDepth:          *bitdepth,
+		DitherSeed:        ditherSeedImage,
+		FullGhosting:      1 - *thumbnailopacity,
+		ThumbnailCrop:     thumbCropRect,
+		FullCrop:          fullCropRect,
+		Aspect:            aspectRatio,
+		Scaler:            fullScaler,
+		FullScaling:       *fullscaling,
+		Feather:           *feather,
+		AlphaMode:         *alphamode,
+		MaxFileSize:       maxFileSize,
+		MemoryBudget:      memoryBudget,
+		Timings:           timings,
+		Denoise:           *denoise,
+		FastGamma:         *fastgamma,
+		ThumbnailVignette: *thumbvignette,
+		Format:            *format,
+		LatticeCorner:     *latticecorner,
+		Align:             *align,
+		Cover:             *cover,
+		AnimateThumbnail:  *animatethumbnail,
+		FullFrame:         *fullframe,
+		Layout:            layout,
+	}
+}
+
+// Muxes the images at the thumbnail and full paths into dest.  Either input may be "-" for
+// stdin, and dest may be "-" for stdout.
+func GammaMuxFiles(thumbnail, full, dest string, opts internal.Options) *internal.ErrChain {
+	if thumbnail == "-" && full == "-" {
+		return internal.ChainErr(nil, "Only one of the thumbnail and full files can be stdin")
+	}
+	var tf io.Reader = os.Stdin
+	if thumbnail != "-" {
+		f, err := os.Open(thumbnail)
 		if err != nil {
-			log.Println(err)
-			http.Error(w, "Problem reading thumbnail "+err.Error(), http.StatusBadRequest)
-			return
+			return internal.ChainErr(err, "Unable to open thumbnail file")
 		}
-		full, _, err := r.FormFile("full")
+		defer f.Close()
+		tf = f
+	}
+
+	var ff io.Reader = os.Stdin
+	if full != "-" {
+		f, err := os.Open(full)
 		if err != nil {
-			log.Println(err)
-			http.Error(w, "Problem reading full "+err.Error(), http.StatusBadRequest)
-			return
+			return internal.ChainErr(err, "Unable to open full file")
 		}
-		var dest bytes.Buffer
-		if ec := internal.GammaMuxData(thumbnail, full, &dest, *dither, *stretch); ec != nil {
-			log.Println(ec)
-			http.Error(w, "Problem making image "+ec.Error(), http.StatusBadRequest)
-			return
+		defer f.Close()
+		ff = f
+	}
+
+	var df io.Writer = os.Stdout
+	if dest != "-" {
+		f, err := os.Create(dest)
+		if err != nil {
+			return internal.ChainErr(err, "Unable create dest file")
 		}
-		w.Header().Set("Content-Type", "image/png")
-		w.Header().Set("Content-Disposition", "attachment; filename=\"merged.png\"")
-		w.Write(dest.Bytes())
-	}))
-	log.Println("Open up your Web Browser to: http://localhost:8080/")
-	log.Println(http.ListenAndServe("localhost:8080", nil))
-	os.Exit(1)
+		defer f.Close()
+		df = f
+	}
+
+	return internal.GammaMuxDataOpts(tf, ff, df, opts)
+}
+
+// Returns the fallback path for dest, e.g. out.png becomes out.fallback.jpg
+func fallbackPath(dest string) string {
+	return strings.TrimSuffix(dest, filepath.Ext(dest)) + ".fallback.jpg"
+}
+
+func GammaFallbackFiles(full, dest string) *internal.ErrChain {
+	ff, err := os.Open(full)
+	if err != nil {
+		return internal.ChainErr(err, "Unable to open full file")
+	}
+	defer ff.Close()
+
+	df, err := os.Create(dest)
+	if err != nil {
+		return internal.ChainErr(err, "Unable create fallback file")
+	}
+	defer df.Close()
+
+	return internal.GammaFallbackData(ff, df)
 }
 
-func GammaMuxFiles(thumbnail, full, dest string, dither, stretch bool) *internal.ErrChain {
-	tf, err := os.Open(thumbnail)
+func GammaMuxTextFiles(text, full, dest string, opts internal.Options) *internal.ErrChain {
+	face, scale := internal.BasicFace, int(math.Max(1, math.Round(*thumbsize/13)))
+	if *thumbfont != "" {
+		if f, ec := internal.LoadFace(*thumbfont, *thumbsize); ec != nil {
+			log.Println("Falling back to basic font:", ec)
+		} else {
+			face, scale = f, 1
+		}
+	}
+
+	ff, err := os.Open(full)
+	if err != nil {
+		return internal.ChainErr(err, "Unable to open full file")
+	}
+	defer ff.Close()
+
+	df, err := os.Create(dest)
 	if err != nil {
-		return internal.ChainErr(err, "Unable to open thumbnail file")
+		return internal.ChainErr(err, "Unable create dest file")
 	}
-	defer tf.Close()
+	defer df.Close()
 
+	return internal.GammaMuxTextData(text, face, scale, ff, df, opts)
+}
+
+func GammaMuxFromFullFiles(full, dest string, opts internal.Options) *internal.ErrChain {
 	ff, err := os.Open(full)
 	if err != nil {
 		return internal.ChainErr(err, "Unable to open full file")
@@ -102,16 +546,412 @@ func GammaMuxFiles(thumbnail, full, dest string, dither, stretch bool) *internal
 	}
 	defer df.Close()
 
-	return internal.GammaMuxData(tf, ff, df, dither, stretch)
+	return internal.GammaMuxFromFullData(ff, df, *thumbscale, opts)
+}
+
+func GammaMuxTileFiles(pairs []string, dest string, opts internal.Options) *internal.ErrChain {
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return internal.ChainErr(nil, "Expected Thumbnail and Full file path pairs")
+	}
+	var thumbnails, fulls []io.Reader
+	for i, path := range pairs {
+		f, err := os.Open(path)
+		if err != nil {
+			return internal.ChainErr(err, "Unable to open "+path)
+		}
+		defer f.Close()
+		if i%2 == 0 {
+			thumbnails = append(thumbnails, f)
+		} else {
+			fulls = append(fulls, f)
+		}
+	}
+
+	df, err := os.Create(dest)
+	if err != nil {
+		return internal.ChainErr(err, "Unable create dest file")
+	}
+	defer df.Close()
+
+	return internal.GammaMuxTilesData(thumbnails, fulls, df, opts)
+}
+
+func HTMLSnippetFile(muxed, dest string) *internal.ErrChain {
+	mf, err := os.Open(muxed)
+	if err != nil {
+		return internal.ChainErr(err, "Unable to open muxed file")
+	}
+	defer mf.Close()
+
+	df, err := os.Create(dest)
+	if err != nil {
+		return internal.ChainErr(err, "Unable create HTML snippet file")
+	}
+	defer df.Close()
+
+	return internal.WriteHTMLSnippet(mf, df)
+}
+
+func DemoFile(muxed, dest string) *internal.ErrChain {
+	mf, err := os.Open(muxed)
+	if err != nil {
+		return internal.ChainErr(err, "Unable to open muxed file")
+	}
+	defer mf.Close()
+
+	df, err := os.Create(dest)
+	if err != nil {
+		return internal.ChainErr(err, "Unable create demo file")
+	}
+	defer df.Close()
+
+	return internal.WriteDemoHTML(mf, df)
+}
+
+func FlipAPNGFile(
+	muxed, dest string, delay time.Duration, opts internal.Options) *internal.ErrChain {
+	mf, err := os.Open(muxed)
+	if err != nil {
+		return internal.ChainErr(err, "Unable to open muxed file")
+	}
+	defer mf.Close()
+
+	df, err := os.Create(dest)
+	if err != nil {
+		return internal.ChainErr(err, "Unable create flip APNG file")
+	}
+	defer df.Close()
+
+	return internal.WriteFlipAPNG(mf, df, delay, opts)
+}
+
+func SVGFile(muxed, dest string) *internal.ErrChain {
+	mf, err := os.Open(muxed)
+	if err != nil {
+		return internal.ChainErr(err, "Unable to open muxed file")
+	}
+	defer mf.Close()
+
+	df, err := os.Create(dest)
+	if err != nil {
+		return internal.ChainErr(err, "Unable create SVG file")
+	}
+	defer df.Close()
+
+	return internal.WriteSVG(mf, df)
+}
+
+// Prints which image muxed mostly shows when decoded with each of the comma separated gammas.
+func CompareRenderersFile(muxed, gammas string, opts internal.Options) *internal.ErrChain {
+	var gs []float64
+	for _, g := range strings.Split(gammas, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(g), 64)
+		if err != nil {
+			return internal.ChainErr(err, "Unable to parse renderer gamma")
+		}
+		gs = append(gs, v)
+	}
+
+	mf, err := os.Open(muxed)
+	if err != nil {
+		return internal.ChainErr(err, "Unable to open muxed file")
+	}
+	defer mf.Close()
+	im, _, err := image.Decode(mf)
+	if err != nil {
+		return internal.ChainErr(err, "Unable to decode muxed image")
+	}
+
+	reports, ec := internal.CompareRenderers(im, gs, opts)
+	if ec != nil {
+		return ec
+	}
+	if err := internal.WriteRendererReports(os.Stdout, reports); err != nil {
+		return internal.ChainErr(err, "Unable to write renderer report")
+	}
+	reveal, ec := internal.RevealGamma(im, opts)
+	if ec != nil {
+		return ec
+	}
+	if _, err := fmt.Printf("The Full image shows from gamma %.2f up\n", reveal); err != nil {
+		return internal.ChainErr(err, "Unable to write renderer report")
+	}
+	return nil
+}
+
+// Writes the naive and corrected previews of muxed.  Empty paths are skipped.
+func PreviewFiles(muxed, naive, corrected string, opts internal.Options) *internal.ErrChain {
+	mf, err := os.Open(muxed)
+	if err != nil {
+		return internal.ChainErr(err, "Unable to open muxed file")
+	}
+	defer mf.Close()
+
+	var nw, cw io.Writer
+	if naive != "" {
+		nf, err := os.Create(naive)
+		if err != nil {
+			return internal.ChainErr(err, "Unable create naive preview file")
+		}
+		defer nf.Close()
+		nw = nf
+	}
+	if corrected != "" {
+		cf, err := os.Create(corrected)
+		if err != nil {
+			return internal.ChainErr(err, "Unable create corrected preview file")
+		}
+		defer cf.Close()
+		cw = cf
+	}
+
+	return internal.WriteInterpretations(mf, nw, cw, opts)
+}
+
+// Writes each channel of muxed as debug-r.png, debug-g.png, and debug-b.png in dir.
+func ChannelFiles(muxed, dir string) *internal.ErrChain {
+	mf, err := os.Open(muxed)
+	if err != nil {
+		return internal.ChainErr(err, "Unable to open muxed file")
+	}
+	defer mf.Close()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return internal.ChainErr(err, "Unable to make debug dir")
+	}
+	var ws [3]io.Writer
+	for i, name := range []string{"debug-r.png", "debug-g.png", "debug-b.png"} {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return internal.ChainErr(err, "Unable create channel file")
+		}
+		defer f.Close()
+		ws[i] = f
+	}
+
+	return internal.WriteChannels(mf, ws[0], ws[1], ws[2])
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "repair":
+			runRepair(os.Args[2:])
+			return
+		case "repair-dir":
+			runRepairDir(os.Args[2:])
+			return
+		case "info":
+			runInfo(os.Args[2:])
+			return
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "extract":
+			runExtract(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Parse()
+	if !*tilepairs && flag.NArg() > 0 {
+		// Most likely a value for -stretch, which as a bool flag doesn't take one after a space.
+		log.Println("Unexpected argument " + flag.Arg(0) + ", flag values such as" +
+			" -stretch=0.5 must be given after =")
+		os.Exit(1)
+	}
+	if ec := loadConfig(*configfile); ec != nil {
+		log.Println(ec)
+		os.Exit(1)
+	}
+
+	if *alphathreshold > 0xFF {
+		log.Println("-alpha-threshold must be between 0 and 255")
+		os.Exit(1)
+	}
+
+	if *explain {
+		// With -dest -, stdout is the muxed image, so explain on stderr instead.
+		out := os.Stdout
+		if *dest == "-" {
+			out = os.Stderr
+		}
+		if err := internal.ExplainOpts(out, options()); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		if *thumbnail == "" && *full == "" && *thumbnailtext == "" && !*tilepairs && !*thumbfromfull &&
+			*batch == "" {
+			return
+		}
+	}
+
+	if *timing {
+		timings = new(internal.Timings)
+	}
+	if *printlayout {
+		layout = new(internal.Layout)
+	}
+	if *maxfilesize != "" {
+		var ec *internal.ErrChain
+		if maxFileSize, ec = internal.ParseByteSize(*maxfilesize); ec != nil {
+			log.Println(ec)
+			os.Exit(1)
+		}
+	}
+	if *maxupload != "" {
+		var ec *internal.ErrChain
+		if maxUpload, ec = internal.ParseByteSize(*maxupload); ec != nil {
+			log.Println(ec)
+			os.Exit(1)
+		}
+	}
+	if maxUpload <= 0 {
+		log.Println("-max-upload must be positive")
+		os.Exit(1)
+	}
+	if *parallelpairs || *batch != "" {
+		var ec *internal.ErrChain
+		if memoryBudget, ec = internal.ParseByteSize(*membudget); ec != nil {
+			log.Println(ec)
+			os.Exit(1)
+		}
+	}
+	if *thumbcrop != "" {
+		var ec *internal.ErrChain
+		if thumbCropRect, ec = internal.ParseRect(*thumbcrop); ec != nil {
+			log.Println(ec)
+			os.Exit(1)
+		}
+	}
+	if *fullcrop != "" {
+		var ec *internal.ErrChain
+		if fullCropRect, ec = internal.ParseRect(*fullcrop); ec != nil {
+			log.Println(ec)
+			os.Exit(1)
+		}
+	}
+	if *scaler != "" {
+		var ec *internal.ErrChain
+		if fullScaler, ec = internal.ParseScaler(*scaler); ec != nil {
+			log.Println(ec)
+			os.Exit(1)
+		}
+	}
+	if *compression != "" {
+		var ec *internal.ErrChain
+		if pngCompression, ec = internal.ParseCompressionLevel(*compression); ec != nil {
+			log.Println(ec)
+			os.Exit(1)
+		}
+	}
+	if *background != "" {
+		var ec *internal.ErrChain
+		if backgroundColor, ec = internal.ParseColor(*background); ec != nil {
+			log.Println(ec)
+			os.Exit(1)
+		}
+	}
+	if *aspect != "" {
+		var ec *internal.ErrChain
+		if aspectRatio, ec = internal.ParseAspect(*aspect); ec != nil {
+			log.Println(ec)
+			os.Exit(1)
+		}
+	}
+	if *ditherseed != "" {
+		im, ec := loadDitherSeed(*ditherseed)
+		if ec != nil {
+			log.Println(ec)
+			os.Exit(1)
+		}
+		ditherSeedImage = im
+	}
+
+	if *dest == "-" && (*watch || *withfallback || *previewout != "" || *naivepreviewout != "" ||
+		*htmlsnippet != "" || *demoout != "" || *flipapng != "" || *svgout != "" ||
+		*debugchannels != "" || *comparerenderers != "") {
+		log.Println("-dest - can't be used with -watch, or with flags that read the dest file back")
+		os.Exit(1)
+	}
+	if *full == "-" && *withfallback {
+		log.Println("-with-fallback can't be used with -full -, which is only read once")
+		os.Exit(1)
+	}
 
-	if *thumbnail == "" && *full == "" && *webfallback {
+	var ec *internal.ErrChain
+	if *batch != "" {
+		ec = GammaMuxBatch(*batch, *batchthumbsuffix, *batchfullsuffix, *batchworkers, options())
+	} else if *tilepairs {
+		ec = GammaMuxTileFiles(flag.Args(), *dest, options())
+	} else if *thumbnailtext != "" {
+		ec = GammaMuxTextFiles(*thumbnailtext, *full, *dest, options())
+	} else if *thumbfromfull {
+		ec = GammaMuxFromFullFiles(*full, *dest, options())
+	} else if *thumbnail == "" && *full == "" && *webfallback {
 		runHttpServer()
-	} else if ec := GammaMuxFiles(*thumbnail, *full, *dest, *dither, *stretch); ec != nil {
-		log.Println(ec)
+	} else if *watch {
+		watchFiles([]string{*thumbnail, *full}, *dest, func() *internal.ErrChain {
+			return GammaMuxFiles(*thumbnail, *full, *dest, options())
+		})
+	} else {
+		ec = GammaMuxFiles(*thumbnail, *full, *dest, options())
+	}
+	if ec == nil && *withfallback && *full != "" {
+		ec = GammaFallbackFiles(*full, fallbackPath(*dest))
+	}
+	if ec == nil && (*previewout != "" || *naivepreviewout != "") {
+		ec = PreviewFiles(*dest, *naivepreviewout, *previewout, options())
+	}
+	if ec == nil && *htmlsnippet != "" {
+		ec = HTMLSnippetFile(*dest, *htmlsnippet)
+	}
+	if ec == nil && *demoout != "" {
+		ec = DemoFile(*dest, *demoout)
+	}
+	if ec == nil && *flipapng != "" {
+		ec = FlipAPNGFile(*dest, *flipapng, *flipdelay, options())
+	}
+	if ec == nil && *svgout != "" {
+		ec = SVGFile(*dest, *svgout)
+	}
+	if ec == nil && *debugchannels != "" {
+		ec = ChannelFiles(*dest, *debugchannels)
+	}
+	if ec == nil && *comparerenderers != "" {
+		ec = CompareRenderersFile(*dest, *comparerenderers, options())
+	}
+	if ec != nil {
+		if *jsonout {
+			json.NewEncoder(os.Stderr).Encode(ec)
+		} else {
+			log.Println(ec)
+		}
 		os.Exit(1)
 	}
+
+	if *timing {
+		var err error
+		if *jsonout {
+			err = json.NewEncoder(os.Stderr).Encode(timings.Stages)
+		} else {
+			err = timings.WriteText(os.Stderr)
+		}
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
+	if *printlayout {
+		var err error
+		if *jsonout {
+			err = json.NewEncoder(os.Stderr).Encode(layout)
+		} else {
+			err = layout.WriteText(os.Stderr)
+		}
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+func TestStretchFlag(t *testing.T) {
+	tests := []struct {
+		args []string
+		want float64
+	}{
+		{nil, 1},
+		{[]string{"-stretch"}, 1},
+		{[]string{"-stretch=false"}, 0},
+		{[]string{"-stretch=true"}, 1},
+		{[]string{"-stretch=0"}, 0},
+		{[]string{"-stretch=0.5"}, 0.5},
+		{[]string{"-stretch=1.0"}, 1},
+	}
+	for _, tt := range tests {
+		s := stretchFlag(1)
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Var(&s, "stretch", "")
+		if err := fs.Parse(tt.args); err != nil {
+			t.Errorf("%v: %v", tt.args, err)
+			continue
+		}
+		if float64(s) != tt.want {
+			t.Errorf("%v: stretch = %v, want %v", tt.args, s, tt.want)
+		}
+		if fs.NArg() != 0 {
+			t.Errorf("%v: left over args %v", tt.args, fs.Args())
+		}
+	}
+}
+
+func TestStretchFlagBad(t *testing.T) {
+	for _, v := range []string{"-0.5", "1.5", "NaN", "half"} {
+		s := stretchFlag(1)
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.Var(&s, "stretch", "")
+		if err := fs.Parse([]string{"-stretch=" + v}); err == nil {
+			t.Errorf("-stretch=%s: no error, stretch = %v", v, s)
+		}
+	}
+}
+
+// Without =, the number isn't taken as the value, and is left over for main to reject.
+func TestStretchFlagSpace(t *testing.T) {
+	s := stretchFlag(0)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&s, "stretch", "")
+	if err := fs.Parse([]string{"-stretch", "0.5"}); err != nil {
+		t.Fatal(err)
+	}
+	if s != 1 || fs.NArg() != 1 || fs.Arg(0) != "0.5" {
+		t.Errorf("stretch = %v, args = %v, want 1 and [0.5]", s, fs.Args())
+	}
+}
@@ -0,0 +1,30 @@
+// Package pngchunk reads and writes PNG streams one chunk at a time, checking the signature and
+// each chunk's CRC.  It is what gammux uses to splice gAMA and other chunks into PNGs.
+package pngchunk
+
+import (
+	"io"
+
+	"github.com/carl-mastrangelo/gammux/internal"
+)
+
+// Reader reads the chunks of a PNG stream.  Next returns the type and data of each chunk in
+// turn, and io.EOF once the stream ends cleanly between chunks.
+type Reader = internal.PNGChunkReader
+
+// Writer writes a PNG stream one chunk at a time, adding the signature and CRCs.
+type Writer = internal.PNGChunkWriter
+
+// ErrBadCRC is the cause of the error Reader returns for a chunk whose CRC doesn't match.  Chunks
+// cut short fail with io.ErrUnexpectedEOF instead.  Check for either with errors.Is.
+var ErrBadCRC = internal.ErrBadCRC
+
+// NewReader returns a Reader of the PNG in r.  The signature is checked before the first chunk.
+func NewReader(r io.Reader) *Reader {
+	return internal.NewPNGChunkReader(r)
+}
+
+// NewWriter returns a Writer to w.  The signature is written before the first chunk.
+func NewWriter(w io.Writer) *Writer {
+	return internal.NewPNGChunkWriter(w)
+}
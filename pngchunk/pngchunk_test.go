@@ -0,0 +1,104 @@
+package pngchunk
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type chunk struct {
+	chunkType string
+	data      []byte
+}
+
+var testChunks = []chunk{
+	{"IHDR", []byte{0, 0, 0, 1, 0, 0, 0, 1, 8, 0, 0, 0, 0}},
+	{"gAMA", []byte{0, 0, 0x08, 0xE1}},
+	{"IDAT", []byte{0x78, 0x9C, 0x63, 0x60, 0, 0, 0, 2, 0, 1}},
+	{"IEND", []byte{}},
+}
+
+func writeChunks(t *testing.T, chunks []chunk) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, c := range chunks {
+		if err := w.WriteChunk(c.chunkType, c.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Reads chunks until an error, which is returned unless it is io.EOF.
+func readChunks(data []byte) ([]chunk, error) {
+	r := NewReader(bytes.NewReader(data))
+	var chunks []chunk
+	for {
+		chunkType, data, err := r.Next()
+		if err == io.EOF {
+			return chunks, nil
+		} else if err != nil {
+			return chunks, err
+		}
+		chunks = append(chunks, chunk{chunkType, data})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	got, err := readChunks(writeChunks(t, testChunks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, testChunks) {
+		t.Errorf("got %v, want %v", got, testChunks)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	data := writeChunks(t, testChunks)
+	// Chunk boundaries, where the stream could end cleanly.
+	ends := map[int]bool{}
+	end := 8
+	for _, c := range testChunks {
+		end += 4 + 4 + len(c.data) + 4
+		ends[end] = true
+	}
+	for n := 9; n < len(data); n++ {
+		_, err := readChunks(data[:n])
+		if ends[n] {
+			if err != nil {
+				t.Errorf("cut at chunk end %d: %v", n, err)
+			}
+		} else if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("cut at %d: got %v, want io.ErrUnexpectedEOF", n, err)
+		}
+	}
+}
+
+func TestBadCRC(t *testing.T) {
+	data := writeChunks(t, testChunks)
+	// Flip a bit in the gAMA data, after the signature and the 25 byte IHDR chunk.
+	data[8+25+8+2] ^= 0x10
+	got, err := readChunks(data)
+	if !errors.Is(err, ErrBadCRC) {
+		t.Errorf("got %v, want ErrBadCRC", err)
+	}
+	if len(got) != 1 {
+		t.Errorf("read %d chunks before the bad one, want 1", len(got))
+	}
+}
+
+func TestNotPNG(t *testing.T) {
+	if _, err := readChunks([]byte("GIF89a is not a PNG")); err == nil {
+		t.Error("no error for a GIF")
+	}
+}
+
+func TestBadChunkType(t *testing.T) {
+	if err := NewWriter(io.Discard).WriteChunk("gAMAx", nil); err == nil {
+		t.Error("no error for a 5 letter chunk type")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/carl-mastrangelo/gammux/internal"
+)
+
+// Re-inserts the gAMA chunk into a muxed PNG that had it stripped, such as by an upload pipeline.
+func runRepair(args []string) {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	in := fs.String("in", "", "The file path of the PNG image to repair")
+	out := fs.String("out", "", "The dest file path of the repaired PNG image")
+	gamma := fs.Float64("gamma", internal.DefaultTargetGamma, "The gamma to declare in the PNG")
+	strict := fs.Bool("strict", false, "If true, fails on any warning, such as a gamma too low"+
+		" for the Full image to show")
+	fs.Parse(args)
+
+	if ec := internal.CheckGamma(*gamma); ec != nil {
+		log.Println(ec)
+		os.Exit(1)
+	}
+	if warning := internal.WarnGamma(*gamma, internal.DefaultSourceGamma); warning != "" {
+		log.Println(warning)
+		if *strict {
+			os.Exit(1)
+		}
+	}
+
+	if ec := RepairFile(*in, *out, *gamma); ec != nil {
+		log.Println(ec)
+		os.Exit(1)
+	}
+}
+
+func RepairFile(in, out string, gamma float64) *internal.ErrChain {
+	inf, err := os.Open(in)
+	if err != nil {
+		return internal.ChainErr(err, "Unable to open input file")
+	}
+	defer inf.Close()
+
+	outf, err := os.Create(out)
+	if err != nil {
+		return internal.ChainErr(err, "Unable create dest file")
+	}
+	defer outf.Close()
+
+	return internal.RepairGamma(inf, outf, gamma)
+}
+
+// Repairs every muxed PNG in a directory that is missing its gamma, in place.  PNGs that don't
+// look muxed are left alone.
+func runRepairDir(args []string) {
+	fs := flag.NewFlagSet("repair-dir", flag.ExitOnError)
+	dir := fs.String("dir", "", "The directory of PNG images to repair")
+	gamma := fs.Float64("gamma", internal.DefaultTargetGamma, "The gamma to declare in the PNGs")
+	workers := fs.Int("workers", runtime.NumCPU(), "How many PNGs to repair at the same time")
+	scaling := fs.Int("full-scaling", 2, "The -full-scaling the PNGs were muxed with, to tell"+
+		" which look muxed")
+	fs.Parse(args)
+
+	if ec := internal.CheckGamma(*gamma); ec != nil {
+		log.Println(ec)
+		os.Exit(1)
+	}
+	if *workers < 1 {
+		log.Println("-workers must be at least 1")
+		os.Exit(1)
+	}
+	if *scaling < 2 {
+		log.Println("-full-scaling must be at least 2")
+		os.Exit(1)
+	}
+	paths, err := filepath.Glob(filepath.Join(*dir, "*.png"))
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	results := make([]string, len(paths))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if result, ec := RepairDirFile(paths[i], *gamma, *scaling); ec != nil {
+					results[i] = "failed: " + strings.Replace(ec.Error(), "\n", " ", -1)
+				} else {
+					results[i] = result
+				}
+			}
+		}()
+	}
+	for i := range paths {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	counts := make(map[string]int)
+	for i, path := range paths {
+		fmt.Printf("%s: %s\n", path, results[i])
+		counts[strings.SplitN(results[i], ":", 2)[0]]++
+	}
+	fmt.Printf("%d repaired, %d already had gamma, %d not muxed, %d failed\n",
+		counts["repaired"], counts["already had gamma"], counts["not muxed"], counts["failed"])
+	if counts["failed"] > 0 {
+		os.Exit(1)
+	}
+}
+
+// Repairs path in place if it is a muxed PNG without the right gamma, and says what was done.
+func RepairDirFile(path string, gamma float64, scaling int) (string, *internal.ErrChain) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", internal.ChainErr(err, "Unable to read file")
+	}
+	info, ec := internal.ReadPNGInfo(bytes.NewReader(data))
+	if ec != nil {
+		return "", ec
+	}
+	if info.HasGamma && info.GamaValue == internal.GamaChunkValue(gamma) {
+		return "already had gamma", nil
+	}
+	im, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", internal.ChainErr(err, "Unable to decode PNG")
+	}
+	if _, ok := internal.DetectLattice(im, internal.Options{FullScaling: scaling}); !ok {
+		return "not muxed", nil
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", internal.ChainErr(err, "Unable to stat file")
+	}
+	// Write next to the original and rename over it, so a failure can't leave it half written.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".repair-*.png")
+	if err != nil {
+		return "", internal.ChainErr(err, "Unable to create temp file")
+	}
+	defer os.Remove(tmp.Name())
+	// Temp files are only readable by their owner, so give it the permissions of the original.
+	if err := tmp.Chmod(stat.Mode().Perm()); err != nil {
+		tmp.Close()
+		return "", internal.ChainErr(err, "Unable to set temp file permissions")
+	}
+	if ec := internal.RepairGamma(bytes.NewReader(data), tmp, gamma); ec != nil {
+		tmp.Close()
+		return "", ec
+	}
+	if err := tmp.Close(); err != nil {
+		return "", internal.ChainErr(err, "Unable to write temp file")
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", internal.ChainErr(err, "Unable to replace file")
+	}
+	return "repaired", nil
+}
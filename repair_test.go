@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/carl-mastrangelo/gammux/internal"
+)
+
+// Repairing a file replaces it, but keeps its permissions.
+func TestRepairDirFileMode(t *testing.T) {
+	thumbnail := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	full := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			thumbnail.Set(x, y, color.Gray{0x80})
+			full.Set(x/2, y/2, color.White)
+		}
+	}
+	muxed, ec := internal.GammaMuxImagesOpts(thumbnail, full, internal.Options{})
+	if ec != nil {
+		t.Fatal(ec)
+	}
+	// Encoded without the gAMA chunk, as some tools strip it.
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, muxed); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "muxed.png")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// WriteFile is subject to the umask, so set the mode exactly.
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, ec := RepairDirFile(path, internal.DefaultTargetGamma, 2)
+	if ec != nil {
+		t.Fatal(ec)
+	}
+	if result != "repaired" {
+		t.Fatalf("result %q, want repaired", result)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := stat.Mode().Perm(); mode != 0644 {
+		t.Errorf("mode %v after repair, want %v", mode, os.FileMode(0644))
+	}
+}
@@ -1,8 +1,11 @@
+//go:build js && wasm
+
 package main
 
 import (
 	"bytes"
 	"encoding/base64"
+	"image/png"
 	"syscall/js"
 
 	"github.com/carl-mastrangelo/gammux/internal"
@@ -15,7 +18,7 @@ type fileOrErr struct {
 	err  error
 }
 
-func watchFile(elementId string) <-chan fileOrErr {
+func watchFile(elementId string) chan fileOrErr {
 	res := make(chan fileOrErr)
 	cb := js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
 		files := args[0].Get("target").Get("files")
@@ -23,27 +26,7 @@ func watchFile(elementId string) <-chan fileOrErr {
 			res <- fileOrErr{}
 			return nil
 		}
-		file := files.Index(0)
-		fr := js.Global().Get("FileReader").New()
-		fr.Call("readAsArrayBuffer", file)
-		fr.Set("onload", js.FuncOf(func(_ js.Value, args2 []js.Value) interface{} {
-			arrayBuffer := fr.Get("result")
-			data := js.Global().Get("Uint8Array").New(arrayBuffer)
-			dst := make([]byte, data.Get("length").Int())
-			for i := 0; i < len(dst); i++ {
-				dst[i] = byte(data.Index(i).Int())
-			}
-			res <- fileOrErr{
-				data: dst,
-			}
-			return nil
-		}))
-		fr.Set("onerror", js.FuncOf(func(_ js.Value, args2 []js.Value) interface{} {
-			res <- fileOrErr{
-				err: js.Error{Value: fr.Get("error")},
-			}
-			return nil
-		}))
+		readFile(files.Index(0), res)
 		return nil
 	})
 	doc := js.Global().Get("document")
@@ -52,8 +35,69 @@ func watchFile(elementId string) <-chan fileOrErr {
 	return res
 }
 
+// Reads file, and sends its contents to res once loaded.
+func readFile(file js.Value, res chan<- fileOrErr) {
+	fr := js.Global().Get("FileReader").New()
+	fr.Call("readAsArrayBuffer", file)
+	fr.Set("onload", js.FuncOf(func(_ js.Value, args2 []js.Value) interface{} {
+		arrayBuffer := fr.Get("result")
+		data := js.Global().Get("Uint8Array").New(arrayBuffer)
+		dst := make([]byte, data.Get("length").Int())
+		for i := 0; i < len(dst); i++ {
+			dst[i] = byte(data.Index(i).Int())
+		}
+		res <- fileOrErr{
+			data: dst,
+		}
+		return nil
+	}))
+	fr.Set("onerror", js.FuncOf(func(_ js.Value, args2 []js.Value) interface{} {
+		res <- fileOrErr{
+			err: js.Error{Value: fr.Get("error")},
+		}
+		return nil
+	}))
+}
+
+// Reads files dropped on the page.  Two files are the thumbnail and full images, in order.  Files
+// dropped on a file input are left to the browser, which fires its change event.
+func watchDrop(thumb, full chan<- fileOrErr) {
+	isFileInput := func(event js.Value) bool {
+		target := event.Get("target")
+		return target.Get("tagName").String() == "INPUT" && target.Get("type").String() == "file"
+	}
+	doc := js.Global().Get("document")
+	dragover := js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+		if !isFileInput(args[0]) {
+			// Needed for the page to accept the drop, rather than the browser opening the file.
+			args[0].Call("preventDefault")
+		}
+		return nil
+	})
+	doc.Call("addEventListener", "dragover", dragover)
+	doc.Call("addEventListener", "drop", js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+		if isFileInput(args[0]) {
+			return nil
+		}
+		args[0].Call("preventDefault")
+		files := args[0].Get("dataTransfer").Get("files")
+		if files.Get("length").Int() != 2 {
+			publishNotice("Drop two images, the thumbnail then the full, or drop one on a picker")
+			return nil
+		}
+		readFile(files.Index(0), thumb)
+		readFile(files.Index(1), full)
+		return nil
+	}))
+}
+
+// The PNG shown in the muxxed element, for the download button.
+var muxed []byte
+
 func setImage(data []byte) {
+	muxed = data
 	doc := js.Global().Get("document")
+	doc.Call("getElementById", "download").Set("disabled", len(data) == 0)
 	elem := doc.Call("getElementById", "muxxed")
 	if len(data) != 0 {
 		enc := base64.StdEncoding
@@ -65,11 +109,62 @@ func setImage(data []byte) {
 	}
 }
 
+// Saves the shown PNG as merged.png when the download button is clicked, like the web UI's
+// Content-Disposition.
+func watchDownload() {
+	doc := js.Global().Get("document")
+	cb := js.FuncOf(func(_ js.Value, _ []js.Value) interface{} {
+		if len(muxed) == 0 {
+			return nil
+		}
+		arr := js.Global().Get("Uint8Array").New(len(muxed))
+		js.CopyBytesToJS(arr, muxed)
+		blob := js.Global().Get("Blob").New(
+			[]interface{}{arr}, map[string]interface{}{"type": "image/png"})
+		url := js.Global().Get("URL").Call("createObjectURL", blob)
+		a := doc.Call("createElement", "a")
+		a.Set("href", url)
+		a.Set("download", "merged.png")
+		a.Get("style").Set("display", "none")
+		body := doc.Get("body")
+		body.Call("appendChild", a)
+		a.Call("click")
+		body.Call("removeChild", a)
+		js.Global().Get("URL").Call("revokeObjectURL", url)
+		return nil
+	})
+	doc.Call("getElementById", "download").Call("addEventListener", "click", cb)
+}
+
+// Sends on the returned channel whenever one of the checkboxes is toggled.
+func watchToggles(elementIds ...string) <-chan struct{} {
+	res := make(chan struct{})
+	cb := js.FuncOf(func(_ js.Value, _ []js.Value) interface{} {
+		res <- struct{}{}
+		return nil
+	})
+	doc := js.Global().Get("document")
+	for _, id := range elementIds {
+		doc.Call("getElementById", id).Call("addEventListener", "change", cb)
+	}
+	return res
+}
+
+func checked(elementId string) bool {
+	return js.Global().Get("document").Call("getElementById", elementId).Get("checked").Bool()
+}
+
 func gen(thumb, full []byte) ([]byte, error) {
 	dst := new(bytes.Buffer)
 	t := bytes.NewBuffer(thumb)
 	f := bytes.NewBuffer(full)
-	if err := internal.GammaMuxData(t, f, dst /*dither=*/, true /*stretch=*/, true); err != nil {
+	opts := internal.Options{
+		Dither:  checked("dither"),
+		Stretch: checked("stretch"),
+		// The page waits on the encoder, so favor speed over size.
+		CompressionLevel: png.BestSpeed,
+	}
+	if err := internal.GammaMuxDataOpts(t, f, dst, opts); err != nil {
 		return nil, err
 	}
 	return dst.Bytes(), nil
@@ -94,6 +189,9 @@ func publishNotice(msg string) {
 func main() {
 	thumbFile := watchFile("thumb")
 	fullFile := watchFile("full")
+	watchDrop(thumbFile, fullFile)
+	toggled := watchToggles("dither", "stretch")
+	watchDownload()
 
 	var thumb []byte
 	var full []byte
@@ -111,6 +209,7 @@ func main() {
 			} else {
 				full = r.data
 			}
+		case <-toggled:
 		}
 		setImage(nil)
 		if len(thumb) == 0 || len(full) == 0 {
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/carl-mastrangelo/gammux/internal"
+)
+
+const (
+	// How often watched files are checked for changes.
+	watchInterval = 250 * time.Millisecond
+	// How long watched files must stay unchanged before rerunning, so an editor saving in several
+	// steps only causes one run.
+	watchSettle = 500 * time.Millisecond
+)
+
+// Runs run to write dest, and again each time any of paths changes, until the process is
+// interrupted.  Errors from run are logged rather than stopping the watch, since the next save may
+// fix them.
+func watchFiles(paths []string, dest string, run func() *internal.ErrChain) {
+	// Returns a fingerprint of the files that changes whenever one of them is written.
+	state := func() string {
+		var s string
+		for _, p := range paths {
+			if fi, err := os.Stat(p); err == nil {
+				s += fmt.Sprintf("%v/%d|", fi.ModTime(), fi.Size())
+			} else {
+				s += "missing|"
+			}
+		}
+		return s
+	}
+
+	last := state()
+	if ec := run(); ec != nil {
+		log.Println(ec)
+	} else {
+		log.Println("Generated", dest)
+	}
+	for {
+		time.Sleep(watchInterval)
+		current := state()
+		if current == last {
+			continue
+		}
+		// Wait for the files to settle down.
+		for {
+			time.Sleep(watchSettle)
+			settled := state()
+			if settled == current {
+				break
+			}
+			current = settled
+		}
+		last = current
+		if ec := run(); ec != nil {
+			log.Println(ec)
+		} else {
+			log.Println("Regenerated", dest)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package web
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/carl-mastrangelo/gammux/internal"
+)
+
+// DefaultMaxUpload is the largest request Handler accepts.
+const DefaultMaxUpload = 25 << 20
+
+// Options is how the uploaded images are muxed.
+type Options = internal.Options
+
+// Cache keeps recent outputs, to reuse for repeated requests.
+type Cache = internal.Cache
+
+// NewCache returns a Cache holding up to size outputs.
+func NewCache(size int) *Cache {
+	return internal.NewCache(size)
+}
+
+type handler struct {
+	opts      Options
+	maxUpload int64
+	cache     *Cache
+}
+
+// Handler returns the gammux web UI.  GET serves a form for uploading a Thumbnail and Full image,
+// and POST responds with them muxed using opts, in the format and preset of the query
+// parameters.  Uploads bigger than DefaultMaxUpload are refused.
+func Handler(opts Options) http.Handler {
+	return NewHandler(opts, DefaultMaxUpload, nil)
+}
+
+// NewHandler is Handler refusing uploads bigger than maxUpload, and reusing outputs from cache,
+// which may be nil.  If maxUpload is 0, DefaultMaxUpload is used.
+func NewHandler(opts Options, maxUpload int64, cache *Cache) http.Handler {
+	if maxUpload == 0 {
+		maxUpload = DefaultMaxUpload
+	}
+	// Timings and layouts aren't safe to share between concurrent requests.
+	opts.Timings = nil
+	opts.Layout = nil
+	return &handler{opts: opts, maxUpload: maxUpload, cache: cache}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Write([]byte(`
+      <!doctype html>
+      <html>
+      <head>
+        <meta charset="utf-8">
+        <title>Gammux - Gamma Muxer</title>
+      </head>
+      <body>
+      <h1>Gammux - Gamma Muxer</h1>
+      <fieldset>
+        <form action="?format=page" method="post" enctype="multipart/form-data">
+          <dl>
+            <dt style="display:inline-block">Thumbnail Image</dt>
+            <dd style="display:inline-block"><input type="file" name="thumbnail" /></dd>
+          </dl>
+          <dl>
+            <dt style="display:inline-block">Full Image</dt>
+            <dd style="display:inline-block"><input type="file" name="full" /></dd>
+          </dl>
+          <input type="submit" value="Submit" />
+        </form>
+      </fieldset>
+      </body>
+      </html>
+      `))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxUpload)
+	if err := r.ParseMultipartForm(h.maxUpload); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, fmt.Sprintf("Upload is bigger than %d bytes", tooBig.Limit),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "Problem reading upload "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	thumbnail, err := readFormFile(r, "thumbnail")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Problem reading thumbnail "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	full, err := readFormFile(r, "full")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Problem reading full "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts := h.opts
+	if ec := internal.ApplyPreset(r.URL.Query().Get("preset"), &opts); ec != nil {
+		http.Error(w, ec.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "png"
+	}
+	switch format {
+	case "png", "webp", "jpeg", "datauri", "preview", "page":
+	default:
+		http.Error(w, "Unknown format "+format+", must be png, webp, jpeg, datauri, preview, or"+
+			" page", http.StatusBadRequest)
+		return
+	}
+	opts.Format = "png"
+	if format == "webp" {
+		opts.Format = "webp"
+	}
+	etag := `"` + internal.Fingerprint(thumbnail, full, opts) + "-" + format + `"`
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		// The client already has this output, so it gets no body, only the ETag it matched.
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	// Only successful outputs are cacheable, so the headers are set just before writing one.
+	cacheable := func() {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+	}
+	var dest bytes.Buffer
+	if cached, ok := h.cache.Get(etag); ok {
+		dest.Write(cached)
+	} else {
+		var ec *internal.ErrChain
+		if format == "jpeg" {
+			// JPEG has no gamma, so the best it can do is the plain Full image.
+			ec = internal.GammaFallbackData(bytes.NewReader(full), &dest)
+		} else {
+			// Stop muxing if the client goes away, since nobody would get the result.
+			ec = internal.GammaMuxDataContext(
+				r.Context(), bytes.NewReader(thumbnail), bytes.NewReader(full), &dest, opts)
+		}
+		if ec != nil {
+			log.Println(ec)
+			if r.Context().Err() != nil {
+				// Nobody is left to tell.
+				return
+			}
+			var decodeErr *internal.DecodeError
+			if errors.As(ec, &decodeErr) {
+				http.Error(w, "Problem decoding "+decodeErr.Which+" "+decodeErr.Error(),
+					http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Problem making image "+ec.Error(), http.StatusBadRequest)
+			return
+		}
+		h.cache.Add(etag, append([]byte(nil), dest.Bytes()...))
+	}
+	switch format {
+	case "jpeg":
+		cacheable()
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"merged.fallback.jpg\"")
+		w.Write(dest.Bytes())
+	case "webp":
+		cacheable()
+		w.Header().Set("Content-Type", "image/webp")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"merged.webp\"")
+		w.Write(dest.Bytes())
+	case "datauri":
+		cacheable()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("data:image/png;base64," + base64.StdEncoding.EncodeToString(dest.Bytes())))
+	case "preview":
+		var preview bytes.Buffer
+		if ec := internal.WriteThumbnailPreview(
+			bytes.NewReader(dest.Bytes()), &preview, opts); ec != nil {
+			log.Println(ec)
+			http.Error(w, "Problem making preview "+ec.Error(), http.StatusInternalServerError)
+			return
+		}
+		cacheable()
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(preview.Bytes())
+	case "page":
+		var preview, corrected bytes.Buffer
+		if ec := internal.WriteThumbnailPreview(
+			bytes.NewReader(dest.Bytes()), &preview, opts); ec != nil {
+			log.Println(ec)
+			http.Error(w, "Problem making preview "+ec.Error(), http.StatusInternalServerError)
+			return
+		}
+		if ec := internal.WriteInterpretations(
+			bytes.NewReader(dest.Bytes()), nil, &corrected, opts); ec != nil {
+			log.Println(ec)
+			http.Error(w, "Problem making preview "+ec.Error(), http.StatusInternalServerError)
+			return
+		}
+		cacheable()
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		writeResultPage(w, dest.Bytes(), corrected.Bytes(), preview.Bytes())
+	default:
+		cacheable()
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"merged.png\"")
+		w.Write(dest.Bytes())
+	}
+}
+
+func readFormFile(r *http.Request, key string) ([]byte, error) {
+	f, _, err := r.FormFile(key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// Checks if etag is in the comma separated If-None-Match header value.  "*" is not a match, since
+// it would fail every upload, not just repeated ones.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if candidate = strings.TrimSpace(candidate); candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes a page showing the gamma corrected rendering of muxed next to the thumbnail preview,
+// with a link to download muxed.
+func writeResultPage(w io.Writer, muxed, corrected, preview []byte) {
+	dataURI := func(png []byte) string {
+		return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+	}
+	fmt.Fprintf(w, `
+      <!doctype html>
+      <html>
+      <head>
+        <meta charset="utf-8">
+        <title>Gammux - Gamma Muxer</title>
+      </head>
+      <body>
+      <h1>Gammux - Gamma Muxer</h1>
+      <figure style="display:inline-block">
+        <img src="%s" />
+        <figcaption>Full rendering, where gamma is honored</figcaption>
+      </figure>
+      <figure style="display:inline-block">
+        <img src="%s" />
+        <figcaption>Simulated thumbnail, where gamma is ignored</figcaption>
+      </figure>
+      <p><a href="%s" download="merged.png">Download merged.png</a></p>
+      </body>
+      </html>
+      `, dataURI(corrected), dataURI(preview), dataURI(muxed))
+}
@@ -0,0 +1,100 @@
+package web
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testPNG(t *testing.T, c color.Color) []byte {
+	t.Helper()
+	im := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			im.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, im); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func uploadRequest(t *testing.T, thumbnail, full []byte, ifNoneMatch string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{"thumbnail", thumbnail}, {"full", full}} {
+		fw, err := mw.CreateFormFile(f.name, f.name+".png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(f.data)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if ifNoneMatch != "" {
+		r.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	return r
+}
+
+func TestETag(t *testing.T) {
+	h := Handler(Options{})
+	thumbnail, full := testPNG(t, color.White), testPNG(t, color.Black)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, uploadRequest(t, thumbnail, full, ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Cache-Control") == "" {
+		t.Fatalf("missing caching headers: %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, uploadRequest(t, thumbnail, full, `"other", `+etag))
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("matching If-None-Match: status %d with %d bytes, want %d with none",
+			w.Code, w.Body.Len(), http.StatusNotModified)
+	}
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Errorf("matching If-None-Match: ETag %s, want %s", got, etag)
+	}
+
+	for _, tag := range []string{"*", `"other"`} {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, uploadRequest(t, thumbnail, full, tag))
+		if w.Code != http.StatusOK {
+			t.Errorf("If-None-Match %s: status %d, want %d", tag, w.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestETagNotSetOnFailure(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := uploadRequest(t, []byte("not an image"), testPNG(t, color.Black), "")
+	Handler(Options{}).ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if etag := w.Header().Get("ETag"); etag != "" {
+		t.Errorf("failed mux has ETag %s", etag)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "" {
+		t.Errorf("failed mux has Cache-Control %s", cc)
+	}
+}